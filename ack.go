@@ -0,0 +1,297 @@
+package aun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Acked delivery errors
+var (
+	ErrAckTimeout = errors.New("Message is not acknowledged in time")
+)
+
+// Acknowledged delivery settings.
+type AckPolicy struct {
+	// First retry interval, doubled on each retry ( default 1s )
+	Backoff time.Duration
+
+	// Max number of retries ( default 5 )
+	Retries int
+
+	// Time to wait for the ack before the delivery fails ( default 30s )
+	Timeout time.Duration
+}
+
+// Default acked delivery settings
+var defaultAckPolicy = AckPolicy{
+	Backoff: time.Second,
+	Retries: 5,
+	Timeout: 30 * time.Second,
+}
+
+// Result of acked delivery, resolved on ack or failure.
+type Delivery struct {
+	// Message ID in the envelope
+	Id uint64
+
+	done chan struct{}
+	err  error
+}
+
+// Get the channel closed when the delivery is resolved.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Get the delivery error, nil if acknowledged.
+// Must be called after Done() is closed.
+func (d *Delivery) Err() error {
+	return d.err
+}
+
+// Wait until the delivery is resolved.
+func (d *Delivery) Wait() error {
+	<-d.done
+	return d.err
+}
+
+// Resolve the delivery.
+func (d *Delivery) resolve(err error) {
+	d.err = err
+	close(d.done)
+}
+
+// Create the resolved delivery.
+func resolvedDelivery(err error) *Delivery {
+	d := &Delivery{done: make(chan struct{})}
+	d.resolve(err)
+	return d
+}
+
+// Message waiting for the ack.
+type pendingAck struct {
+	delivery *Delivery
+	opcode   int
+	payload  []byte
+	retries  int
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// Queued message of the ack tracker.
+// Not kept in the suspended session, since the tracker resends it on resumption.
+type ackMessage struct {
+	Readable
+}
+
+// Unacked messages of the connection.
+// Moved to the resumed connection with the session.
+type ackTracker struct {
+	mutex   sync.Mutex
+	conn    *Connection
+	policy  AckPolicy
+	nextId  uint64
+	pending map[uint64]*pendingAck
+}
+
+// Create ack tracker for the connection.
+func newAckTracker(c *Connection, policy *AckPolicy) *ackTracker {
+	t := &ackTracker{
+		conn:    c,
+		policy:  defaultAckPolicy,
+		pending: make(map[uint64]*pendingAck),
+	}
+	if policy != nil {
+		if policy.Backoff > 0 {
+			t.policy.Backoff = policy.Backoff
+		}
+		if policy.Retries > 0 {
+			t.policy.Retries = policy.Retries
+		}
+		if policy.Timeout > 0 {
+			t.policy.Timeout = policy.Timeout
+		}
+	}
+	return t
+}
+
+// Send message in the envelope, and track it until acked.
+func (t *ackTracker) send(opcode int, message []byte) *Delivery {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.nextId++
+	p := &pendingAck{
+		delivery: &Delivery{Id: t.nextId, done: make(chan struct{})},
+		opcode:   opcode,
+		payload:  envelope(t.nextId, opcode, message),
+		deadline: time.Now().Add(t.policy.Timeout),
+	}
+	t.pending[p.delivery.Id] = p
+	t.write(p)
+	t.schedule(p)
+	return p.delivery
+}
+
+// Write the message to the connection, must be called with lock.
+// Write error is ignored, the message is retried later.
+func (t *ackTracker) write(p *pendingAck) {
+	msg, err := t.conn.buildMessage(p.payload, p.opcode)
+	if err != nil {
+		return
+	}
+	t.conn.enqueue(&ackMessage{msg})
+}
+
+// Schedule the next retry or timeout, must be called with lock.
+func (t *ackTracker) schedule(p *pendingAck) {
+	wait := time.Until(p.deadline)
+	if p.retries < t.policy.Retries {
+		if backoff := t.policy.Backoff << p.retries; backoff < wait {
+			wait = backoff
+		}
+	}
+	p.timer = time.AfterFunc(wait, func() {
+		t.retry(p)
+	})
+}
+
+// Resend the message, or fail if timed out.
+func (t *ackTracker) retry(p *pendingAck) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.pending[p.delivery.Id] != p {
+		return
+	}
+	if !time.Now().Before(p.deadline) {
+		delete(t.pending, p.delivery.Id)
+		p.delivery.resolve(ErrAckTimeout)
+		return
+	}
+	p.retries++
+	if t.conn.State() == CONNECTED {
+		t.write(p)
+	}
+	t.schedule(p)
+}
+
+// Resolve the acked message.
+func (t *ackTracker) ack(id uint64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p, ok := t.pending[id]
+	if !ok {
+		return false
+	}
+	p.timer.Stop()
+	delete(t.pending, id)
+	p.delivery.resolve(nil)
+	return true
+}
+
+// Move unacked messages to the resumed connection, and resend them.
+func (t *ackTracker) attach(c *Connection) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.conn = c
+	for _, p := range t.pending {
+		t.write(p)
+	}
+}
+
+// Fail all unacked messages.
+func (t *ackTracker) close(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for id, p := range t.pending {
+		p.timer.Stop()
+		delete(t.pending, id)
+		p.delivery.resolve(err)
+	}
+}
+
+// Wrap message with the message ID:
+//
+//	text:   {"aun.id": 10, "data": "original message"}
+//	binary: 8 bytes big endian message ID + original message
+//
+// Text which is not valid UTF-8 can't be kept in JSON string, so it is base64 encoded:
+//
+//	{"aun.id": 10, "data": "/w==", "encoding": "base64"}
+func envelope(id uint64, opcode int, message []byte) []byte {
+	if opcode == BinaryFrame {
+		wrapped := make([]byte, 8, 8+len(message))
+		binary.BigEndian.PutUint64(wrapped, id)
+		return append(wrapped, message...)
+	}
+	if !utf8.Valid(message) {
+		wrapped, _ := json.Marshal(struct {
+			Id       uint64 `json:"aun.id"`
+			Data     []byte `json:"data"`
+			Encoding string `json:"encoding"`
+		}{id, message, "base64"})
+		return wrapped
+	}
+	wrapped, _ := json.Marshal(struct {
+		Id   uint64 `json:"aun.id"`
+		Data string `json:"data"`
+	}{id, string(message)})
+	return wrapped
+}
+
+// Send text message which the client must acknowledge with {"aun.ack": <id>}.
+// Unacked message is retried with backoff, and resent after session resumption.
+// Same as Send() with Server.Ack set, but default policy is used if Server.Ack is nil.
+func (c *Connection) SendAck(message []byte) *Delivery {
+	return c.sendAck(TextFrame, message)
+}
+
+// Send binary message which the client must acknowledge with {"aun.ack": <id>}.
+func (c *Connection) SendBinaryAck(message []byte) *Delivery {
+	return c.sendAck(BinaryFrame, message)
+}
+
+// Send message, in the ack envelope if the server opts in acked delivery.
+func (c *Connection) send(opcode int, message []byte) *Delivery {
+	if c.server != nil && c.server.Ack != nil {
+		return c.sendAck(opcode, message)
+	}
+	return resolvedDelivery(c.enqueueMessage(message, opcode))
+}
+
+// Send message in the ack envelope.
+func (c *Connection) sendAck(opcode int, message []byte) *Delivery {
+	if c.acks == nil || c.State() == CLOSED {
+		return resolvedDelivery(ErrConnectionClosed)
+	}
+	c.server.ackOnce.Do(func() {
+		c.server.addMessageHook(c.server.handleAck)
+	})
+	return c.acks.send(opcode, message)
+}
+
+// Message hook to consume acks from the client.
+// The field name is reserved, so application messages are never taken as acks.
+func (s *Server) handleAck(c *Connection, frame *Frame) bool {
+	payload := bytes.TrimSpace(frame.PayloadData)
+	if frame.Opcode != TextFrame || len(payload) == 0 || payload[0] != '{' || !bytes.Contains(payload, []byte(`"aun.ack"`)) {
+		return false
+	}
+	var m struct {
+		Ack *uint64 `json:"aun.ack"`
+	}
+	if err := json.Unmarshal(payload, &m); err != nil || m.Ack == nil || c.acks == nil {
+		return false
+	}
+	c.acks.ack(*m.Ack)
+	return true
+}
@@ -0,0 +1,90 @@
+package aun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendResolvedWhenQueued(t *testing.T) {
+	c := NewConnection(discardConn{}, 1024)
+	c.server = &Server{}
+	c.setState(CONNECTED)
+
+	d := c.Send([]byte("hello"))
+	select {
+	case <-d.Done():
+	default:
+		t.Fatal("delivery is not resolved without Server.Ack")
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if m := (<-c.Write).(*Frame); string(m.PayloadData) != "hello" {
+		t.Fatalf("queued %q, want hello", m.PayloadData)
+	}
+}
+
+func TestSendWaitsForAck(t *testing.T) {
+	s := &Server{Ack: &AckPolicy{Timeout: time.Minute}}
+	c := NewConnection(discardConn{}, 1024)
+	c.server = s
+	c.acks = newAckTracker(c, s.Ack)
+	c.setState(CONNECTED)
+
+	d := c.Send([]byte("hello"))
+	m := (<-c.Write).(*ackMessage).Readable.(*Frame)
+	if string(m.PayloadData) != `{"aun.id":1,"data":"hello"}` {
+		t.Fatalf("queued %s", m.PayloadData)
+	}
+	select {
+	case <-d.Done():
+		t.Fatal("delivery is resolved before the ack")
+	default:
+	}
+
+	ack, _ := BuildSingleFrame([]byte(`{"aun.ack": 1}`), 1, TextFrame)
+	if !s.handleAck(c, ack) {
+		t.Fatal("ack is not consumed")
+	}
+	if err := d.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAckEnvelope(t *testing.T) {
+	for _, tt := range []struct {
+		opcode  int
+		message string
+		want    string
+	}{
+		{TextFrame, "hello", `{"aun.id":1,"data":"hello"}`},
+		{TextFrame, "\xffa", `{"aun.id":1,"data":"/2E=","encoding":"base64"}`},
+		{BinaryFrame, "\xffa", "\x00\x00\x00\x00\x00\x00\x00\x01\xffa"},
+	} {
+		if got := string(envelope(1, tt.opcode, []byte(tt.message))); got != tt.want {
+			t.Fatalf("envelope(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestAckHookKeepsApplicationMessages(t *testing.T) {
+	s := &Server{Ack: &AckPolicy{Timeout: time.Minute}}
+	c := NewConnection(discardConn{}, 1024)
+	c.server = s
+	c.acks = newAckTracker(c, s.Ack)
+	c.setState(CONNECTED)
+	d := c.Send([]byte("hello"))
+
+	for _, message := range []string{`{"ack": 1}`, `{"type": "ack", "id": 1}`, `{"aun.ack": "x"}`} {
+		frame, _ := BuildSingleFrame([]byte(message), 1, TextFrame)
+		if s.handleAck(c, frame) {
+			t.Fatalf("application message %s is consumed", message)
+		}
+	}
+	select {
+	case <-d.Done():
+		t.Fatal("delivery is resolved by an application message")
+	default:
+	}
+	c.acks.close(ErrConnectionClosed)
+}
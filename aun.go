@@ -5,6 +5,10 @@
 //     http://www.hcn.zaq.ne.jp/___/WEB/RFC6455-ja.html
 package aun
 
+import (
+	"time"
+)
+
 // Connection state constants
 const (
 	INITIALIZE = iota
@@ -14,14 +18,67 @@ const (
 	CLOSED
 )
 
+// Frame opcodes
+const (
+	ContinuationFrame = 0
+	TextFrame         = 1
+	BinaryFrame       = 2
+	CloseFrame        = 8
+	PingFrame         = 9
+	PongFrame         = 10
+)
+
 // Sec-WebSocket-Accept key calculate seed
 const ACCEPTKEY = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
 // On message arrived event handler
 type MessageHandler func(message []byte)
 
+// On message arrived event handler with the sender connection and opcode ( TextFrame or BinaryFrame )
+type ReceiveHandler func(conn *Connection, opcode int, message []byte)
+
 // On client connected event handler
 type ConnectHandler func(conn *Connection)
 
 // On client closed hook handler
 type CloseHandler func(conn *Connection)
+
+// On handshake user identifying handler.
+// Returns application user ID, or error to reject the handshake.
+type IdentifyHandler func(conn *Connection, req *Request) (string, error)
+
+// On user online/offline hook handler
+type UserHandler func(userId string)
+
+// On handler error ( including recovered panic ) hook handler
+type ErrorHandler func(conn *Connection, err error)
+
+// Close frame status codes
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseInternalError   = 1011
+	CloseTryAgainLater   = 1013
+	CloseBadGateway      = 1014
+)
+
+// Send queue defaults
+const (
+	DefaultSendQueueSize = 64
+	DefaultSendTimeout   = 10 * time.Second
+)
+
+// Close the connection when no data is received for the duration
+const DefaultIdleTimeout = 1 * time.Minute
+
+// Max time to wait for writing the closing frame
+const closeTimeout = 1 * time.Second
+
+// Max size of the handshake request headers
+const maxHandshakeSize = 16 * 1024
+
+// Max payload size of the received frame
+const maxFramePayload = 1 << 30
@@ -0,0 +1,237 @@
+package aun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Message broker between aun nodes.
+// Server broadcasts and hub publishes go through the broker,
+// so the message reaches clients on every node.
+type Broker interface {
+	// Send message to all subscribers of the channel on every node.
+	Publish(channel string, message []byte) error
+
+	// Receive messages of the channel. Returns the function to unsubscribe.
+	Subscribe(channel string, handler func(message []byte)) (func(), error)
+
+	// Stop the broker.
+	Close() error
+}
+
+// Broker channel for server broadcasts
+const broadcastChannel = "aun.broadcast"
+
+// Broker channel for hub publishes, suffixed with the hub number
+const hubChannel = "aun.hub."
+
+// Message passed through broker.
+type brokerMessage struct {
+	opcode int
+
+	// Connection ID excluded from delivery
+	except string
+
+	// Hub topic ( empty for broadcast )
+	topic string
+
+	payload []byte
+}
+
+// Encode message:
+// opcode (1) | except length (2) | except | topic length (2) | topic | payload
+func (m *brokerMessage) encode() []byte {
+	data := make([]byte, 0, 5+len(m.except)+len(m.topic)+len(m.payload))
+	data = append(data, byte(m.opcode))
+	data = binary.BigEndian.AppendUint16(data, uint16(len(m.except)))
+	data = append(data, m.except...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(m.topic)))
+	data = append(data, m.topic...)
+	return append(data, m.payload...)
+}
+
+// Decode message.
+func decodeBrokerMessage(data []byte) (*brokerMessage, error) {
+	m := &brokerMessage{}
+	if len(data) < 3 {
+		return nil, errors.New("Invalid broker message")
+	}
+	m.opcode = int(data[0])
+	size := int(binary.BigEndian.Uint16(data[1:]))
+	data = data[3:]
+	if len(data) < size+2 {
+		return nil, errors.New("Invalid broker message")
+	}
+	m.except = string(data[:size])
+	data = data[size:]
+	size = int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < size {
+		return nil, errors.New("Invalid broker message")
+	}
+	m.topic = string(data[:size])
+	m.payload = data[size:]
+	return m, nil
+}
+
+// In-process broker.
+// Useful for single node, and as the local dispatcher of other brokers.
+type MemoryBroker struct {
+	mutex         sync.RWMutex
+	subscriptions map[string]map[int]func([]byte)
+	nextId        int
+}
+
+// Create in-process broker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscriptions: make(map[string]map[int]func([]byte)),
+	}
+}
+
+// Call all handlers of the channel synchronously.
+func (b *MemoryBroker) Publish(channel string, message []byte) error {
+	b.mutex.RLock()
+	handlers := make([]func([]byte), 0, len(b.subscriptions[channel]))
+	for _, handler := range b.subscriptions[channel] {
+		handlers = append(handlers, handler)
+	}
+	b.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+	return nil
+}
+
+// Add handler of the channel.
+func (b *MemoryBroker) Subscribe(channel string, handler func([]byte)) (func(), error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscriptions[channel] == nil {
+		b.subscriptions[channel] = make(map[int]func([]byte))
+	}
+	id := b.nextId
+	b.nextId++
+	b.subscriptions[channel][id] = handler
+
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscriptions[channel], id)
+		if len(b.subscriptions[channel]) == 0 {
+			delete(b.subscriptions, channel)
+		}
+	}, nil
+}
+
+// Remove all handlers.
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = make(map[string]map[int]func([]byte))
+	return nil
+}
+
+// Use the broker for broadcasts and hub publishes.
+// Must be called before clients are connected.
+func (s *Server) UseBroker(broker Broker) error {
+	unsubscribe, err := broker.Subscribe(broadcastChannel, func(data []byte) {
+		m, err := decodeBrokerMessage(data)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		frame, _ := BuildSingleFrame(m.payload, 1, m.opcode)
+		s.broadcastLocal(frame, m.except)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.brokerMutex.Lock()
+	s.broker = broker
+	s.unsubscribes = append(s.unsubscribes, unsubscribe)
+	s.brokerMutex.Unlock()
+
+	for _, hub := range s.hubList() {
+		if err := hub.subscribe(broker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove broker subscriptions of the server.
+func (s *Server) unsubscribeBroker() {
+	s.brokerMutex.Lock()
+	unsubscribes := s.unsubscribes
+	s.unsubscribes = nil
+	s.brokerMutex.Unlock()
+
+	for _, unsubscribe := range unsubscribes {
+		unsubscribe()
+	}
+}
+
+// Get the broker ( nil if not used ).
+func (s *Server) currentBroker() Broker {
+	s.brokerMutex.RLock()
+	defer s.brokerMutex.RUnlock()
+	return s.broker
+}
+
+// Broadcast message frame to all clients, through the broker if used.
+func (s *Server) broadcastMessage(message *Frame) {
+	if message.origin != nil && s.Broadcast == BroadcastNone {
+		return
+	}
+	var except string
+	if message.origin != nil && s.Broadcast == BroadcastOthers {
+		except = message.origin.Id
+	}
+
+	if broker := s.currentBroker(); broker != nil {
+		m := &brokerMessage{opcode: message.Opcode, except: except, payload: message.PayloadData}
+		if err := broker.Publish(broadcastChannel, m.encode()); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	s.broadcastLocal(message, except)
+}
+
+// Broadcast message frame to clients on this node.
+func (s *Server) broadcastLocal(message *Frame, except string) {
+	if except == "" {
+		s.fanout(message)
+		return
+	}
+	s.record(message, s.connectionsWhere(func(c *Connection) bool {
+		return c.Id != except
+	}))
+}
+
+// Receive topic messages from the broker.
+func (h *Hub) subscribe(broker Broker) error {
+	unsubscribe, err := broker.Subscribe(h.channel, func(data []byte) {
+		m, err := decodeBrokerMessage(data)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		frame, _ := BuildSingleFrame(m.payload, 1, m.opcode)
+		h.publishLocal(m.topic, frame, m.except)
+	})
+	if err != nil {
+		return err
+	}
+
+	h.server.brokerMutex.Lock()
+	h.server.unsubscribes = append(h.server.unsubscribes, unsubscribe)
+	h.server.brokerMutex.Unlock()
+	return nil
+}
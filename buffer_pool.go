@@ -0,0 +1,134 @@
+package aun
+
+import (
+	"net"
+	"sync"
+)
+
+// Buffer size classes.
+// Larger buffers than the last class are allocated every time.
+var bufferClasses = []int{512, 4096, 65536, 1 << 20}
+
+var bufferPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(bufferClasses))
+	for i, size := range bufferClasses {
+		size := size
+		pools[i] = &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		}
+	}
+	return pools
+}()
+
+// Get buffer which has at least size bytes from the pool.
+// Returned slice length is equal to size.
+func getBuffer(size int) *[]byte {
+	for i, class := range bufferClasses {
+		if size <= class {
+			b := bufferPools[i].Get().(*[]byte)
+			*b = (*b)[:size]
+			return b
+		}
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// Return buffer to the pool.
+func putBuffer(b *[]byte) {
+	for i, class := range bufferClasses {
+		if cap(*b) == class {
+			*b = (*b)[:class]
+			bufferPools[i].Put(b)
+			return
+		}
+	}
+}
+
+// Prepared frames up to this size are copied and written at once,
+// copying is cheaper than vectored writing for small frames
+const maxCopySize = 4096
+
+// Max frame header size ( 2 bytes + 8 bytes extended length + 4 bytes masking key )
+const maxHeaderSize = 14
+
+// Frame encoded once and shared between recipients.
+// Header and payload are kept separately and written with writev,
+// so the payload is never copied per recipient.
+type preparedFrame struct {
+	Readable
+	header     [maxHeaderSize]byte
+	headerSize int
+	payload    []byte
+}
+
+// Encode frame header for sharing.
+// The frame must not be masked, and its payload must not be modified after this.
+func prepareFrame(f *Frame) *preparedFrame {
+	p := &preparedFrame{
+		payload: f.PayloadData,
+	}
+	p.headerSize = f.putHeader(p.header[:])
+	return p
+}
+
+// Readable interface implement.
+func (p *preparedFrame) getData() []byte {
+	data := make([]byte, p.headerSize+len(p.payload))
+	copy(data, p.header[:p.headerSize])
+	copy(data[p.headerSize:], p.payload)
+	return data
+}
+
+// Build vectored buffers for writing.
+// net.Buffers is consumed on writing, so new value is needed per write.
+func (p *preparedFrame) buffers() net.Buffers {
+	return net.Buffers{p.header[:p.headerSize], p.payload}
+}
+
+// Prepare frames of the message as a single send queue entry.
+func prepareMessage(frames FrameStack) Readable {
+	if len(frames) == 1 {
+		return prepareFrame(frames[0])
+	}
+	batch := &frameBatch{frames: make([]Readable, len(frames))}
+	for i, f := range frames {
+		batch.frames[i] = prepareFrame(f)
+	}
+	return batch
+}
+
+// Frames written at once, takes single send queue slot.
+// Used for the fragmented message and replayed messages, so they are never dropped partially.
+type frameBatch struct {
+	Readable
+	frames []Readable
+}
+
+// Readable interface implement.
+func (b *frameBatch) getData() []byte {
+	var data []byte
+	for _, f := range b.frames {
+		data = append(data, f.getData()...)
+	}
+	return data
+}
+
+// Build vectored buffers for writing.
+func (b *frameBatch) buffers() net.Buffers {
+	bufs := make(net.Buffers, 0, len(b.frames)*2)
+	for _, f := range b.frames {
+		switch m := f.(type) {
+		case *preparedFrame:
+			bufs = append(bufs, m.buffers()...)
+		case *frameBatch:
+			bufs = append(bufs, m.buffers()...)
+		default:
+			bufs = append(bufs, f.getData())
+		}
+	}
+	return bufs
+}
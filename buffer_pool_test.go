@@ -0,0 +1,149 @@
+package aun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// Socket discarding written data.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+const (
+	benchRecipients = 100
+	benchFrameSize  = 1024
+)
+
+func benchConnections() []*Connection {
+	conns := make([]*Connection, benchRecipients)
+	for i := range conns {
+		conns[i] = NewConnection(discardConn{}, benchFrameSize)
+	}
+	return conns
+}
+
+// Encoding per recipient ( before prepared frames ).
+func benchmarkSendPerRecipient(b *testing.B, size int) {
+	conns := benchConnections()
+	message := bytes.Repeat([]byte("a"), size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frames, err := buildFrames(message, TextFrame, benchFrameSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, c := range conns {
+			for _, f := range frames {
+				if _, err := c.conn.Write(f.toFrameBytes()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// Encoding once and writing with writev.
+func benchmarkSendPrepared(b *testing.B, size int) {
+	conns := benchConnections()
+	message := bytes.Repeat([]byte("a"), size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frames, err := buildFrames(message, TextFrame, benchFrameSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		prepared := prepareMessage(frames)
+		for _, c := range conns {
+			if err := c.write(prepared); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSendPerRecipientSmall(b *testing.B) { benchmarkSendPerRecipient(b, 128) }
+func BenchmarkSendPreparedSmall(b *testing.B)     { benchmarkSendPrepared(b, 128) }
+func BenchmarkSendPerRecipientLarge(b *testing.B) { benchmarkSendPerRecipient(b, 16*1024) }
+func BenchmarkSendPreparedLarge(b *testing.B)     { benchmarkSendPrepared(b, 16*1024) }
+
+// Single frame written by the connection writer.
+func BenchmarkWriteFrame(b *testing.B) {
+	c := NewConnection(discardConn{}, benchFrameSize)
+	message := bytes.Repeat([]byte("a"), 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame, _ := BuildSingleFrame(message, 1, TextFrame)
+		if err := c.write(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDropOldestDropsWholeMessage(t *testing.T) {
+	c := NewConnection(discardConn{}, 16)
+	c.setSendQueue(1, SlowConsumerDropOldest, 0)
+	c.setState(CONNECTED)
+
+	first := bytes.Repeat([]byte("a"), 40)
+	second := bytes.Repeat([]byte("b"), 40)
+	if err := c.Send(first).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(second).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Write) != 1 {
+		t.Fatalf("queued entries = %d, want 1", len(c.Write))
+	}
+	if dropped := c.Stats().MessagesDropped; dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+	batch, ok := (<-c.Write).(*frameBatch)
+	if !ok {
+		t.Fatal("fragmented message is not queued as a batch")
+	}
+	if len(batch.frames) != 3 {
+		t.Fatalf("fragments = %d, want 3", len(batch.frames))
+	}
+	var payload []byte
+	for _, f := range batch.frames {
+		payload = append(payload, f.(*preparedFrame).payload...)
+	}
+	if !bytes.Equal(payload, second) {
+		t.Fatalf("queued message = %q, want %q", payload, second)
+	}
+}
+
+func TestBroadcastQueuesWholeMessage(t *testing.T) {
+	s := &Server{}
+	s.maxDataSize.Store(16)
+	conns := []*Connection{
+		NewConnection(discardConn{}, 16),
+		NewConnection(discardConn{}, 16),
+	}
+	for _, c := range conns {
+		c.setSendQueue(1, SlowConsumerDropNewest, 0)
+		c.setState(CONNECTED)
+	}
+	frame, _ := BuildSingleFrame(bytes.Repeat([]byte("a"), 40), 1, TextFrame)
+	s.send(frame, func(fn func(*Connection) bool) {
+		for _, c := range conns {
+			fn(c)
+		}
+	})
+	for _, c := range conns {
+		if len(c.Write) != 1 {
+			t.Fatalf("queued entries = %d, want 1", len(c.Write))
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package aun
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+)
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// CBOR ( RFC 8949 ) codec, encoded as binary frame.
+// Struct fields are named by json tag. Tags are ignored on decoding.
+type CBORCodec struct{}
+
+// Codec interface implement.
+func (CBORCodec) Name() string {
+	return "cbor"
+}
+
+// Codec interface implement.
+func (CBORCodec) Opcode() int {
+	return BinaryFrame
+}
+
+// Codec interface implement.
+func (CBORCodec) Marshal(v interface{}) ([]byte, error) {
+	w := &cborWriter{}
+	if err := encodeValue(w, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+// Codec interface implement.
+func (CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return decodeAll(&cborReader{data: data}, v)
+}
+
+// CBOR encoder.
+type cborWriter struct {
+	buf []byte
+}
+
+// Write major type with the argument in the shortest form.
+func (w *cborWriter) head(major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		w.buf = append(w.buf, major|byte(arg))
+	case arg <= math.MaxUint8:
+		w.buf = append(w.buf, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, major|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, major|26), uint32(arg))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, major|27), arg)
+	}
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeNil() {
+	w.buf = append(w.buf, cborSimple<<5|22)
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, cborSimple<<5|21)
+	} else {
+		w.buf = append(w.buf, cborSimple<<5|20)
+	}
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeInt(i int64) {
+	if i >= 0 {
+		w.head(cborUint, uint64(i))
+	} else {
+		w.head(cborNegInt, uint64(-(i + 1)))
+	}
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeUint(u uint64) {
+	w.head(cborUint, u)
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeFloat(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, cborSimple<<5|27), math.Float64bits(f))
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeString(s string) {
+	w.head(cborText, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeBytes(b []byte) {
+	w.head(cborBytes, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeArray(n int) {
+	w.head(cborArray, uint64(n))
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeMap(n int) {
+	w.head(cborMap, uint64(n))
+}
+
+// valueWriter interface implement.
+func (w *cborWriter) writeRaw(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// CBOR decoder.
+type cborReader struct {
+	depthLimit
+	data []byte
+	pos  int
+}
+
+// valueReader interface implement.
+func (r *cborReader) position() int {
+	return r.pos
+}
+
+// valueReader interface implement.
+func (r *cborReader) input() []byte {
+	return r.data
+}
+
+// Read n bytes.
+func (r *cborReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, errShortData
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// Read major type, additional information and argument.
+// Returns true for indefinite length.
+func (r *cborReader) head() (byte, byte, uint64, bool, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info <= 27:
+		b, err := r.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		var arg uint64
+		for _, c := range b {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, false, nil
+	case info == 31:
+		return major, info, 0, true, nil
+	}
+	return 0, 0, 0, false, errors.New("Invalid CBOR additional information")
+}
+
+// valueReader interface implement.
+func (r *cborReader) readEnd() (bool, error) {
+	if r.pos >= len(r.data) {
+		return false, errShortData
+	}
+	if r.data[r.pos] == 0xff {
+		r.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+// valueReader interface implement.
+func (r *cborReader) readItem() (codecItem, error) {
+	major, info, arg, indefinite, err := r.head()
+	// tags are skipped
+	for err == nil && major == cborTag && !indefinite {
+		major, info, arg, indefinite, err = r.head()
+	}
+	if err != nil {
+		return codecItem{}, err
+	}
+	if indefinite && major != cborBytes && major != cborText && major != cborArray && major != cborMap {
+		return codecItem{}, errors.New("Invalid CBOR indefinite length")
+	}
+
+	switch major {
+	case cborUint:
+		return codecItem{kind: itemUint, u: arg}, nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return codecItem{}, errors.New("CBOR negative integer overflows")
+		}
+		return codecItem{kind: itemInt, i: -1 - int64(arg)}, nil
+	case cborBytes, cborText:
+		kind := itemBytes
+		if major == cborText {
+			kind = itemString
+		}
+		if !indefinite {
+			b, err := r.next(arg)
+			return codecItem{kind: kind, s: b}, err
+		}
+		// concatenate definite length chunks
+		var s []byte
+		for {
+			end, err := r.readEnd()
+			if err != nil {
+				return codecItem{}, err
+			}
+			if end {
+				return codecItem{kind: kind, s: s}, nil
+			}
+			chunkMajor, _, size, chunkIndefinite, err := r.head()
+			if err != nil {
+				return codecItem{}, err
+			}
+			if chunkMajor != major || chunkIndefinite {
+				return codecItem{}, errors.New("Invalid CBOR string chunk")
+			}
+			chunk, err := r.next(size)
+			if err != nil {
+				return codecItem{}, err
+			}
+			s = append(s, chunk...)
+		}
+	case cborArray, cborMap:
+		kind := itemArray
+		if major == cborMap {
+			kind = itemMap
+		}
+		if indefinite {
+			return codecItem{kind: kind, n: -1}, nil
+		}
+		if arg > uint64(len(r.data)-r.pos) {
+			return codecItem{}, errShortData
+		}
+		return codecItem{kind: kind, n: int(arg)}, nil
+	}
+
+	// simple values and floats
+	switch {
+	case info == 20 || info == 21:
+		return codecItem{kind: itemBool, b: info == 21}, nil
+	case info == 22 || info == 23:
+		return codecItem{kind: itemNil}, nil
+	case info == 25:
+		return codecItem{kind: itemFloat, f: halfToFloat(uint16(arg))}, nil
+	case info == 26:
+		return codecItem{kind: itemFloat, f: float64(math.Float32frombits(uint32(arg)))}, nil
+	case info == 27:
+		return codecItem{kind: itemFloat, f: math.Float64frombits(arg)}, nil
+	}
+	return codecItem{}, errors.New("Unsupported CBOR simple value")
+}
+
+// Convert IEEE 754 half precision float.
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,412 @@
+package aun
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default timeout of connecting and handshake
+const defaultHandshakeTimeout = 10 * time.Second
+
+// WebSocket client dialer.
+type Dialer struct {
+	// Additional handshake request headers
+	Header map[string]string
+
+	// Subprotocols offered in preference order
+	Subprotocols []string
+
+	// TLS configuration for "wss" scheme
+	TLSConfig *tls.Config
+
+	// Timeout of connecting and handshake ( 10 seconds if zero )
+	HandshakeTimeout time.Duration
+}
+
+// Dialer with default settings.
+var DefaultDialer = &Dialer{}
+
+// WebSocket client connection.
+// ReadMessage() must be called from a single goroutine, writing is safe for concurrent use.
+type ClientConn struct {
+	// Subprotocol selected by the server ( empty if none )
+	Subprotocol string
+
+	// Handshake response headers
+	Header http.Header
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Serialize frame writing
+	writeMutex sync.Mutex
+
+	// Whether the closing frame is sent
+	closeSent atomic.Bool
+
+	// Closed on socket closing
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Closing frame received from the peer.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+// error interface implement.
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("Connection closed with %d", e.Code)
+	}
+	return fmt.Sprintf("Connection closed with %d: %s", e.Code, e.Reason)
+}
+
+// Connect to the WebSocket server with the default dialer.
+func Dial(rawurl string) (*ClientConn, error) {
+	return DefaultDialer.Dial(rawurl)
+}
+
+// Connect to the WebSocket server, URL scheme is "ws" or "wss".
+func (d *Dialer) Dial(rawurl string) (*ClientConn, error) {
+	return d.DialContext(context.Background(), rawurl)
+}
+
+// Connect to the WebSocket server with the context for connecting and handshake.
+func (d *Dialer) DialContext(ctx context.Context, rawurl string) (*ClientConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var useTLS bool
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		useTLS = true
+	default:
+		return nil, fmt.Errorf("Unsupported URL scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if useTLS {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	timeout := d.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		config := &tls.Config{}
+		if d.TLSConfig != nil {
+			config = d.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// interrupt the handshake on context done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	c, err := d.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return c, nil
+}
+
+// Send handshake request and verify the response.
+func (d *Dialer) handshake(conn net.Conn, u *url.URL) (*ClientConn, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+
+	path := u.RequestURI()
+	headers := []string{
+		fmt.Sprintf("GET %s HTTP/1.1", path),
+		"Upgrade: websocket",
+		"Connection: Upgrade",
+		fmt.Sprintf("Sec-WebSocket-Key: %s", key),
+		"Sec-WebSocket-Version: 13",
+	}
+	if _, ok := d.Header["Host"]; !ok {
+		headers = append(headers, fmt.Sprintf("Host: %s", u.Host))
+	}
+	if len(d.Subprotocols) > 0 {
+		headers = append(headers, fmt.Sprintf("Sec-WebSocket-Protocol: %s", strings.Join(d.Subprotocols, ", ")))
+	}
+	for name, value := range d.Header {
+		headers = append(headers, fmt.Sprintf("%s: %s", name, value))
+	}
+	if _, err := conn.Write([]byte(strings.Join(headers, "\r\n") + "\r\n\r\n")); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("Handshake failed with status %d", resp.StatusCode)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(resp.Header.Get("Connection")), "upgrade") {
+		return nil, errors.New("Handshake response is not upgrading to websocket")
+	}
+	accept := sha1.Sum([]byte(key + ACCEPTKEY))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return nil, errors.New("Invalid Sec-WebSocket-Accept")
+	}
+
+	protocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if protocol != "" {
+		offered := false
+		for _, p := range d.Subprotocols {
+			offered = offered || p == protocol
+		}
+		if !offered {
+			return nil, fmt.Errorf("Server selected unoffered subprotocol %q", protocol)
+		}
+	}
+
+	return &ClientConn{
+		Subprotocol: protocol,
+		Header:      resp.Header,
+		conn:        conn,
+		reader:      reader,
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// Read single message, returns opcode ( TextFrame or BinaryFrame ) and the payload.
+// Ping is answered automatically, and closing frame from the server returns *CloseError.
+func (c *ClientConn) ReadMessage() (int, []byte, error) {
+	stack := FrameStack{}
+	size := 0
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			c.shutdown()
+			return 0, nil, err
+		}
+
+		switch frame.Opcode {
+		case ContinuationFrame, TextFrame, BinaryFrame:
+			if (frame.Opcode == ContinuationFrame) != (len(stack) > 0) {
+				c.shutdown()
+				return 0, nil, errors.New("Unexpected continuation frame")
+			}
+			size += len(frame.PayloadData)
+			if size > maxFramePayload {
+				c.shutdown()
+				return 0, nil, errors.New("Message is too large")
+			}
+			stack = append(stack, frame)
+			if frame.Fin == 1 {
+				return stack[0].Opcode, stack.synthesize(), nil
+			}
+
+		case CloseFrame:
+			closeErr := &CloseError{Code: CloseNormalClosure}
+			reply := CloseNormalClosure
+			switch len(frame.PayloadData) {
+			case 0:
+			case 1:
+				closeErr.Code, reply = CloseProtocolError, CloseProtocolError
+			default:
+				closeErr.Code = int(binary.BigEndian.Uint16(frame.PayloadData))
+				closeErr.Reason = string(frame.PayloadData[2:])
+				reply = sendableCloseCode(closeErr.Code)
+			}
+			// reply with the same status code unless we started closing
+			if !c.closeSent.Swap(true) {
+				c.writeFrame(NewCloseFrame(reply, ""))
+			}
+			c.shutdown()
+			return 0, nil, closeErr
+
+		case PingFrame:
+			pong := NewPongFrame()
+			pong.PayloadData = frame.PayloadData
+			pong.PayloadLength = len(frame.PayloadData)
+			if err := c.writeFrame(pong); err != nil {
+				c.shutdown()
+				return 0, nil, err
+			}
+
+		case PongFrame:
+		}
+	}
+}
+
+// Read single frame from socket.
+func (c *ClientConn) readFrame() (*Frame, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+	extra := 0
+	switch header[1] & 0x7F {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if header[1]&0x80 > 0 {
+		extra += 4
+	}
+	header = header[:2+extra]
+	if _, err := io.ReadFull(c.reader, header[2:]); err != nil {
+		return nil, err
+	}
+
+	size, err := frameSize(header)
+	if err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, size)
+	copy(buffer, header)
+	if _, err := io.ReadFull(c.reader, buffer[len(header):]); err != nil {
+		return nil, err
+	}
+	frame := NewFrame()
+	if err := frame.parse(buffer); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Send message with the opcode ( TextFrame or BinaryFrame ).
+func (c *ClientConn) WriteMessage(opcode int, message []byte) error {
+	if c.closeSent.Load() {
+		return ErrConnectionClosed
+	}
+	frame, err := BuildSingleFrame(message, 1, opcode)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(frame)
+}
+
+// Send text message.
+func (c *ClientConn) Send(message []byte) error {
+	return c.WriteMessage(TextFrame, message)
+}
+
+// Send binary message.
+func (c *ClientConn) SendBinary(message []byte) error {
+	return c.WriteMessage(BinaryFrame, message)
+}
+
+// Send ping frame, pong is consumed by ReadMessage().
+func (c *ClientConn) Ping() error {
+	return c.writeFrame(NewPingFrame())
+}
+
+// Write the frame masked ( C->S frame must be masked ).
+func (c *ClientConn) writeFrame(frame *Frame) error {
+	frame.Mask = 1
+	frame.MaskingKey = newMaskingKey()
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.conn.Write(frame.toFrameBytes())
+	return err
+}
+
+// Close connection with status code and reason.
+// Waits for the closing frame from the server while ReadMessage() is running.
+func (c *ClientConn) CloseWith(code int, reason string) error {
+	if c.closeSent.Swap(true) {
+		return nil
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	err := c.writeFrame(NewCloseFrame(code, reason))
+
+	select {
+	case <-c.closed:
+	case <-time.After(closeTimeout):
+	}
+	c.shutdown()
+	return err
+}
+
+// Close connection with normal closure.
+func (c *ClientConn) Close() error {
+	return c.CloseWith(CloseNormalClosure, "")
+}
+
+// Close socket.
+func (c *ClientConn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// Get the local network address.
+func (c *ClientConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Get the remote network address.
+func (c *ClientConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Set deadline of reading the socket.
+func (c *ClientConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Set deadline of writing the socket.
+func (c *ClientConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
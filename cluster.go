@@ -0,0 +1,511 @@
+package aun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Broker channel for cluster messages
+const clusterChannel = "aun.cluster"
+
+// Cluster message types
+const (
+	clusterHeartbeat      = "heartbeat"
+	clusterSync           = "sync"
+	clusterJoin           = "join"
+	clusterLeave          = "leave"
+	clusterSend           = "send"
+	clusterSendUser       = "send_user"
+	clusterDisconnectUser = "disconnect_user"
+)
+
+// Connection entry in the cluster directory.
+type clusterEntry struct {
+	Id     string `json:"id"`
+	UserId string `json:"user_id,omitempty"`
+}
+
+// Heartbeat counter of the node process.
+// Incarnation is the start time of the process, so the restarted node with the same ID
+// is newer than its previous heartbeats.
+type clusterBeat struct {
+	Incarnation int64  `json:"incarnation"`
+	Heartbeat   uint64 `json:"heartbeat"`
+}
+
+// Report whether the heartbeat is newer than the other.
+func (b clusterBeat) newer(other clusterBeat) bool {
+	if b.Incarnation != other.Incarnation {
+		return b.Incarnation > other.Incarnation
+	}
+	return b.Heartbeat > other.Heartbeat
+}
+
+// Message between cluster nodes.
+type clusterMessage struct {
+	Type        string `json:"type"`
+	From        string `json:"from"`
+	Incarnation int64  `json:"incarnation"`
+	To          string `json:"to,omitempty"`
+
+	// Heartbeat counters of the known nodes ( heartbeat )
+	Nodes map[string]clusterBeat `json:"nodes,omitempty"`
+
+	// Directory entries ( sync, join, leave )
+	Entries []clusterEntry `json:"entries,omitempty"`
+
+	// Target connection or user ID, and the message ( send, send_user, disconnect_user )
+	Target  string `json:"target,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// Known node in the cluster.
+type clusterNode struct {
+	beat     clusterBeat
+	lastSeen time.Time
+}
+
+// Cluster of aun nodes connected by the server broker.
+//
+// Nodes gossip membership with heartbeats, and share the directory of
+// connection and user IDs to the owning node, so the server can send to
+// connections and users on other nodes:
+//
+//	broker, _ := aun.NewMeshBroker(aun.MeshConfig{Addr: addr, Peers: peers, Secret: secret})
+//	srv.UseBroker(broker)
+//	cluster := aun.NewCluster(srv, "node-1")
+//	cluster.Join()
+//	srv.NotifyId([]byte("hello"), connId) // forwarded to the owning node
+//
+// A node is removed with its directory entries when its heartbeat is not updated within Timeout.
+// A node restarted with the same ID joins again, and entries of the previous process are removed.
+type Cluster struct {
+	server *Server
+	broker Broker
+
+	// Unique node ID
+	NodeId string
+
+	// Heartbeat interval and timeout to remove the silent node
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// optional hooks, run on the broker goroutine
+	OnNodeJoin  func(nodeId string)
+	OnNodeLeave func(nodeId string)
+
+	mutex sync.Mutex
+
+	// Own heartbeat counter
+	beat clusterBeat
+
+	// node ID -> node
+	nodes map[string]*clusterNode
+
+	// Last heartbeat of removed nodes, to ignore stale gossip
+	dead map[string]clusterBeat
+
+	// connection ID -> node ID
+	conns map[string]string
+
+	// user ID -> node ID -> number of connections
+	users map[string]map[string]int
+
+	unsubscribe func()
+	closed      chan struct{}
+	once        sync.Once
+}
+
+// Create cluster node on the server.
+// Node ID must be unique in the cluster, random ID is used if empty.
+func NewCluster(s *Server, nodeId string) *Cluster {
+	if nodeId == "" {
+		nodeId = generateSessionId()
+	}
+	return &Cluster{
+		server:   s,
+		NodeId:   nodeId,
+		Interval: time.Second,
+		Timeout:  5 * time.Second,
+		beat:     clusterBeat{Incarnation: time.Now().UnixNano()},
+		nodes:    make(map[string]*clusterNode),
+		dead:     make(map[string]clusterBeat),
+		conns:    make(map[string]string),
+		users:    make(map[string]map[string]int),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Join the cluster through the server broker.
+// UseBroker() must be called before.
+func (c *Cluster) Join() error {
+	s := c.server
+	c.broker = s.currentBroker()
+	if c.broker == nil {
+		return errors.New("Server broker is not set")
+	}
+	unsubscribe, err := c.broker.Subscribe(clusterChannel, c.receive)
+	if err != nil {
+		return err
+	}
+	c.unsubscribe = unsubscribe
+
+	s.brokerMutex.Lock()
+	s.cluster = c
+	s.brokerMutex.Unlock()
+
+	s.addJoinHook(c.join)
+	s.addLeaveHook(c.leave)
+	go c.run()
+	return nil
+}
+
+// Get alive node IDs including this node.
+func (c *Cluster) Nodes() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	nodes := make([]string, 0, len(c.nodes)+1)
+	nodes = append(nodes, c.NodeId)
+	for id := range c.nodes {
+		nodes = append(nodes, id)
+	}
+	return nodes
+}
+
+// Get the node ID which owns the connection.
+func (c *Cluster) Locate(connId string) (string, bool) {
+	if _, ok := c.server.connections.get(connId); ok {
+		return c.NodeId, true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	nodeId, ok := c.conns[connId]
+	return nodeId, ok
+}
+
+// Get node IDs which the user is connected to.
+func (c *Cluster) UserNodes(userId string) []string {
+	var nodes []string
+	if len(c.server.users.get(userId)) > 0 {
+		nodes = append(nodes, c.NodeId)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for nodeId := range c.users[userId] {
+		nodes = append(nodes, nodeId)
+	}
+	return nodes
+}
+
+// Leave the cluster.
+// Other nodes remove this node after the timeout.
+func (c *Cluster) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+		if c.unsubscribe != nil {
+			c.unsubscribe()
+		}
+
+		c.server.brokerMutex.Lock()
+		if c.server.cluster == c {
+			c.server.cluster = nil
+		}
+		c.server.brokerMutex.Unlock()
+	})
+}
+
+// Send heartbeat, and remove silent nodes periodically.
+func (c *Cluster) run() {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	c.heartbeatNow()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.heartbeatNow()
+			c.expire()
+		}
+	}
+}
+
+// Gossip heartbeat counters of the known nodes.
+func (c *Cluster) heartbeatNow() {
+	c.mutex.Lock()
+	c.beat.Heartbeat++
+	nodes := make(map[string]clusterBeat, len(c.nodes)+1)
+	nodes[c.NodeId] = c.beat
+	for id, node := range c.nodes {
+		nodes[id] = node.beat
+	}
+	c.mutex.Unlock()
+
+	c.publish(&clusterMessage{Type: clusterHeartbeat, Nodes: nodes})
+}
+
+// Remove nodes which heartbeat is not updated within timeout.
+func (c *Cluster) expire() {
+	limit := time.Now().Add(-c.Timeout)
+
+	c.mutex.Lock()
+	var removed []string
+	for id, node := range c.nodes {
+		if node.lastSeen.Before(limit) {
+			c.dead[id] = node.beat
+			delete(c.nodes, id)
+			c.removeNode(id)
+			removed = append(removed, id)
+		}
+	}
+	c.mutex.Unlock()
+
+	if c.OnNodeLeave != nil {
+		for _, id := range removed {
+			c.OnNodeLeave(id)
+		}
+	}
+}
+
+// Remove directory entries of the node, must be called with lock.
+func (c *Cluster) removeNode(nodeId string) {
+	for connId, owner := range c.conns {
+		if owner == nodeId {
+			delete(c.conns, connId)
+		}
+	}
+	for userId, nodes := range c.users {
+		delete(nodes, nodeId)
+		if len(nodes) == 0 {
+			delete(c.users, userId)
+		}
+	}
+}
+
+// Server join hook.
+func (c *Cluster) join(conn *Connection) {
+	c.publish(&clusterMessage{
+		Type:    clusterJoin,
+		Entries: []clusterEntry{{Id: conn.Id, UserId: conn.UserId}},
+	})
+}
+
+// Server leave hook.
+func (c *Cluster) leave(conn *Connection) {
+	c.publish(&clusterMessage{
+		Type:    clusterLeave,
+		Entries: []clusterEntry{{Id: conn.Id, UserId: conn.UserId}},
+	})
+}
+
+// Publish the whole local directory for new nodes.
+func (c *Cluster) sync() {
+	entries := []clusterEntry{}
+	c.server.connections.each(func(conn *Connection) bool {
+		entries = append(entries, clusterEntry{Id: conn.Id, UserId: conn.UserId})
+		return true
+	})
+	c.publish(&clusterMessage{Type: clusterSync, Entries: entries})
+}
+
+// Send message to the cluster.
+func (c *Cluster) publish(m *clusterMessage) error {
+	select {
+	case <-c.closed:
+		return errors.New("Cluster is closed")
+	default:
+	}
+	m.From = c.NodeId
+	m.Incarnation = c.beat.Incarnation
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.broker.Publish(clusterChannel, data)
+}
+
+// Handle message from the cluster.
+func (c *Cluster) receive(data []byte) {
+	m := &clusterMessage{}
+	if err := json.Unmarshal(data, m); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if m.From == c.NodeId || (m.To != "" && m.To != c.NodeId) {
+		return
+	}
+
+	switch m.Type {
+	case clusterHeartbeat:
+		c.gossip(m.Nodes)
+	case clusterSync, clusterJoin:
+		c.mutex.Lock()
+		// entries may arrive before the first heartbeat of the node
+		current, restarted := c.current(m.From, m.Incarnation)
+		if current {
+			for _, entry := range m.Entries {
+				c.addEntry(m.From, entry)
+			}
+		}
+		c.mutex.Unlock()
+		if restarted {
+			c.sync()
+		}
+	case clusterLeave:
+		c.mutex.Lock()
+		current, restarted := c.current(m.From, m.Incarnation)
+		if current {
+			for _, entry := range m.Entries {
+				c.removeEntry(m.From, entry)
+			}
+		}
+		c.mutex.Unlock()
+		if restarted {
+			c.sync()
+		}
+	case clusterSend:
+		if conn, ok := c.server.connections.get(m.Target); ok {
+			conn.enqueueMessage(m.Payload, TextFrame)
+		}
+	case clusterSendUser:
+		c.server.sendToLocalUser(m.Target, m.Payload)
+	case clusterDisconnectUser:
+		c.server.disconnectLocalUser(m.Target, m.Code)
+	}
+}
+
+// Report whether messages of the node process are current, must be called with lock.
+// The newer incarnation of the known node is the restarted process,
+// entries of the previous process are removed and restarted is reported.
+func (c *Cluster) current(nodeId string, incarnation int64) (current, restarted bool) {
+	if dead, ok := c.dead[nodeId]; ok && incarnation <= dead.Incarnation {
+		return false, false
+	}
+	node, ok := c.nodes[nodeId]
+	if !ok || incarnation == node.beat.Incarnation {
+		return true, false
+	}
+	if incarnation < node.beat.Incarnation {
+		return false, false
+	}
+	c.removeNode(nodeId)
+	node.beat = clusterBeat{Incarnation: incarnation}
+	return true, true
+}
+
+// Merge heartbeat counters.
+func (c *Cluster) gossip(nodes map[string]clusterBeat) {
+	now := time.Now()
+	var joined []string
+	var restarted bool
+
+	c.mutex.Lock()
+	for id, beat := range nodes {
+		if id == c.NodeId || !beat.newer(c.dead[id]) {
+			continue
+		}
+		node, ok := c.nodes[id]
+		if !ok {
+			delete(c.dead, id)
+			c.nodes[id] = &clusterNode{beat: beat, lastSeen: now}
+			joined = append(joined, id)
+			continue
+		}
+		if !beat.newer(node.beat) {
+			continue
+		}
+		if _, r := c.current(id, beat.Incarnation); r {
+			restarted = true
+		}
+		node.beat = beat
+		node.lastSeen = now
+	}
+	c.mutex.Unlock()
+
+	if len(joined) == 0 && !restarted {
+		return
+	}
+	// new nodes don't know the local directory yet
+	c.sync()
+	if c.OnNodeJoin != nil {
+		for _, id := range joined {
+			c.OnNodeJoin(id)
+		}
+	}
+}
+
+// Add directory entry, must be called with lock.
+func (c *Cluster) addEntry(nodeId string, entry clusterEntry) {
+	if c.conns[entry.Id] == nodeId {
+		return
+	}
+	if owner, ok := c.conns[entry.Id]; ok {
+		// resumed on another node
+		c.removeEntry(owner, entry)
+	}
+	c.conns[entry.Id] = nodeId
+	if entry.UserId == "" {
+		return
+	}
+	if c.users[entry.UserId] == nil {
+		c.users[entry.UserId] = make(map[string]int)
+	}
+	c.users[entry.UserId][nodeId]++
+}
+
+// Remove directory entry, must be called with lock.
+func (c *Cluster) removeEntry(nodeId string, entry clusterEntry) {
+	if c.conns[entry.Id] != nodeId {
+		return
+	}
+	delete(c.conns, entry.Id)
+	if entry.UserId == "" {
+		return
+	}
+	if c.users[entry.UserId][nodeId]--; c.users[entry.UserId][nodeId] <= 0 {
+		delete(c.users[entry.UserId], nodeId)
+	}
+	if len(c.users[entry.UserId]) == 0 {
+		delete(c.users, entry.UserId)
+	}
+}
+
+// Get the cluster ( nil if not joined ).
+func (s *Server) currentCluster() *Cluster {
+	s.brokerMutex.RLock()
+	defer s.brokerMutex.RUnlock()
+	return s.cluster
+}
+
+// Send text message to the connection by ID.
+// The message is forwarded if the connection is on another cluster node.
+func (s *Server) NotifyId(message []byte, id string) error {
+	if conn, ok := s.connections.get(id); ok {
+		return conn.enqueueMessage(message, TextFrame)
+	}
+
+	cluster := s.currentCluster()
+	if cluster == nil {
+		return errors.New("Client not connected, abort send message.")
+	}
+	nodeId, ok := cluster.Locate(id)
+	if !ok {
+		return errors.New("Client not connected, abort send message.")
+	}
+	return cluster.publish(&clusterMessage{
+		Type:    clusterSend,
+		To:      nodeId,
+		Target:  id,
+		Payload: message,
+	})
+}
@@ -0,0 +1,105 @@
+package aun
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCluster(t *testing.T, broker Broker, nodeId string) *Cluster {
+	t.Helper()
+	s, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UseBroker(broker); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCluster(s, nodeId)
+	c.Interval = 10 * time.Millisecond
+	c.Timeout = 100 * time.Millisecond
+	if err := c.Join(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func waitCluster(t *testing.T, message string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasNode(c *Cluster, nodeId string) bool {
+	for _, id := range c.Nodes() {
+		if id == nodeId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClusterRejoin(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := newTestCluster(t, broker, "a")
+	b := newTestCluster(t, broker, "b")
+
+	conn := NewConnection(discardConn{}, 0)
+	b.join(conn)
+	waitCluster(t, "node b doesn't join", func() bool { return hasNode(a, "b") })
+	if nodeId, ok := a.Locate(conn.Id); !ok || nodeId != "b" {
+		t.Fatalf("connection is located at %q, want b", nodeId)
+	}
+
+	// node b dies
+	b.Close()
+	waitCluster(t, "dead node b is not removed", func() bool { return !hasNode(a, "b") })
+	if _, ok := a.Locate(conn.Id); ok {
+		t.Fatal("directory entry of the dead node is kept")
+	}
+
+	// node b restarts with the same ID, its heartbeat starts from 1 again
+	restarted := newTestCluster(t, broker, "b")
+	waitCluster(t, "restarted node b doesn't join", func() bool { return hasNode(a, "b") })
+	waitCluster(t, "restarted node b doesn't know node a", func() bool { return hasNode(restarted, "a") })
+
+	conn = NewConnection(discardConn{}, 0)
+	restarted.join(conn)
+	if nodeId, ok := a.Locate(conn.Id); !ok || nodeId != "b" {
+		t.Fatalf("connection of the restarted node is located at %q, want b", nodeId)
+	}
+}
+
+func TestClusterRestartRemovesStaleEntries(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := newTestCluster(t, broker, "a")
+	a.receive([]byte(`{"type":"heartbeat","from":"b","incarnation":1,"nodes":{"b":{"incarnation":1,"heartbeat":5}}}`))
+	a.receive([]byte(`{"type":"join","from":"b","incarnation":1,"entries":[{"id":"old"}]}`))
+	if _, ok := a.Locate("old"); !ok {
+		t.Fatal("entry is not added")
+	}
+
+	// restarted before the timeout, entries of the previous process are gone
+	a.receive([]byte(`{"type":"join","from":"b","incarnation":2,"entries":[{"id":"new"}]}`))
+	if _, ok := a.Locate("old"); ok {
+		t.Fatal("entry of the previous process is kept")
+	}
+	if _, ok := a.Locate("new"); !ok {
+		t.Fatal("entry of the restarted process is not added")
+	}
+
+	// late messages of the previous process are ignored
+	a.receive([]byte(`{"type":"join","from":"b","incarnation":1,"entries":[{"id":"late"}]}`))
+	if _, ok := a.Locate("late"); ok {
+		t.Fatal("entry of the previous process is added")
+	}
+	a.receive([]byte(`{"type":"heartbeat","from":"b","incarnation":2,"nodes":{"b":{"incarnation":2,"heartbeat":1}}}`))
+	if _, ok := a.Locate("new"); !ok {
+		t.Fatal("heartbeat of the restarted process removes its entries")
+	}
+}
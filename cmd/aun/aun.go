@@ -14,6 +14,16 @@ func main() {
 	isTls := flag.Bool("tls", false, "Listen tls socket")
 	pem := flag.String("pem", "", "Path to .pem file (with --tls option)")
 	key := flag.String("key", "", "Path to .key file (with --tls option)")
+	target := flag.String("target", "", "Bridge to the backend TCP address, {name} is replaced by --path segment")
+	pattern := flag.String("path", "", "Request path pattern for the bridge (e.g. /vnc/{host})")
+	allow := flag.String("allow", "", "Comma separated backend addresses allowed for the bridge (IP, CIDR or glob host with port, e.g. 10.0.0.0/24:5900)")
+	idle := flag.Duration("idle", 0, "Close the bridge when idle for the duration (e.g. 5m)")
+	command := flag.String("exec", "", "Run the command per connection, messages are stdin and stdout lines")
+	maxProcs := flag.Int("max-procs", 0, "Max running processes of --exec (0 is unlimited)")
+	var upstreams upstreamFlags
+	flag.Var(&upstreams, "upstream", "Proxy to the upstream WebSocket URLs, \"[host][/path]=url,url\" routes by host and path (repeatable)")
+	balance := flag.String("balance", "round-robin", "Upstream selection of --upstream (round-robin, least-conn or hash)")
+	hashHeader := flag.String("hash-header", "", "Request header for hash balance (client address if empty)")
 	flag.Parse()
 
 	server, err := aun.NewServer(*host, *port)
@@ -22,6 +32,39 @@ func main() {
 		os.Exit(1)
 	}
 
+	modes := 0
+	for _, enabled := range []bool{*target != "", *command != "", len(upstreams) > 0} {
+		if enabled {
+			modes++
+		}
+	}
+	if modes > 1 {
+		fmt.Println("--target, --exec and --upstream cannot be used together")
+		os.Exit(1)
+	}
+
+	if *target != "" {
+		b, err := newBridge(*target, *pattern, *allow, *idle)
+		if err != nil {
+			fmt.Println("bridge error:", err)
+			os.Exit(1)
+		}
+		b.attach(server)
+		fmt.Printf("Bridging to %s\n", *target)
+	}
+
+	if *command != "" {
+		newExecutor(*command, *maxProcs).attach(server)
+		fmt.Printf("Executing %s\n", *command)
+	}
+
+	if len(upstreams) > 0 {
+		if err := attachProxy(server, upstreams, *balance, *hashHeader); err != nil {
+			fmt.Println("proxy error:", err)
+			os.Exit(1)
+		}
+	}
+
 	if *isTls {
 		fmt.Println("Working with TLS.")
 		if _, err := os.Stat(*pem); err != nil {
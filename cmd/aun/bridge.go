@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ysugimoto/aun"
+)
+
+// Timeout of connecting to the backend
+const dialTimeout = 10 * time.Second
+
+// WebSocket to TCP bridge.
+// Binary messages are written to the backend, and the backend output is sent as binary messages.
+type bridge struct {
+	// Backend address, may contain {name} placeholders of the path pattern
+	target string
+
+	// Request path pattern segments ( any path if empty )
+	pattern []string
+
+	// Allowed backend addresses
+	allow []*allowRule
+
+	// Close when no data is transferred for the duration ( disabled if zero )
+	idle time.Duration
+}
+
+// Create bridge from the command options.
+func newBridge(target, pattern, allow string, idle time.Duration) (*bridge, error) {
+	b := &bridge{
+		target: target,
+		idle:   idle,
+	}
+	if pattern != "" {
+		b.pattern = strings.Split(strings.Trim(pattern, "/"), "/")
+	}
+	for _, a := range strings.Split(allow, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			rule, err := parseAllowRule(a)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid allow pattern %q: %w", a, err)
+			}
+			b.allow = append(b.allow, rule)
+		}
+	}
+	// the target chosen by client must be restricted, otherwise it is an open proxy
+	if strings.Contains(target, "{") && len(b.allow) == 0 {
+		return nil, errors.New("--allow is required for the target with placeholders")
+	}
+	return b, nil
+}
+
+// Configure the server as bridge.
+func (b *bridge) attach(server *aun.Server) {
+	server.Broadcast = aun.BroadcastNone
+	// noVNC and websockify clients offer "binary"
+	server.Subprotocols = []string{"binary"}
+	server.Identify = b.identify
+	server.OnConnect = func(conn *aun.Connection) {
+		go b.serve(conn)
+	}
+}
+
+// Resolve the backend on handshake, and reject the request if not allowed.
+func (b *bridge) identify(conn *aun.Connection, req *aun.Request) (string, error) {
+	target, err := b.resolve(req.Path)
+	if err != nil {
+		return "", err
+	}
+	conn.Set("target", target)
+	// adapt before receiving messages
+	conn.NetConn()
+	return "", nil
+}
+
+// Resolve the backend address of the request path.
+// With the allowlist, the host is resolved and the allowed IP address is returned,
+// so the checked address is dialed.
+func (b *bridge) resolve(requestPath string) (string, error) {
+	target := b.target
+	if b.pattern != nil {
+		segments := strings.Split(strings.Trim(requestPath, "/"), "/")
+		if len(segments) != len(b.pattern) {
+			return "", fmt.Errorf("Path %s does not match", requestPath)
+		}
+		for i, p := range b.pattern {
+			if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+				target = strings.ReplaceAll(target, p, segments[i])
+			} else if p != segments[i] {
+				return "", fmt.Errorf("Path %s does not match", requestPath)
+			}
+		}
+	}
+	if strings.Contains(target, "{") {
+		return "", fmt.Errorf("Target %s has unresolved placeholder", target)
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if len(b.allow) == 0 {
+		return target, nil
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("Invalid target port %s", port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		for _, rule := range b.allow {
+			if rule.match(host, addr, int(portNumber)) {
+				return net.JoinHostPort(addr.String(), port), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Target %s is not allowed", target)
+}
+
+// Allowed backend address, "host:port" with numeric glob port ( "*" for any ).
+// Host is one of:
+//
+//	IP address or CIDR:         10.0.0.5, 10.0.0.0/24, fd00::/64
+//	numeric glob of IP address: 10.0.0.*, matches IP address literals only
+//	hostname glob:              *.vnc.internal
+//
+// Globs are matched for each dot separated label, "*" doesn't match "." nor ":".
+type allowRule struct {
+	prefix  netip.Prefix
+	labels  []string
+	numeric bool
+	port    string
+}
+
+// Parse allowlist entry.
+func parseAllowRule(a string) (*allowRule, error) {
+	host, port, err := net.SplitHostPort(a)
+	if err != nil {
+		return nil, err
+	}
+	rule := &allowRule{port: port}
+	if _, err := path.Match(port, ""); err != nil || strings.Trim(port, "0123456789*?[]-") != "" {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	if n, err := strconv.Atoi(port); err == nil && n > 65535 {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		rule.prefix = prefix.Masked()
+		return rule, nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		return rule, nil
+	}
+	if _, err := path.Match(host, ""); err != nil {
+		return nil, err
+	}
+	rule.numeric = strings.Trim(host, "0123456789.*?[]-") == ""
+	rule.labels = strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	return rule, nil
+}
+
+// Check the target host, its resolved address and port match the rule.
+func (r *allowRule) match(host string, addr netip.Addr, port int) bool {
+	if ok, _ := path.Match(r.port, strconv.Itoa(port)); !ok {
+		return false
+	}
+	if r.prefix.IsValid() {
+		return r.prefix.Contains(addr)
+	}
+	if r.numeric {
+		// hostname like 10.0.0.127.0.0.1.nip.io must not match 10.0.0.*
+		if _, err := netip.ParseAddr(host); err != nil {
+			return false
+		}
+		host = addr.String()
+	}
+
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	if len(labels) != len(r.labels) {
+		return false
+	}
+	for i, label := range labels {
+		if ok, _ := path.Match(r.labels[i], label); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Connect to the backend and pump data in both directions.
+func (b *bridge) serve(conn *aun.Connection) {
+	value, _ := conn.Get("target")
+	target, _ := value.(string)
+	client := conn.NetConn()
+
+	backend, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		fmt.Printf("bridge %s -> %s: %s\n", conn.RemoteAddr(), target, err)
+		conn.CloseWith(aun.CloseBadGateway, "backend unavailable")
+		return
+	}
+	fmt.Printf("bridge %s -> %s: connected\n", conn.RemoteAddr(), target)
+
+	var active atomic.Int64
+	active.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			close(done)
+			backend.Close()
+			client.Close()
+		})
+	}
+
+	pump := func(dst io.Writer, src io.Reader) {
+		defer closeBoth()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				active.Store(time.Now().UnixNano())
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go pump(backend, client)
+	go pump(client, backend)
+
+	if b.idle > 0 {
+		go func() {
+			ticker := time.NewTicker(min(b.idle/2, time.Second))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if time.Since(time.Unix(0, active.Load())) >= b.idle {
+						fmt.Printf("bridge %s -> %s: idle timeout\n", conn.RemoteAddr(), target)
+						closeBoth()
+						return
+					}
+				}
+			}
+		}()
+	}
+	<-done
+	fmt.Printf("bridge %s -> %s: closed\n", conn.RemoteAddr(), target)
+}
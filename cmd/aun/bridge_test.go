@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBridgeAllowlist(t *testing.T) {
+	b, err := newBridge("{host}:{port}", "/vnc/{host}/{port}", "10.0.0.*:5900, 127.0.0.0/8:*, [::1]:22", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path   string
+		target string
+	}{
+		{"/vnc/10.0.0.7/5900", "10.0.0.7:5900"},
+		{"/vnc/127.0.0.1/80", "127.0.0.1:80"},
+		// resolved address is dialed
+		{"/vnc/localhost/80", "127.0.0.1:80"},
+		{"/vnc/[::1]/22", "[::1]:22"},
+	} {
+		target, err := b.resolve(c.path)
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		if target != c.target {
+			t.Fatalf("%s: target %s, want %s", c.path, target, c.target)
+		}
+	}
+
+	for _, path := range []string{
+		"/vnc/10.0.0.7/5901",
+		"/vnc/10.0.1.7/5900",
+		"/vnc/[::1]/23",
+		"/vnc/192.168.0.1/80",
+	} {
+		if target, err := b.resolve(path); err == nil {
+			t.Fatalf("%s: resolved to %s", path, target)
+		}
+	}
+}
+
+func TestBridgeAllowRule(t *testing.T) {
+	for _, c := range []struct {
+		rule  string
+		host  string
+		addr  string
+		port  int
+		match bool
+	}{
+		{"10.0.0.*:5900", "10.0.0.7", "10.0.0.7", 5900, true},
+		// hostnames are not matched by numeric pattern, even if resolved in the range
+		{"10.0.0.*:5900", "10.0.0.127.0.0.1.nip.io", "10.0.0.8", 5900, false},
+		{"10.0.0.*:5900", "10.0.0.7", "10.0.0.7", 5901, false},
+		{"10.0.0.0/24:*", "vnc.internal", "10.0.0.9", 22, true},
+		{"10.0.0.0/24:*", "10.0.0.7.evil.example", "127.0.0.1", 22, false},
+		{"*.vnc.internal:5900", "desk.vnc.internal", "192.168.0.1", 5900, true},
+		{"*.vnc.internal:5900", "DESK.vnc.internal.", "192.168.0.1", 5900, true},
+		// "*" matches in a label
+		{"*.vnc.internal:5900", "a.desk.vnc.internal", "192.168.0.1", 5900, false},
+		{"*:5900", "host:5900", "192.168.0.1", 5900, false},
+	} {
+		rule, err := parseAllowRule(c.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := rule.match(c.host, netip.MustParseAddr(c.addr), c.port); match != c.match {
+			t.Fatalf("%s for %s (%s) port %d: match = %v, want %v", c.rule, c.host, c.addr, c.port, match, c.match)
+		}
+	}
+}
+
+func TestBridgeInvalidAllowPattern(t *testing.T) {
+	for _, allow := range []string{"10.0.0.1", "10.0.0.1:port", "[a-:22", "10.0.0.1:70000"} {
+		if _, err := newBridge("{host}:22", "/{host}", allow, 0); err == nil {
+			t.Fatalf("%s is accepted", allow)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysugimoto/aun"
+)
+
+const (
+	// Max length of the output line, longer line is split
+	maxLineSize = 1024 * 1024
+
+	// Messages waiting for writing to stdin
+	stdinQueueSize = 1024
+
+	// Wait for the process output after killed
+	killWait = time.Second
+)
+
+// Process per connection ( like websocketd ).
+// Text messages are written to stdin by line, and stdout lines are sent as text messages.
+type executor struct {
+	// Shell command line
+	command string
+
+	// Running process slots ( nil if unlimited )
+	slots chan struct{}
+
+	// Running processes by connection
+	mutex     sync.Mutex
+	processes map[*aun.Connection]*process
+}
+
+// Process of the connection.
+type process struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	input  chan []byte
+}
+
+// Create executor from the command options.
+func newExecutor(command string, maxProcs int) *executor {
+	e := &executor{
+		command:   command,
+		processes: make(map[*aun.Connection]*process),
+	}
+	if maxProcs > 0 {
+		e.slots = make(chan struct{}, maxProcs)
+	}
+	return e
+}
+
+// Configure the server to run the process per connection.
+func (e *executor) attach(server *aun.Server) {
+	server.Broadcast = aun.BroadcastNone
+	// handlers of the connection run in order, so the process starts before receiving messages
+	server.OnConnect = e.start
+	server.OnReceive = e.receive
+	server.OnClose = e.stop
+}
+
+// Start the process for the connection.
+func (e *executor) start(conn *aun.Connection) {
+	if e.slots != nil {
+		select {
+		case e.slots <- struct{}{}:
+		default:
+			fmt.Printf("exec %s: too many processes\n", conn.RemoteAddr())
+			// closing may block on slow socket, don't hold the connection worker
+			go conn.CloseWith(aun.CloseTryAgainLater, "too many processes")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", e.command)
+	cmd.Env = append(os.Environ(), environment(conn)...)
+	killProcessGroup(cmd)
+	stdout := &lineWriter{emit: func(line []byte) {
+		conn.Send(line)
+	}}
+	stderr := &lineWriter{emit: func(line []byte) {
+		fmt.Printf("exec %s: %s\n", conn.RemoteAddr(), line)
+	}}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// stop waiting for the output held by orphaned children
+	cmd.WaitDelay = killWait
+
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		cancel()
+		e.release()
+		fmt.Printf("exec %s: %s\n", conn.RemoteAddr(), err)
+		go conn.CloseWith(aun.CloseInternalError, "process failed")
+		return
+	}
+	fmt.Printf("exec %s: started pid %d\n", conn.RemoteAddr(), cmd.Process.Pid)
+
+	p := &process{
+		ctx:    ctx,
+		cancel: cancel,
+		input:  make(chan []byte, stdinQueueSize),
+	}
+	e.mutex.Lock()
+	e.processes[conn] = p
+	e.mutex.Unlock()
+
+	go func() {
+		defer stdin.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case line := <-p.input:
+				if _, err := stdin.Write(line); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		err := cmd.Wait()
+		cancel()
+		stdout.flush()
+		stderr.flush()
+		e.mutex.Lock()
+		delete(e.processes, conn)
+		e.mutex.Unlock()
+		e.release()
+
+		if err != nil {
+			fmt.Printf("exec %s: exited: %s\n", conn.RemoteAddr(), err)
+		} else {
+			fmt.Printf("exec %s: exited\n", conn.RemoteAddr())
+		}
+		// the last output is queued by flush()
+		conn.CloseAfterFlush(aun.CloseNormalClosure, "")
+	}()
+}
+
+// Queue the text message to stdin of the process.
+func (e *executor) receive(conn *aun.Connection, opcode int, message []byte) {
+	if opcode != aun.TextFrame {
+		return
+	}
+	e.mutex.Lock()
+	p, ok := e.processes[conn]
+	e.mutex.Unlock()
+	if !ok {
+		return
+	}
+	// message is the receive buffer of the connection, copy before passing to the writer
+	line := append(append([]byte(nil), message...), '\n')
+	select {
+	case p.input <- line:
+	case <-p.ctx.Done():
+	default:
+		// process does not read stdin
+		fmt.Printf("exec %s: stdin is full\n", conn.RemoteAddr())
+		go conn.CloseWith(aun.ClosePolicyViolation, "too many messages")
+	}
+}
+
+// Kill the process of the closed connection.
+func (e *executor) stop(conn *aun.Connection) {
+	e.mutex.Lock()
+	p, ok := e.processes[conn]
+	e.mutex.Unlock()
+	if ok {
+		p.cancel()
+	}
+}
+
+// Release the process slot.
+func (e *executor) release() {
+	if e.slots != nil {
+		<-e.slots
+	}
+}
+
+// Environment variables of the connection metadata ( CGI-like ).
+func environment(conn *aun.Connection) []string {
+	env := []string{
+		"AUN_CONNECTION_ID=" + conn.Id,
+	}
+	if host, port, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		env = append(env, "REMOTE_ADDR="+host, "REMOTE_PORT="+port)
+	}
+	if req := conn.Request; req != nil {
+		env = append(env,
+			"REQUEST_URI="+req.URI(),
+			"PATH_INFO="+req.Path,
+			"QUERY_STRING="+req.RawQuery,
+		)
+		for name, value := range req.Headers {
+			name = strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+			env = append(env, "HTTP_"+name+"="+value)
+		}
+	}
+	return env
+}
+
+// Writer to call emit for each line without the line break.
+type lineWriter struct {
+	emit   func(line []byte)
+	buffer []byte
+}
+
+// io.Writer interface implement.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	for {
+		i := bytes.IndexByte(w.buffer, '\n')
+		if i < 0 {
+			if len(w.buffer) < maxLineSize {
+				break
+			}
+			i = maxLineSize
+		}
+		line := bytes.TrimSuffix(w.buffer[:i], []byte("\r"))
+		w.emit(append([]byte(nil), line...))
+		if i < len(w.buffer) && w.buffer[i] == '\n' {
+			i++
+		}
+		w.buffer = w.buffer[i:]
+	}
+	return len(p), nil
+}
+
+// Emit the last line without the line break.
+func (w *lineWriter) flush() {
+	if len(w.buffer) > 0 {
+		w.emit(w.buffer)
+		w.buffer = nil
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+)
+
+// Process groups are not supported on this platform, only the shell is killed on cancel.
+func killProcessGroup(cmd *exec.Cmd) {}
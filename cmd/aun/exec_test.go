@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ysugimoto/aun"
+)
+
+// Run the command per connection on the test server.
+func newTestExecutor(t *testing.T, command string) string {
+	t.Helper()
+	hs := aun.NewHandlerServer(func(c *aun.Connection) {})
+	newExecutor(command, 0).attach(hs.Server)
+	server := httptest.NewServer(hs)
+	t.Cleanup(func() {
+		server.Close()
+		hs.Exit <- 1
+	})
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Read messages until the connection is closed with 1000.
+func readUntilClose(t *testing.T, client *aun.ClientConn) []string {
+	t.Helper()
+	var lines []string
+	for {
+		_, message, err := client.ReadMessage()
+		if err != nil {
+			if ce, ok := err.(*aun.CloseError); !ok || ce.Code != aun.CloseNormalClosure {
+				t.Fatalf("close error = %v, want %d", err, aun.CloseNormalClosure)
+			}
+			return lines
+		}
+		lines = append(lines, string(message))
+	}
+}
+
+func TestExecSendsOutputBeforeClose(t *testing.T) {
+	url := newTestExecutor(t, "echo hi")
+	// the process exits right after the output
+	for i := 0; i < 10; i++ {
+		client, err := aun.Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if lines := readUntilClose(t, client); len(lines) != 1 || lines[0] != "hi" {
+			t.Fatalf("received %q before close, want [hi]", lines)
+		}
+	}
+}
+
+func TestExecWritesStdin(t *testing.T) {
+	url := newTestExecutor(t, "read a; read b; echo $a $b")
+	client, err := aun.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	client.Send([]byte("hello"))
+	client.Send([]byte("world"))
+	if lines := readUntilClose(t, client); len(lines) != 1 || lines[0] != "hello world" {
+		t.Fatalf("received %q, want [hello world]", lines)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ysugimoto/aun"
+)
+
+// Upstream routes of --upstream flags.
+// Each value is "[host][/path]=url,url,..." or "url,url,..." for any request.
+type upstreamFlags []string
+
+// flag.Value interface implement.
+func (u *upstreamFlags) String() string {
+	return strings.Join(*u, " ")
+}
+
+// flag.Value interface implement.
+func (u *upstreamFlags) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
+// Balance names of --balance flag.
+var balances = map[string]aun.ProxyBalance{
+	"round-robin": aun.ProxyRoundRobin,
+	"least-conn":  aun.ProxyLeastConnections,
+	"hash":        aun.ProxyHash,
+}
+
+// Configure the server as reverse proxy.
+func attachProxy(server *aun.Server, upstreams upstreamFlags, balance, hashHeader string) error {
+	b, ok := balances[balance]
+	if !ok {
+		return fmt.Errorf("Unknown balance %q", balance)
+	}
+
+	p := aun.NewProxy(server)
+	for _, value := range upstreams {
+		host, path := "", "/"
+		if target, urls, ok := strings.Cut(value, "="); ok && !strings.Contains(target, "://") {
+			host, path, _ = strings.Cut(target, "/")
+			path = "/" + path
+			value = urls
+		}
+		var urls []string
+		for _, u := range strings.Split(value, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		r, err := p.Route(host, path, b, urls...)
+		if err != nil {
+			return err
+		}
+		r.HashHeader = hashHeader
+		fmt.Printf("Proxying %s%s to %s\n", host, path, strings.Join(urls, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,717 @@
+package aun
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Message encoding for events.
+type Codec interface {
+	// Codec name
+	Name() string
+
+	// Frame opcode of encoded messages ( TextFrame or BinaryFrame )
+	Opcode() int
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Encoded value kept undecoded, to decode later with the same codec.
+type RawData []byte
+
+// json.Marshaler interface implement.
+func (r RawData) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+// json.Unmarshaler interface implement.
+func (r *RawData) UnmarshalJSON(data []byte) error {
+	*r = append((*r)[0:0], data...)
+	return nil
+}
+
+// JSON codec, encoded as text frame.
+type JSONCodec struct{}
+
+// Codec interface implement.
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+// Codec interface implement.
+func (JSONCodec) Opcode() int {
+	return TextFrame
+}
+
+// Codec interface implement.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Codec interface implement.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var (
+	rawDataType         = reflect.TypeOf(RawData(nil))
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Binary format writer used by the shared encoder.
+type valueWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(i int64)
+	writeUint(u uint64)
+	writeFloat(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArray(n int)
+	writeMap(n int)
+	writeRaw(b []byte)
+}
+
+// Kind of the decoded item
+type itemKind int
+
+const (
+	itemNil itemKind = iota
+	itemBool
+	itemInt
+	itemUint
+	itemFloat
+	itemString
+	itemBytes
+	itemArray
+	itemMap
+)
+
+// Decoded item header, or scalar value.
+type codecItem struct {
+	kind itemKind
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	s    []byte
+
+	// Number of array or map elements, -1 for indefinite length
+	n int
+}
+
+// Binary format reader used by the shared decoder.
+type valueReader interface {
+	readItem() (codecItem, error)
+
+	// Consume the end of indefinite length container if found
+	readEnd() (bool, error)
+
+	// Read position, and the input
+	position() int
+	input() []byte
+
+	// Track container nesting
+	enter() error
+	exit()
+}
+
+// Max nesting depth of decoded containers
+const maxCodecDepth = 1000
+
+// Max preallocated slice elements, the length in the data is not trusted
+const maxCodecPrealloc = 1024
+
+// Nesting depth counter for readers.
+type depthLimit struct {
+	depth int
+}
+
+// Enter nested container.
+func (d *depthLimit) enter() error {
+	d.depth++
+	if d.depth > maxCodecDepth {
+		return errors.New("Too deep nesting")
+	}
+	return nil
+}
+
+// Exit nested container.
+func (d *depthLimit) exit() {
+	d.depth--
+}
+
+// Struct field for encoding.
+type codecField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	tagged    bool
+}
+
+// Struct fields by type
+var codecFields sync.Map
+
+// Get encoded struct fields, named by json tag.
+// Fields of embedded structs without tag name are promoted like encoding/json:
+// the shallowest field wins on name conflict, and the tagged one wins at the same depth.
+// Conflicting fields at the same depth are ignored.
+func structFields(t reflect.Type) []codecField {
+	if fields, ok := codecFields.Load(t); ok {
+		return fields.([]codecField)
+	}
+
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []codecField
+	resolved := make(map[string]bool)
+	visited := make(map[reflect.Type]bool)
+	next := []embedded{{t: t}}
+
+	for len(next) > 0 {
+		current := next
+		next = nil
+		level := make(map[string][]codecField)
+		var names []string
+
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				f := e.t.Field(i)
+				tag := f.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				parts := strings.Split(tag, ",")
+				index := append(append([]int(nil), e.index...), i)
+
+				ft := f.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if f.Anonymous && parts[0] == "" && ft.Kind() == reflect.Struct {
+					// exported fields of unexported struct are promoted too
+					next = append(next, embedded{t: ft, index: index})
+					continue
+				}
+				if !f.IsExported() {
+					continue
+				}
+
+				field := codecField{name: f.Name, index: index, tagged: parts[0] != ""}
+				if field.tagged {
+					field.name = parts[0]
+				}
+				for _, opt := range parts[1:] {
+					if opt == "omitempty" {
+						field.omitEmpty = true
+					}
+				}
+				if resolved[field.name] {
+					// hidden by the shallower field
+					continue
+				}
+				if len(level[field.name]) == 0 {
+					names = append(names, field.name)
+				}
+				level[field.name] = append(level[field.name], field)
+			}
+		}
+
+		for _, name := range names {
+			resolved[name] = true
+			if field, ok := dominantField(level[name]); ok {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	// in the order of the struct definition
+	slices.SortFunc(fields, func(a, b codecField) int {
+		return slices.Compare(a.index, b.index)
+	})
+	codecFields.Store(t, fields)
+	return fields
+}
+
+// Get the field used for the name at the same depth.
+func dominantField(fields []codecField) (codecField, bool) {
+	if len(fields) == 1 {
+		return fields[0], true
+	}
+	var dominant []codecField
+	for _, f := range fields {
+		if f.tagged {
+			dominant = append(dominant, f)
+		}
+	}
+	if len(dominant) == 1 {
+		return dominant[0], true
+	}
+	return codecField{}, false
+}
+
+// Get the struct field for encoding.
+// Returns false if the field is in nil embedded pointer.
+func fieldForEncode(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// Get the struct field for decoding, nil embedded pointers are allocated.
+// Returns false if the nil embedded pointer is unexported and can't be allocated.
+func fieldForDecode(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// Encode Go value with the writer.
+func encodeValue(w valueWriter, v reflect.Value) error {
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+	if v.Type() == rawDataType {
+		if v.Len() == 0 {
+			w.writeNil()
+		} else {
+			w.writeRaw(v.Bytes())
+		}
+		return nil
+	}
+	if v.Type().Implements(textMarshalerType) && (v.Kind() != reflect.Pointer || !v.IsNil()) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		w.writeString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return encodeValue(w, v.Elem())
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.writeFloat(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		w.writeArray(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(w, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		w.writeMap(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := encodeValue(w, iter.Key()); err != nil {
+				return err
+			}
+			if err := encodeValue(w, iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		values := make([]reflect.Value, 0, len(fields))
+		names := make([]string, 0, len(fields))
+		for _, f := range fields {
+			fv, ok := fieldForEncode(v, f.index)
+			if !ok || (f.omitEmpty && fv.IsZero()) {
+				continue
+			}
+			values = append(values, fv)
+			names = append(names, f.name)
+		}
+		w.writeMap(len(values))
+		for i, fv := range values {
+			w.writeString(names[i])
+			if err := encodeValue(w, fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Decode the next value to Go value.
+func decodeValue(r valueReader, v reflect.Value) error {
+	if v.Type() == rawDataType {
+		start := r.position()
+		if err := skipValue(r); err != nil {
+			return err
+		}
+		raw := r.input()[start:r.position()]
+		v.SetBytes(append([]byte(nil), raw...))
+		return nil
+	}
+	item, err := r.readItem()
+	if err != nil {
+		return err
+	}
+	return decodeItem(r, item, v)
+}
+
+// Decode the item ( and its elements ) to Go value.
+func decodeItem(r valueReader, item codecItem, v reflect.Value) error {
+	if item.kind == itemNil {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeItem(r, item, v.Elem())
+	}
+	if item.kind == itemString && reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(item.s)
+	}
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() > 0 {
+			return fmt.Errorf("Cannot decode to %s", v.Type())
+		}
+		generic, err := decodeGeneric(r, item)
+		if err != nil {
+			return err
+		}
+		if generic != nil {
+			v.Set(reflect.ValueOf(generic))
+		}
+		return nil
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("Cannot decode item kind %d to %s", item.kind, v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if item.kind != itemBool {
+			return mismatch()
+		}
+		v.SetBool(item.b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch item.kind {
+		case itemInt:
+			if v.OverflowInt(item.i) {
+				return mismatch()
+			}
+			v.SetInt(item.i)
+		case itemUint:
+			if item.u > 1<<63-1 || v.OverflowInt(int64(item.u)) {
+				return mismatch()
+			}
+			v.SetInt(int64(item.u))
+		default:
+			return mismatch()
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch item.kind {
+		case itemUint:
+			if v.OverflowUint(item.u) {
+				return mismatch()
+			}
+			v.SetUint(item.u)
+		case itemInt:
+			if item.i < 0 || v.OverflowUint(uint64(item.i)) {
+				return mismatch()
+			}
+			v.SetUint(uint64(item.i))
+		default:
+			return mismatch()
+		}
+	case reflect.Float32, reflect.Float64:
+		switch item.kind {
+		case itemFloat:
+			v.SetFloat(item.f)
+		case itemInt:
+			v.SetFloat(float64(item.i))
+		case itemUint:
+			v.SetFloat(float64(item.u))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		if item.kind != itemString && item.kind != itemBytes {
+			return mismatch()
+		}
+		v.SetString(string(item.s))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (item.kind == itemBytes || item.kind == itemString) {
+			v.SetBytes(append([]byte(nil), item.s...))
+			return nil
+		}
+		if item.kind != itemArray {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(v.Type(), 0, min(max(item.n, 0), maxCodecPrealloc))
+		err := eachElement(r, item, func() error {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(r, elem); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if item.kind != itemArray {
+			return mismatch()
+		}
+		i := 0
+		return eachElement(r, item, func() error {
+			defer func() { i++ }()
+			if i < v.Len() {
+				return decodeValue(r, v.Index(i))
+			}
+			return skipValue(r)
+		})
+	case reflect.Map:
+		if item.kind != itemMap {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		return eachElement(r, item, func() error {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := decodeValue(r, key); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(r, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+			return nil
+		})
+	case reflect.Struct:
+		if item.kind != itemMap {
+			return mismatch()
+		}
+		fields := structFields(v.Type())
+		return eachElement(r, item, func() error {
+			var name string
+			if err := decodeValue(r, reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			if field, ok := findField(fields, name); ok {
+				if fv, ok := fieldForDecode(v, field.index); ok {
+					return decodeValue(r, fv)
+				}
+			}
+			return skipValue(r)
+		})
+	default:
+		return fmt.Errorf("Unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Find struct field by name, case insensitive like encoding/json.
+func findField(fields []codecField, name string) (codecField, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return codecField{}, false
+}
+
+// Decode the item to generic value:
+// nil, bool, int64, uint64, float64, string, []byte, []interface{} or map[string]interface{}.
+func decodeGeneric(r valueReader, item codecItem) (interface{}, error) {
+	switch item.kind {
+	case itemNil:
+		return nil, nil
+	case itemBool:
+		return item.b, nil
+	case itemInt:
+		return item.i, nil
+	case itemUint:
+		if item.u <= 1<<63-1 {
+			return int64(item.u), nil
+		}
+		return item.u, nil
+	case itemFloat:
+		return item.f, nil
+	case itemString:
+		return string(item.s), nil
+	case itemBytes:
+		return append([]byte(nil), item.s...), nil
+	case itemArray:
+		var list []interface{}
+		err := eachElement(r, item, func() error {
+			var elem interface{}
+			if err := decodeValue(r, reflect.ValueOf(&elem).Elem()); err != nil {
+				return err
+			}
+			list = append(list, elem)
+			return nil
+		})
+		if list == nil {
+			list = []interface{}{}
+		}
+		return list, err
+	case itemMap:
+		m := make(map[string]interface{})
+		err := eachElement(r, item, func() error {
+			var key, elem interface{}
+			if err := decodeValue(r, reflect.ValueOf(&key).Elem()); err != nil {
+				return err
+			}
+			if err := decodeValue(r, reflect.ValueOf(&elem).Elem()); err != nil {
+				return err
+			}
+			if s, ok := key.(string); ok {
+				m[s] = elem
+			} else {
+				m[fmt.Sprint(key)] = elem
+			}
+			return nil
+		})
+		return m, err
+	}
+	return nil, errors.New("Unknown item")
+}
+
+// Call fn for each element of array or map item.
+func eachElement(r valueReader, item codecItem, fn func() error) error {
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.exit()
+
+	for i := 0; item.n < 0 || i < item.n; i++ {
+		if item.n < 0 {
+			end, err := r.readEnd()
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Skip the next value.
+func skipValue(r valueReader) error {
+	item, err := r.readItem()
+	if err != nil {
+		return err
+	}
+	switch item.kind {
+	case itemArray:
+		return eachElement(r, item, func() error {
+			return skipValue(r)
+		})
+	case itemMap:
+		return eachElement(r, item, func() error {
+			if err := skipValue(r); err != nil {
+				return err
+			}
+			return skipValue(r)
+		})
+	}
+	return nil
+}
+
+// Errors of binary codecs
+var (
+	errShortData    = errors.New("Unexpected end of data")
+	errTrailingData = errors.New("Unexpected data after value")
+)
+
+// Decode whole data with the reader to v.
+func decodeAll(r valueReader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("Unmarshal target must be non-nil pointer")
+	}
+	if err := decodeValue(r, rv.Elem()); err != nil {
+		return err
+	}
+	if r.position() != len(r.input()) {
+		return errTrailingData
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package aun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var binaryCodecs = []Codec{MessagePackCodec{}, CBORCodec{}}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type codecBase struct {
+	Id      int    `json:"id"`
+	Created string `json:"created"`
+}
+
+type codecMeta struct {
+	Tags []string `json:"tags"`
+}
+
+type codecMessage struct {
+	codecBase
+	Meta  *codecMeta `json:"meta"`
+	Extra *codecMeta `json:"extra,omitempty"`
+
+	Name    string            `json:"name"`
+	Count   uint16            `json:"count"`
+	Delta   int64             `json:"delta"`
+	Ratio   float64           `json:"ratio"`
+	Ok      bool              `json:"ok"`
+	Data    []byte            `json:"data"`
+	Matrix  [][]int           `json:"matrix"`
+	Labels  map[string]string `json:"labels"`
+	At      time.Time         `json:"at"`
+	Raw     RawData           `json:"raw"`
+	Skipped string            `json:"-"`
+	hidden  string
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range binaryCodecs {
+		raw, _ := codec.Marshal([]int{1, 2})
+		in := codecMessage{
+			codecBase: codecBase{Id: 7, Created: "now"},
+			Meta:      &codecMeta{Tags: []string{"a", "b"}},
+			Name:      "name",
+			Count:     65535,
+			Delta:     math.MinInt64,
+			Ratio:     0.25,
+			Ok:        true,
+			Data:      []byte{0, 1, 2},
+			Matrix:    [][]int{{1}, {2, 3}, {}},
+			Labels:    map[string]string{"k": "v"},
+			At:        time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Raw:       raw,
+			Skipped:   "skipped",
+			hidden:    "hidden",
+		}
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		var out codecMessage
+		if err := codec.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		in.Skipped, in.hidden = "", ""
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("%s: round trip\n got %+v\nwant %+v", codec.Name(), out, in)
+		}
+	}
+}
+
+func TestCodecEmbeddedStructMatchesJSON(t *testing.T) {
+	type inner struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	type Other struct {
+		Name  string `json:"name"`
+		Kind  string `json:"kind"`
+		Label string `json:"label"`
+	}
+	type outer struct {
+		inner
+		*Other
+		Kind string `json:"kind"`
+	}
+	// name conflicts at the same depth, kind is hidden by the outer field
+	in := outer{inner: inner{Id: 1, Name: "a"}, Other: &Other{Name: "b", Kind: "x", Label: "l"}, Kind: "y"}
+	var fields map[string]interface{}
+	data, _ := json.Marshal(in)
+	json.Unmarshal(data, &fields)
+	// sorted by key
+	want, _ := json.Marshal(fields)
+
+	for _, codec := range binaryCodecs {
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic map[string]interface{}
+		if err := codec.Unmarshal(data, &generic); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := json.Marshal(generic)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: encoded %s, json %s", codec.Name(), got, want)
+		}
+
+		var out outer
+		if err := codec.Unmarshal(data, &out); err != nil || out.Id != 1 || out.Label != "l" || out.Kind != "y" {
+			t.Fatalf("%s: decoded %+v, %v", codec.Name(), out, err)
+		}
+
+		// nil embedded pointer is skipped
+		data, _ = codec.Marshal(outer{Kind: "z"})
+		out = outer{}
+		if err := codec.Unmarshal(data, &out); err != nil || out.Other != nil || out.Kind != "z" {
+			t.Fatalf("%s: nil embedded pointer = %+v, %v", codec.Name(), out, err)
+		}
+		// unexported embedded pointer can't be allocated like encoding/json, the field is skipped
+		data, _ = codec.Marshal(map[string]int{"id": 3})
+		var hidden struct {
+			*inner
+		}
+		if err := codec.Unmarshal(data, &hidden); err != nil || hidden.inner != nil {
+			t.Fatalf("%s: unexported embedded pointer = %+v, %v", codec.Name(), hidden, err)
+		}
+	}
+}
+
+// Examples of the MessagePack specification.
+func TestMessagePackVectors(t *testing.T) {
+	codec := MessagePackCodec{}
+	for _, c := range []struct {
+		value interface{}
+		hex   string
+	}{
+		{nil, "c0"},
+		{false, "c2"},
+		{true, "c3"},
+		{0, "00"},
+		{127, "7f"},
+		{128, "cc 80"},
+		{256, "cd 0100"},
+		{65536, "ce 00010000"},
+		{uint64(1) << 32, "cf 0000000100000000"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0 df"},
+		{-129, "d1 ff7f"},
+		{-32769, "d2 ffff7fff"},
+		{int64(math.MinInt64), "d3 8000000000000000"},
+		{1.5, "cb 3ff8000000000000"},
+		{"", "a0"},
+		{"abc", "a3 616263"},
+		{strings.Repeat("a", 32), "d9 20" + strings.Repeat("61", 32)},
+		{[]byte{1, 2}, "c4 02 0102"},
+		{[]int{1, 2}, "92 01 02"},
+		{map[string]int{"a": 1}, "81 a161 01"},
+	} {
+		want := mustHex(t, c.hex)
+		got, err := codec.Marshal(c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%v: encoded %x, want %x", c.value, got, want)
+		}
+	}
+
+	for _, c := range []struct {
+		hex  string
+		want interface{}
+	}{
+		{"ca 3fc00000", 1.5},
+		{"cb 3ff8000000000000", 1.5},
+		{"da 0003 616263", "abc"},
+		{"dc 0002 01 02", []interface{}{int64(1), int64(2)}},
+		{"de 0001 a161 c3", map[string]interface{}{"a": true}},
+		{"c5 0001 ff", []byte{0xff}},
+	} {
+		var got interface{}
+		if err := codec.Unmarshal(mustHex(t, c.hex), &got); err != nil {
+			t.Fatalf("%s: %v", c.hex, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%s: decoded %#v, want %#v", c.hex, got, c.want)
+		}
+	}
+}
+
+// Examples of RFC 8949 Appendix A.
+func TestCBORVectors(t *testing.T) {
+	codec := CBORCodec{}
+	for _, c := range []struct {
+		value interface{}
+		hex   string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{100, "1864"},
+		{1000, "1903e8"},
+		{1000000, "1a000f4240"},
+		{1000000000000, "1b000000e8d4a51000"},
+		{uint64(math.MaxUint64), "1bffffffffffffffff"},
+		{-1, "20"},
+		{-10, "29"},
+		{-100, "3863"},
+		{-1000, "3903e7"},
+		{1.1, "fb3ff199999999999a"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{"", "60"},
+		{"a", "6161"},
+		{"IETF", "6449455446"},
+		{"ü", "62c3bc"},
+		{[]int{}, "80"},
+		{[]int{1, 2, 3}, "83010203"},
+		{[]interface{}{1, []int{2, 3}, []int{4, 5}}, "8301820203820405"},
+		{struct {
+			A int   `json:"a"`
+			B []int `json:"b"`
+		}{1, []int{2, 3}}, "a26161016162820203"},
+	} {
+		want := mustHex(t, c.hex)
+		got, err := codec.Marshal(c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%v: encoded %x, want %x", c.value, got, want)
+		}
+	}
+
+	for _, c := range []struct {
+		hex  string
+		want interface{}
+	}{
+		{"f90000", 0.0},
+		{"f93c00", 1.0},
+		{"f93e00", 1.5},
+		{"f97bff", 65504.0},
+		{"f90001", 5.960464477539063e-08},
+		{"f9c400", -4.0},
+		{"f97c00", math.Inf(1)},
+		{"fa47c35000", 100000.0},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9fff", []interface{}{}},
+		{"9f018202039f0405ffff", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"bf6346756ef563416d7421ff", map[string]interface{}{"Fun": true, "Amt": int64(-2)}},
+	} {
+		var got interface{}
+		if err := codec.Unmarshal(mustHex(t, c.hex), &got); err != nil {
+			t.Fatalf("%s: %v", c.hex, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%s: decoded %#v, want %#v", c.hex, got, c.want)
+		}
+	}
+}
+
+func TestCodecTruncatedInput(t *testing.T) {
+	for _, codec := range binaryCodecs {
+		data, err := codec.Marshal(codecMessage{
+			Meta:   &codecMeta{Tags: []string{"tag"}},
+			Name:   "truncated",
+			Matrix: [][]int{{1, 2}},
+			Labels: map[string]string{"k": "v"},
+			Data:   []byte("data"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(data); n++ {
+			var out codecMessage
+			if err := codec.Unmarshal(data[:n], &out); err == nil {
+				t.Fatalf("%s: truncated at %d is decoded", codec.Name(), n)
+			}
+			var generic interface{}
+			if err := codec.Unmarshal(data[:n], &generic); err == nil {
+				t.Fatalf("%s: truncated at %d is decoded to generic value", codec.Name(), n)
+			}
+		}
+		var out codecMessage
+		if err := codec.Unmarshal(append(data, 0), &out); err != errTrailingData {
+			t.Fatalf("%s: trailing data error = %v", codec.Name(), err)
+		}
+	}
+}
+
+func TestCodecMaliciousInput(t *testing.T) {
+	type large struct {
+		Block [4096]byte
+	}
+	cases := map[string][]string{
+		"msgpack": {
+			"db ffffffff 61",             // str32 of 4GB
+			"c6 ffffffff 00",             // bin32 of 4GB
+			"dd ffffffff 01",             // array32 of 4G elements
+			"df ffffffff a161 01",        // map32 of 4G entries
+			strings.Repeat("91", 100000), // deep nesting
+			"c1",                         // never used
+			"d4 00 00",                   // extension
+		},
+		"cbor": {
+			"7b ffffffffffffffff 61",      // text of 2^64 bytes
+			"5b 7fffffffffffffff 00",      // bytes of 2^63 bytes
+			"9b ffffffffffffffff 01",      // array of 2^64 elements
+			"bb 0000000100000000 6161 01", // map of 2^32 entries
+			"9a 00010000" + "01",          // array longer than the data
+			"7f 61 ff",                    // invalid indefinite text chunk
+			"5f 9f ff ff",                 // invalid indefinite bytes chunk
+			"3b ffffffffffffffff",         // negative integer overflows int64
+			strings.Repeat("81", 100000),  // deep nesting
+			strings.Repeat("c1", 100000),  // tags without value
+			"1c",                          // reserved additional information
+			"f8 20",                       // simple value
+		},
+	}
+	for _, codec := range binaryCodecs {
+		for _, input := range cases[codec.Name()] {
+			data := mustHex(t, input)
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+
+			var generic interface{}
+			if err := codec.Unmarshal(data, &generic); err == nil {
+				t.Fatalf("%s: %.40s... is decoded", codec.Name(), input)
+			}
+			var blocks []large
+			codec.Unmarshal(data, &blocks)
+
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+				t.Fatalf("%s: %.40s... allocated %d bytes", codec.Name(), input, allocated)
+			}
+		}
+	}
+}
+
+func TestCodecLargeArrayIsNotPreallocated(t *testing.T) {
+	type large struct {
+		Block [4096]byte
+	}
+	// array header of 64K elements followed by invalid data, each element of the Go slice is 4KB
+	data := append(mustHex(t, "dc ffff"), bytes.Repeat([]byte{0xc1}, 0xffff)...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var blocks []large
+	if err := (MessagePackCodec{}).Unmarshal(data, &blocks); err == nil {
+		t.Fatal("invalid array is decoded")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Fatalf("allocated %d bytes for invalid array", allocated)
+	}
+}
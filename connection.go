@@ -1,12 +1,17 @@
 package aun
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,11 +21,31 @@ type Connection struct {
 	// connection ID (probably unique)
 	Id string
 
+	// Application user ID, bound by Server.Identify on handshake
+	UserId string
+
+	// Handshake request
+	Request *Request
+
+	// Negotiated subprotocol ( empty if none )
+	Subprotocol string
+
+	// Application data attached to the connection
+	meta      map[string]interface{}
+	metaMutex sync.RWMutex
+
+	// Session resumption token, and restored session
+	resumeToken string
+	resumed     *session
+
+	// Unacked messages sent by SendAck()
+	acks *ackTracker
+
 	// socket max buffer size
 	maxDataSize int
 
-	// connection status
-	state int
+	// connection status ( accessed atomically )
+	state atomic.Int32
 
 	// TCP socket connection
 	conn net.Conn
@@ -43,8 +68,109 @@ type Connection struct {
 	// join channnel ( supply from Server )
 	join chan *Connection
 
+	// Closed when server stops receiving from manager ( supply from Server )
+	serverDone chan struct{}
+
+	// Owner server ( nil if the connection is used standalone )
+	server *Server
+
+	// Policy when the Write queue is full, and blocking send limit
+	queuePolicy SlowConsumerPolicy
+	sendTimeout time.Duration
+
+	// Max time without receiving data, and its deadline in unix nanoseconds ( netpoll mode )
+	idleTimeout  time.Duration
+	idleDeadline atomic.Int64
+
+	// Tail of blocking send chain ( nil when no blocking send is in flight )
+	pending      chan struct{}
+	pendingCount int
+	sendMutex    sync.Mutex
+
+	// Serialize socket writing between writer and closing
+	writeMutex sync.Mutex
+
+	// Closed on connection shutdown
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Netpoll mode poller and socket descriptor ( nil in goroutine mode )
+	poller *poller
+	pollFd int
+
+	// Serialize processing in netpoll mode, the order by epoll rearming is invisible to the race detector
+	pollMutex sync.Mutex
+
+	// Whether the on-demand writer is running ( netpoll mode )
+	writing atomic.Bool
+
 	// Frame queue stack ( treats FIN = 0 message queue )
 	frameStack FrameStack
+
+	// Socket data not processed yet ( incomplete handshake request or frame )
+	received []byte
+
+	// Traffic counters ( see Stats() )
+	bytesSent        atomic.Int64
+	bytesReceived    atomic.Int64
+	messagesSent     atomic.Int64
+	messagesReceived atomic.Int64
+
+	// Last read/write time in unix nanoseconds
+	lastActivity atomic.Int64
+
+	// Ping sent time in unix nanoseconds, zero when no ping is in flight
+	pingSentAt atomic.Int64
+
+	// Last measured ping round trip time
+	pingRTT atomic.Int64
+
+	// Messages discarded by slow consumer policy
+	messagesDropped atomic.Int64
+
+	// Messages rejected by the validator
+	messagesRejected atomic.Int64
+
+	// net.Conn adapter ( nil if not adapted )
+	netConn atomic.Pointer[netConn]
+
+	// Closing frame received from the client ( nil if not received )
+	peerClose atomic.Pointer[CloseError]
+}
+
+// Connection statistics snapshot.
+type ConnectionStats struct {
+	// connection ID
+	Id string
+
+	// connection status ( INITIALIZE, OPENING, ... )
+	State int
+
+	// Total bytes written to / read from socket
+	BytesSent     int64
+	BytesReceived int64
+
+	// Frames written to socket, and data messages received from client
+	MessagesSent     int64
+	MessagesReceived int64
+
+	// Last time of socket read/write
+	LastActivity time.Time
+
+	// Number of messages waiting in the Write channel
+	QueueDepth int
+
+	// Messages discarded by slow consumer policy
+	MessagesDropped int64
+
+	// Messages rejected by the validator
+	MessagesRejected int64
+
+	// Round trip time of the last answered ping ( zero if never measured )
+	PingRTT time.Duration
+
+	// Whether the ping is sent and waiting for pong
+	PingPending bool
 }
 
 func generateSessionId() string {
@@ -62,118 +188,376 @@ func NewConnection(conn net.Conn, maxDataSize int) *Connection {
 
 	return &Connection{
 		Id:          generateSessionId(),
-		state:       INITIALIZE,
 		maxDataSize: maxDataSize,
 		conn:        conn,
 		frameStack:  FrameStack{},
 		Read:        make(chan Readable, 1),
-		Write:       make(chan Readable, 1),
+		Write:       make(chan Readable, DefaultSendQueueSize),
 		Close:       make(chan struct{}),
+		sendTimeout: DefaultSendTimeout,
+		idleTimeout: DefaultIdleTimeout,
+		closed:      make(chan struct{}),
 	}
 }
 
+// Attach application data to the connection.
+// The data is kept across session resumption.
+func (c *Connection) Set(key string, value interface{}) {
+	c.metaMutex.Lock()
+	defer c.metaMutex.Unlock()
+
+	if c.meta == nil {
+		c.meta = make(map[string]interface{})
+	}
+	c.meta[key] = value
+}
+
+// Get application data attached to the connection.
+func (c *Connection) Get(key string) (interface{}, bool) {
+	c.metaMutex.RLock()
+	defer c.metaMutex.RUnlock()
+
+	value, ok := c.meta[key]
+	return value, ok
+}
+
+// Get current connection state.
+func (c *Connection) State() int {
+	return int(c.state.Load())
+}
+
+// Change connection state.
+func (c *Connection) setState(state int) {
+	c.state.Store(int32(state))
+}
+
+// Get the remote network address.
+func (c *Connection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Take a snapshot of connection statistics.
+func (c *Connection) Stats() ConnectionStats {
+	stats := ConnectionStats{
+		Id:               c.Id,
+		State:            c.State(),
+		BytesSent:        c.bytesSent.Load(),
+		BytesReceived:    c.bytesReceived.Load(),
+		MessagesSent:     c.messagesSent.Load(),
+		MessagesReceived: c.messagesReceived.Load(),
+		MessagesDropped:  c.messagesDropped.Load(),
+		MessagesRejected: c.messagesRejected.Load(),
+		QueueDepth:       len(c.Write),
+		PingRTT:          time.Duration(c.pingRTT.Load()),
+		PingPending:      c.pingSentAt.Load() > 0,
+	}
+	if last := c.lastActivity.Load(); last > 0 {
+		stats.LastActivity = time.Unix(0, last)
+	}
+	return stats
+}
+
+// Send ping frame to client.
+// Round trip time is measured when the pong frame arrives.
+func (c *Connection) Ping() error {
+	if c.State() != CONNECTED {
+		return errors.New("Connection is not established")
+	}
+	c.pingSentAt.Store(time.Now().UnixNano())
+	return c.enqueue(NewPingFrame())
+}
+
+// Send text message to client.
+// Message is split into frames by max buffer size, and queued to the writer.
+// The returned delivery is resolved when the message is queued,
+// or when the client acks it if Server.Ack is set ( see SendAck() ).
+func (c *Connection) Send(message []byte) *Delivery {
+	return c.send(TextFrame, message)
+}
+
+// Send binary message to client.
+func (c *Connection) SendBinary(message []byte) *Delivery {
+	return c.send(BinaryFrame, message)
+}
+
+// Get the status code which can be sent for the received one.
+// Codes which must not be sent ( 1005, 1006, 1015 ), reserved and undefined ones are protocol error.
+func sendableCloseCode(code int) int {
+	switch {
+	case code >= 1000 && code <= 1003,
+		code >= 1007 && code <= 1014,
+		code >= 3000 && code <= 4999:
+		return code
+	}
+	return CloseProtocolError
+}
+
+// Close connection with status code and reason.
+// The closing frame is written directly, pending queue messages are discarded.
+func (c *Connection) CloseWith(code int, reason string) {
+	if c.State() == CLOSED {
+		return
+	}
+	c.setState(CLOSING)
+
+	// Unblock the writer if it is stuck on slow socket
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeMutex.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.conn.Write(NewCloseFrame(code, reason).getData())
+	c.writeMutex.Unlock()
+
+	c.shutdown()
+}
+
+// Close connection with status code and reason after the queued messages are written.
+// The closing frame is queued behind them, and written directly by CloseWith()
+// if the queue is not drained in the send timeout or the frame is dropped.
+func (c *Connection) CloseAfterFlush(code int, reason string) {
+	if c.State() != CONNECTED {
+		c.CloseWith(code, reason)
+		return
+	}
+	sf := &syncFrame{Frame: NewCloseFrame(code, reason), done: make(chan error, 1)}
+	if err := c.enqueue(sf); err == nil {
+		c.setState(CLOSING)
+		if err := sf.wait(c.closed, time.Now().Add(c.sendTimeout)); err == nil {
+			c.shutdown()
+			return
+		}
+	}
+	c.CloseWith(code, reason)
+}
+
+// Stop all connection goroutines and close socket.
+func (c *Connection) shutdown() {
+	c.closeOnce.Do(func() {
+		c.setState(CLOSED)
+		close(c.closed)
+		if c.poller != nil {
+			// socket descriptor must be unregistered before closing,
+			// and there is no loop to notify leaving
+			c.poller.remove(c)
+			c.conn.Close()
+			go c.leave()
+			return
+		}
+		c.conn.Close()
+	})
+}
+
+// Record socket activity time.
+func (c *Connection) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
 // Waiting incoming message, receive channel.
 func (c *Connection) Wait(broadCast chan *Frame, join, manager chan *Connection) {
-	c.broadcast = broadCast
-	c.manager = manager
-	c.join = join
+	c.attach(broadCast, join, manager)
+	c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
 
+	go c.writeLoop()
 	go c.readSocket()
 	c.loop()
 }
 
+// Waiting incoming message with netpoll.
+// No goroutine is used until the socket becomes readable.
+func (c *Connection) waitPoll(p *poller, broadCast chan *Frame, join, manager chan *Connection) error {
+	c.attach(broadCast, join, manager)
+	c.extendIdle()
+	return p.add(c)
+}
+
+// Set server channels.
+func (c *Connection) attach(broadCast chan *Frame, join, manager chan *Connection) {
+	c.broadcast = broadCast
+	c.manager = manager
+	c.join = join
+}
+
 // Main channael message waiting
 func (c *Connection) loop() {
-	defer c.conn.Close()
+	defer c.leave()
 	// Outer loop label
 OUTER:
 	for {
 		select {
 		// Message incoming
 		case msg := <-c.Read:
-			switch c.state {
-			// When state is INITIALIZE, process handshake.
-			case INITIALIZE:
-				req := NewRequest(string(msg.getData()))
-				if err := c.handshake(req, false); err == nil {
-					c.join <- c
-				}
-			// When state is CONNECTED, incoming message.
-			case CONNECTED:
-				frame := NewFrame()
-				err := frame.parse(msg.getData())
-				if err != nil {
-					fmt.Println(err)
-					break OUTER
-				}
-
-				if err := c.handleFrame(frame); err != nil {
-					fmt.Println(err)
-					break OUTER
-				}
+			if err := c.process(msg.getData()); err != nil {
+				fmt.Println(err)
+				break OUTER
 			}
 			go c.readSocket()
-		// Message sending
-		case msg := <-c.Write:
-			data := msg.getData()
-			size := len(data)
-			var (
-				written int
-				err     error
-			)
-			for {
-				if written, err = c.conn.Write(data[written:]); err != nil {
-					fmt.Println(err)
-					break OUTER
-				}
-				if written == size {
-					break
-				}
-			}
 		// Connection closing
 		case <-c.Close:
 			break OUTER
+		case <-c.closed:
+			break OUTER
 		}
 
-		c.conn.SetDeadline(time.Now().Add(1 * time.Minute))
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
 	}
 }
 
-// Read message from socket.
+// Extend the idle deadline checked by the poller ( netpoll mode ).
+// In goroutine mode, the socket read deadline is used.
+func (c *Connection) extendIdle() {
+	c.idleDeadline.Store(time.Now().Add(c.idleTimeout).UnixNano())
+}
+
+// Process incoming socket data.
+// Socket reads are not aligned to messages, so the data is buffered
+// until the handshake request or frames are completed.
+func (c *Connection) process(data []byte) error {
+	if len(c.received) == 0 {
+		c.received = data
+	} else {
+		c.received = append(c.received, data...)
+	}
+
+	for len(c.received) > 0 {
+		switch c.State() {
+		// When state is INITIALIZE, process handshake.
+		case INITIALIZE:
+			end := bytes.Index(c.received, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(c.received) > maxHandshakeSize {
+					c.reject(431)
+					return errors.New("Handshake request is too large")
+				}
+				return nil
+			}
+			req := NewRequest(string(c.received[:end]))
+			c.received = c.received[end+4:]
+			if err := c.handshake(req); err != nil {
+				c.reject(403)
+				return err
+			}
+			c.join <- c
+		// When state is CONNECTED, incoming message.
+		case CONNECTED:
+			size, err := frameSize(c.received)
+			if err != nil {
+				return err
+			}
+			if size == 0 || len(c.received) < size {
+				return nil
+			}
+			frame := NewFrame()
+			if err := frame.parse(c.received[:size]); err != nil {
+				return err
+			}
+			// consumed bytes are never written again, frame can own them
+			c.received = c.received[size:]
+			if err := c.handleFrame(frame); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	c.received = nil
+	return nil
+}
+
+// Close socket and notify leaving to server.
+func (c *Connection) leave() {
+	c.shutdown()
+	if c.manager == nil {
+		return
+	}
+	select {
+	case c.manager <- c:
+	case <-c.serverDone:
+	}
+}
+
+// Read message from socket, and pass to the loop.
 func (c *Connection) readSocket() {
+	dat, err := c.readMessage()
+	if err != nil {
+		c.shutdown()
+		return
+	}
+	select {
+	case c.Read <- NewMessage(dat):
+	case <-c.closed:
+	}
+}
+
+// Read single message from socket.
+func (c *Connection) readMessage() ([]byte, error) {
 	dat := make([]byte, 0)
-	buf := make([]byte, c.maxDataSize)
+	pooled := getBuffer(c.maxDataSize)
+	defer putBuffer(pooled)
+	buf := *pooled
 	for {
 		size, err := c.conn.Read(buf)
-		if err != nil && err != io.EOF {
-			c.Close <- struct{}{}
-			return
+		if err != nil {
+			return nil, err
 		}
 		dat = append(dat, buf[:size]...)
+		c.bytesReceived.Add(int64(size))
+		c.touch()
 		if len(dat) > 0 && size != c.maxDataSize {
-			c.Read <- NewMessage(dat)
-			break
+			return dat, nil
 		}
 	}
 }
 
+// Reply handshake failure response.
+func (c *Connection) reject(code int) {
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	fmt.Fprintf(c.conn, "HTTP/1.1 %03d %s\r\n\r\n", code, http.StatusText(code))
+}
+
 // Processing handshake.
-func (c *Connection) handshake(request *Request, manual bool) error {
-	c.state = OPENING
+// The response is queued as the first message of the connection.
+func (c *Connection) handshake(request *Request) error {
+	c.setState(OPENING)
 
 	// Check valid handshake request
 	if !request.isValid() {
-		fmt.Println(request)
-		c.Close <- struct{}{}
 		return errors.New("Invalid handshake request")
 	}
+	c.Request = request
+
+	if c.server != nil {
+		if err := c.server.checkReplay(request); err != nil {
+			return err
+		}
+	}
 
-	if !manual {
-		response := NewResponse(request)
-		c.Write <- response
+	// Bind application user
+	if c.server != nil && c.server.Identify != nil {
+		userId, err := c.server.Identify(c, request)
+		if err != nil {
+			return err
+		}
+		c.UserId = userId
+	}
+
+	response := NewResponse(request)
+	if c.server != nil {
+		if protocol := c.server.selectSubprotocol(request); protocol != "" {
+			c.Subprotocol = protocol
+			response.SetHeader("Sec-WebSocket-Protocol", protocol)
+		}
+	}
+	if c.server != nil && c.server.Resume > 0 {
+		c.server.resume(c, request, response)
+	}
+	// adapt before receiving messages
+	if c.server != nil && c.server.netListener.Load() != nil {
+		c.NetConn()
+	}
+	if err := c.enqueue(response); err != nil {
+		return err
 	}
 	// state changed to CONNECTED
-	c.state = CONNECTED
+	c.setState(CONNECTED)
 	return nil
 }
 
@@ -181,30 +565,54 @@ func (c *Connection) handshake(request *Request, manual bool) error {
 func (c *Connection) handleFrame(frame *Frame) error {
 	switch frame.Opcode {
 
-	// text / binary frame
-	case 1, 2:
+	// continuation / text / binary frame
+	case 0, 1, 2:
 		c.frameStack = append(c.frameStack, frame)
 		if frame.Fin == 0 {
 			return nil
 		}
-		// synthesize queueing frames (if exists)
+		c.messagesReceived.Add(1)
+		// synthesize queueing frames (if exists) into single message frame
+		opcode := c.frameStack[0].Opcode
 		message := c.frameStack.synthesize()
 		c.frameStack = FrameStack{}
-		frames, err := BuildFrame(message, c.maxDataSize)
+		// net.Conn adapter reads directly, socket reading waits while the adapter buffer is full
+		if nc := c.netConn.Load(); nc != nil && opcode == BinaryFrame {
+			nc.push(message, true)
+			return nil
+		}
+		frame, err := BuildSingleFrame(message, 1, opcode)
 		if err != nil {
 			return err
 		}
-		for _, frame := range frames {
-			c.broadcast <- frame
-		}
+		frame.origin = c
+		c.broadcast <- frame
 
-	// closing frame
+	// closing frame, reply with the same status code if it can be sent
 	case 8:
-		c.Close <- struct{}{}
+		code := CloseNormalClosure
+		switch len(frame.PayloadData) {
+		case 0:
+			c.peerClose.Store(&CloseError{Code: code})
+		case 1:
+			code = CloseProtocolError
+			c.peerClose.Store(&CloseError{Code: code})
+		default:
+			received := int(binary.BigEndian.Uint16(frame.PayloadData))
+			c.peerClose.Store(&CloseError{Code: received, Reason: string(frame.PayloadData[2:])})
+			code = sendableCloseCode(received)
+		}
+		c.CloseWith(code, "")
 
-	// ping frame
+	// ping frame, reply pong to the sender
 	case 9:
-		c.broadcast <- NewPongFrame()
+		return c.enqueue(NewPongFrame())
+
+	// pong frame
+	case 10:
+		if sent := c.pingSentAt.Swap(0); sent > 0 {
+			c.pingRTT.Store(time.Now().UnixNano() - sent)
+		}
 	}
 
 	return nil
@@ -0,0 +1,250 @@
+package aun
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Server on httptest, connections are passed to the returned channel.
+func newTestServer(t *testing.T, setup func(s *Server)) (*Server, string, chan *Connection) {
+	t.Helper()
+	connected := make(chan *Connection, 16)
+	hs := NewHandlerServer(func(c *Connection) { connected <- c })
+	if setup != nil {
+		setup(hs.Server)
+	}
+	server := httptest.NewServer(hs)
+	t.Cleanup(func() {
+		server.Close()
+		hs.Exit <- 1
+	})
+	return hs.Server, "ws" + strings.TrimPrefix(server.URL, "http"), connected
+}
+
+// Server listening on the local port, connections are passed to the returned channel.
+func newTestListener(t *testing.T, netpoll bool, setup func(s *Server)) (*Server, string, chan *Connection) {
+	t.Helper()
+	s, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.NetPoll = netpoll
+	connected := make(chan *Connection, 16)
+	s.OnConnect = func(c *Connection) { connected <- c }
+	if setup != nil {
+		setup(s)
+	}
+	if s.socket, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(1024)
+	t.Cleanup(func() {
+		s.Exit <- 1
+		<-s.done
+	})
+	return s, "ws://" + s.socket.Addr().String(), connected
+}
+
+// Connection modes to run the same tests.
+var testServerModes = []struct {
+	name  string
+	start func(t *testing.T, setup func(s *Server)) (*Server, string, chan *Connection)
+}{
+	{"handler", newTestServer},
+	{"goroutine", func(t *testing.T, setup func(s *Server)) (*Server, string, chan *Connection) {
+		return newTestListener(t, false, setup)
+	}},
+	{"netpoll", func(t *testing.T, setup func(s *Server)) (*Server, string, chan *Connection) {
+		return newTestListener(t, true, setup)
+	}},
+}
+
+// Connect to the test server and take the server side connection.
+func dialTest(t *testing.T, url string, connected chan *Connection) (*ClientConn, *Connection) {
+	t.Helper()
+	return dialTestWith(t, DefaultDialer, url, connected)
+}
+
+// Connect to the test server with the dialer.
+func dialTestWith(t *testing.T, d *Dialer, url string, connected chan *Connection) (*ClientConn, *Connection) {
+	t.Helper()
+	client, err := d.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeClient(client) })
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	select {
+	case c := <-connected:
+		return client, c
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not accepted")
+	}
+	return nil, nil
+}
+
+// Read the next message of the client.
+func expectMessage(t *testing.T, client *ClientConn, want string) {
+	t.Helper()
+	_, message, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != want {
+		t.Fatalf("received %q, want %q", message, want)
+	}
+}
+
+// Expect nothing is sent to the client before the marker message.
+func expectNoMessage(t *testing.T, client *ClientConn, c *Connection) {
+	t.Helper()
+	c.enqueueMessage([]byte("marker"), TextFrame)
+	expectMessage(t, client, "marker")
+}
+
+// Wait until the condition is satisfied.
+func eventually(t *testing.T, message string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionStats(t *testing.T) {
+	for _, mode := range testServerModes {
+		t.Run(mode.name, func(t *testing.T) {
+			s, url, connected := mode.start(t, nil)
+			testConnectionStats(t, s, url, connected)
+		})
+	}
+}
+
+func testConnectionStats(t *testing.T, s *Server, url string, connected chan *Connection) {
+	client, c := dialTest(t, url, connected)
+
+	if err := client.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := client.ReadMessage(); err != nil || string(message) != "hello" {
+		t.Fatalf("echo = %q, %v", message, err)
+	}
+
+	eventually(t, "sent messages are not counted", func() bool {
+		return c.Stats().MessagesSent >= 2
+	})
+	stats := c.Stats()
+	if stats.Id != c.Id || stats.State != CONNECTED {
+		t.Fatalf("unexpected identity %+v", stats)
+	}
+	if stats.MessagesReceived != 1 || stats.BytesReceived == 0 || stats.BytesSent == 0 {
+		t.Fatalf("traffic is not counted %+v", stats)
+	}
+	if stats.LastActivity.IsZero() || time.Since(stats.LastActivity) > time.Minute {
+		t.Fatalf("last activity = %v", stats.LastActivity)
+	}
+	if stats.QueueDepth != 0 || stats.MessagesDropped != 0 {
+		t.Fatalf("unexpected queue %+v", stats)
+	}
+
+	if found, ok := s.Connection(c.Id); !ok || found != c {
+		t.Fatal("connection is not found by ID")
+	}
+	if n := s.ConnectionCount(); n != 1 {
+		t.Fatalf("connection count = %d, want 1", n)
+	}
+	var ids []string
+	for conn := range s.Connections() {
+		ids = append(ids, conn.Id)
+	}
+	if len(ids) != 1 || ids[0] != c.Id {
+		t.Fatalf("iterated %v", ids)
+	}
+}
+
+func TestConnectionPingRTT(t *testing.T) {
+	for _, mode := range testServerModes {
+		t.Run(mode.name, func(t *testing.T) {
+			_, url, connected := mode.start(t, nil)
+			testConnectionPingRTT(t, url, connected)
+		})
+	}
+}
+
+func testConnectionPingRTT(t *testing.T, url string, connected chan *Connection) {
+	client, c := dialTest(t, url, connected)
+	// pong is replied by the reader
+	go client.ReadMessage()
+
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "ping round trip is not measured", func() bool {
+		stats := c.Stats()
+		return stats.PingRTT > 0 && !stats.PingPending
+	})
+	// closing reply is received by the running reader
+	client.Close()
+}
+
+func TestConnectionLeavesRegistry(t *testing.T) {
+	for _, mode := range testServerModes {
+		t.Run(mode.name, func(t *testing.T) {
+			s, url, connected := mode.start(t, nil)
+			testConnectionLeavesRegistry(t, s, url, connected)
+		})
+	}
+}
+
+func testConnectionLeavesRegistry(t *testing.T, s *Server, url string, connected chan *Connection) {
+	client, c := dialTest(t, url, connected)
+
+	closeClient(client)
+	eventually(t, "closed connection is still registered", func() bool {
+		_, ok := s.Connection(c.Id)
+		return !ok && s.ConnectionCount() == 0
+	})
+	if c.State() != CLOSED {
+		t.Fatalf("state = %d, want CLOSED", c.State())
+	}
+}
+
+func TestConnectionIdleTimeout(t *testing.T) {
+	for _, mode := range testServerModes {
+		t.Run(mode.name, func(t *testing.T) {
+			s, url, connected := mode.start(t, func(s *Server) {
+				s.IdleTimeout = 300 * time.Millisecond
+			})
+			testConnectionIdleTimeout(t, s, url, connected)
+		})
+	}
+}
+
+func testConnectionIdleTimeout(t *testing.T, s *Server, url string, connected chan *Connection) {
+	client, c := dialTest(t, url, connected)
+
+	// receiving extends the deadline
+	for i := 0; i < 6; i++ {
+		if err := client.Send([]byte("keep")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := client.ReadMessage(); err != nil {
+			t.Fatalf("connection is closed while receiving: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("message is received from the idle connection")
+	}
+	eventually(t, "idle connection is not closed", func() bool {
+		return c.State() == CLOSED && s.ConnectionCount() == 0
+	})
+}
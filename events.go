@@ -0,0 +1,101 @@
+package aun
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Event message envelope:
+//
+//	{"event": "chat", "data": {...}}
+type eventEnvelope struct {
+	Event string  `json:"event"`
+	Data  RawData `json:"data"`
+}
+
+// Outgoing event message envelope.
+type eventMessage struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// Event handler with undecoded data.
+type eventHandler func(conn *Connection, data RawData) error
+
+// Typed event messaging encoded by the codec.
+// Messages of registered events are consumed before OnMessage and broadcasting,
+// others are handled as usual.
+type Events struct {
+	server *Server
+	codec  Codec
+
+	mutex    sync.RWMutex
+	handlers map[string][]eventHandler
+}
+
+// Enable event messaging on the server with the codec.
+func NewEvents(s *Server, codec Codec) *Events {
+	e := &Events{
+		server:   s,
+		codec:    codec,
+		handlers: make(map[string][]eventHandler),
+	}
+	s.addMessageHook(e.handle)
+	return e
+}
+
+// Register handler of the event, data is decoded to T.
+// Handlers run on the connection worker in the message order.
+//
+//	aun.On(events, "chat", func(conn *aun.Connection, msg ChatMsg) {
+//	    ...
+//	})
+func On[T any](e *Events, event string, handler func(conn *Connection, data T)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.handlers[event] = append(e.handlers[event], func(conn *Connection, raw RawData) error {
+		var data T
+		if len(raw) > 0 {
+			if err := e.codec.Unmarshal(raw, &data); err != nil {
+				return fmt.Errorf("Failed to decode event %s: %w", event, err)
+			}
+		}
+		handler(conn, data)
+		return nil
+	})
+}
+
+// Send the event to the connection.
+func (e *Events) Emit(conn *Connection, event string, data interface{}) error {
+	message, err := e.codec.Marshal(eventMessage{Event: event, Data: data})
+	if err != nil {
+		return err
+	}
+	return conn.enqueueMessage(message, e.codec.Opcode())
+}
+
+// Message hook to dispatch registered events.
+func (e *Events) handle(c *Connection, frame *Frame) bool {
+	if frame.Opcode != e.codec.Opcode() {
+		return false
+	}
+	envelope := &eventEnvelope{}
+	if err := e.codec.Unmarshal(frame.PayloadData, envelope); err != nil || envelope.Event == "" {
+		return false
+	}
+
+	e.mutex.RLock()
+	handlers := e.handlers[envelope.Event]
+	e.mutex.RUnlock()
+	if len(handlers) == 0 {
+		return false
+	}
+
+	for _, handler := range handlers {
+		if err := handler(c, envelope.Data); err != nil {
+			e.server.handleError(c, err)
+		}
+	}
+	return true
+}
@@ -23,6 +23,7 @@ package aun
 
 import (
 	"encoding/binary"
+	"errors"
 )
 
 type Frame struct {
@@ -37,6 +38,9 @@ type Frame struct {
 	PayloadLength int
 	MaskingKey    []byte
 	PayloadData   []byte
+
+	// Connection which sent the message ( nil for server messages )
+	origin *Connection
 }
 
 // Create new frame
@@ -58,25 +62,53 @@ func NewPongFrame() *Frame {
 	}
 }
 
+// Create "ping" frame
+func NewPingFrame() *Frame {
+	return &Frame{
+		Fin:           1,
+		Opcode:        9,
+		PayloadLength: 0,
+		PayloadData:   []byte{},
+	}
+}
+
+// Create "close" frame with status code and reason
+func NewCloseFrame(code int, reason string) *Frame {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return &Frame{
+		Fin:           1,
+		Opcode:        8,
+		PayloadLength: len(payload),
+		PayloadData:   payload,
+	}
+}
+
 // Create Message frame for S->C sending
 func BuildFrame(message []byte, maxSize int) (FrameStack, error) {
+	return buildFrames(message, TextFrame, maxSize)
+}
+
+// Split message into frames by max size.
+// First frame has the opcode, following frames are continuation.
+func buildFrames(message []byte, opcode int, maxSize int) (FrameStack, error) {
 	stack := FrameStack{}
 
 	for len(message) > maxSize {
-		frame, err := BuildSingleFrame(message[0:maxSize], 0, 0)
+		frame, err := BuildSingleFrame(message[0:maxSize], 0, opcode)
 		if err != nil {
 			return stack, err
 		}
 		stack = append(stack, frame)
 		message = message[maxSize:]
+		opcode = ContinuationFrame
 	}
-	if len(message) > 0 {
-		frame, err := BuildSingleFrame(message, 1, 1)
-		if err != nil {
-			return stack, err
-		}
-		stack = append(stack, frame)
+	frame, err := BuildSingleFrame(message, 1, opcode)
+	if err != nil {
+		return stack, err
 	}
+	stack = append(stack, frame)
 	return stack, nil
 }
 
@@ -96,6 +128,37 @@ func BuildSingleFrame(message []byte, finBit int, opcode int) (*Frame, error) {
 	}, nil
 }
 
+// Calculate the whole frame size from the header.
+// Returns zero if the header is incomplete.
+func frameSize(buffer []byte) (int, error) {
+	if len(buffer) < 2 {
+		return 0, nil
+	}
+	size := 2
+	length := uint64(buffer[1] & 0x7F)
+	switch length {
+	case 126:
+		if len(buffer) < 4 {
+			return 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(buffer[2:4]))
+		size += 2
+	case 127:
+		if len(buffer) < 10 {
+			return 0, nil
+		}
+		length = binary.BigEndian.Uint64(buffer[2:10])
+		size += 8
+	}
+	if buffer[1]&0x80 > 0 {
+		size += 4
+	}
+	if length > maxFramePayload {
+		return 0, errors.New("Frame payload is too large")
+	}
+	return size + int(length), nil
+}
+
 // Parse them incoming message frame.
 func (f *Frame) parse(buffer []byte) error {
 	bits := int(buffer[0])
@@ -128,16 +191,9 @@ func (f *Frame) parse(buffer []byte) error {
 	if f.Mask > 0 {
 		f.MaskingKey = buffer[index:(index + 4)]
 		index += 4
-		payload := buffer[index:(index + f.PayloadLength)]
-		size := len(payload)
-		for i := 0; i < size; i++ {
-			f.PayloadData = append(
-				f.PayloadData,
-				// Unmasking payload:
-				// payload-i ^ masking-key-j mod 4
-				byte((int(payload[i]) ^ int(f.MaskingKey[i%4]))),
-			)
-		}
+		// Unmasking payload in place, buffer is owned by this frame
+		f.PayloadData = buffer[index:(index + f.PayloadLength)]
+		maskBytes([4]byte(f.MaskingKey), 0, f.PayloadData)
 	} else {
 		f.PayloadData = buffer[index:(index + f.PayloadLength)]
 	}
@@ -151,46 +207,65 @@ func (f *Frame) getData() []byte {
 }
 
 // Binarify the frame to send.
-func (f *Frame) toFrameBytes() (data []byte) {
-	bin := 0
-	bin |= (f.Fin << 7)
-	bin |= (f.RSV1 << 6)
-	bin |= (f.RSV1 << 5)
-	bin |= (f.RSV1 << 4)
-	bin |= f.Opcode
-	data = append(data, byte(bin))
-
-	bin = 0
-	bin |= (f.Mask << 7)
+func (f *Frame) toFrameBytes() []byte {
+	data := make([]byte, f.headerLength()+len(f.PayloadData))
+	f.encodeTo(data)
+	return data
+}
+
+// Byte length of frame header.
+func (f *Frame) headerLength() int {
+	size := 2
+	switch {
+	case f.PayloadLength > 65535:
+		size += 8
+	case f.PayloadLength >= 126:
+		size += 2
+	}
+	if f.Mask > 0 {
+		size += 4
+	}
+	return size
+}
+
+// Write frame header to dst and return the written size.
+// dst must have at least headerLength() bytes.
+func (f *Frame) putHeader(dst []byte) int {
+	dst[0] = byte(f.Fin<<7 | f.RSV1<<6 | f.RSV2<<5 | f.RSV3<<4 | f.Opcode)
+
+	index := 2
+	mask := byte(f.Mask << 7)
 	switch {
 	case f.PayloadLength > 65535:
-		bin |= 127
-		data = append(data, byte(bin))
 		// extra payload length of 8 bytes
-		data = append(
-			data,
-			byte((f.PayloadLength>>56)&0xFF),
-			byte((f.PayloadLength>>48)&0xFF),
-			byte((f.PayloadLength>>40)&0xFF),
-			byte((f.PayloadLength>>32)&0xFF),
-			byte((f.PayloadLength>>24)&0xFF),
-			byte((f.PayloadLength>>16)&0xFF),
-			byte((f.PayloadLength>>8)&0xFF),
-			byte((f.PayloadLength)&0xFF),
-		)
-	case f.PayloadLength > 126 && f.PayloadLength <= 65535:
-		bin |= 126
-		data = append(data, byte(bin))
+		dst[1] = mask | 127
+		binary.BigEndian.PutUint64(dst[index:], uint64(f.PayloadLength))
+		index += 8
+	case f.PayloadLength >= 126:
 		// extra payload length of 2 bytes
-		data = append(
-			data,
-			byte((f.PayloadLength>>8)&0xFF),
-			byte((f.PayloadLength)&0xFF),
-		)
+		dst[1] = mask | 126
+		binary.BigEndian.PutUint16(dst[index:], uint16(f.PayloadLength))
+		index += 2
 	default:
-		bin |= f.PayloadLength
-		data = append(data, byte(bin))
+		dst[1] = mask | byte(f.PayloadLength)
+	}
+	if f.Mask > 0 {
+		if len(f.MaskingKey) != 4 {
+			f.MaskingKey = newMaskingKey()
+		}
+		index += copy(dst[index:], f.MaskingKey)
+	}
+	return index
+}
+
+// Write whole frame to dst and return the written size.
+// dst must have at least headerLength() + payload bytes.
+func (f *Frame) encodeTo(dst []byte) int {
+	index := f.putHeader(dst)
+	size := copy(dst[index:], f.PayloadData)
+	// C->S frame, mask the copied payload
+	if f.Mask > 0 {
+		maskBytes([4]byte(f.MaskingKey), 0, dst[index:index+size])
 	}
-	data = append(data, f.PayloadData...)
-	return
+	return index + size
 }
@@ -0,0 +1,198 @@
+package aun
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Header and query parameter name to request replay on handshake
+const (
+	ReplayHeader = "Aun-Since"
+	ReplayQuery  = "since"
+)
+
+// Replay from a sequence number is requested, but messages are sent without it.
+var ErrHistoryNotStamped = errors.New("History is not stamped, replay from sequence number is unavailable")
+
+// Recorded message.
+type HistoryEntry struct {
+	// Sequence number, starts from 1
+	Seq uint64
+
+	// Frame opcode and payload ( stamped with sequence number if History.Stamp is set )
+	Opcode  int
+	Payload []byte
+
+	// Recorded time
+	Time time.Time
+}
+
+// Ring buffer of the last messages.
+//
+// Messages are sent unchanged by default. If Stamp is set, live and replayed messages
+// are stamped with the sequence number, so clients know where to replay from.
+// Replay is available only with Stamp, clients have no sequence number without it:
+//
+//	text:   {"seq": 10, "data": "original message"}
+//	binary: 8 bytes big endian sequence number + original message
+//
+// Text message which is not valid UTF-8 is not stamped, since JSON string can't keep it.
+// Sequence numbers are counted per node, so with a broker, clients must replay from the same node.
+type History struct {
+	// Stamp sequence number to the messages, must be set before recording.
+	// Required for replaying.
+	Stamp bool
+
+	mutex   sync.Mutex
+	maxAge  time.Duration
+	entries []HistoryEntry
+
+	// Index of the oldest entry and number of entries
+	head  int
+	count int
+
+	// Last sequence number
+	seq uint64
+}
+
+// Create history which keeps the last size messages.
+// If maxAge is not zero, older messages are also discarded.
+func NewHistory(size int, maxAge time.Duration) *History {
+	if size <= 0 {
+		size = 100
+	}
+	return &History{
+		maxAge:  maxAge,
+		entries: make([]HistoryEntry, size),
+	}
+}
+
+// Get the last sequence number.
+func (h *History) Seq() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.seq
+}
+
+// Get messages after the sequence number.
+func (h *History) Since(seq uint64) []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.expire()
+	var entries []HistoryEntry
+	for i := 0; i < h.count; i++ {
+		entry := h.entries[(h.head+i)%len(h.entries)]
+		if entry.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Record message frame, and return the stamped frame to send.
+func (h *History) record(message *Frame) *Frame {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seq++
+	entry := HistoryEntry{
+		Seq:     h.seq,
+		Opcode:  message.Opcode,
+		Payload: message.PayloadData,
+		Time:    time.Now(),
+	}
+	if h.count == len(h.entries) {
+		h.head = (h.head + 1) % len(h.entries)
+		h.count--
+	}
+	if h.Stamp {
+		entry.Payload = stamp(h.seq, message.Opcode, message.PayloadData)
+	}
+	h.entries[(h.head+h.count)%len(h.entries)] = entry
+	h.count++
+	h.expire()
+
+	if !h.Stamp {
+		return message
+	}
+	frame, _ := BuildSingleFrame(entry.Payload, 1, entry.Opcode)
+	return frame
+}
+
+// Discard expired entries, must be called with lock.
+func (h *History) expire() {
+	if h.maxAge <= 0 {
+		return
+	}
+	limit := time.Now().Add(-h.maxAge)
+	for h.count > 0 && h.entries[h.head].Time.Before(limit) {
+		h.entries[h.head] = HistoryEntry{}
+		h.head = (h.head + 1) % len(h.entries)
+		h.count--
+	}
+}
+
+// Stamp sequence number to the message payload.
+func stamp(seq uint64, opcode int, payload []byte) []byte {
+	if opcode == BinaryFrame {
+		stamped := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint64(stamped, seq)
+		return append(stamped, payload...)
+	}
+	if !utf8.Valid(payload) {
+		return payload
+	}
+	stamped, _ := json.Marshal(struct {
+		Seq  uint64 `json:"seq"`
+		Data string `json:"data"`
+	}{seq, string(payload)})
+	return stamped
+}
+
+// Queue history messages to the connection.
+func (c *Connection) replay(entries []HistoryEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	batch := &frameBatch{}
+	for _, entry := range entries {
+		frames, err := buildFrames(entry.Payload, entry.Opcode, c.maxDataSize)
+		if err != nil {
+			return err
+		}
+		for _, f := range frames {
+			batch.frames = append(batch.frames, prepareFrame(f))
+		}
+	}
+	return c.enqueue(batch)
+}
+
+// Check the replay request on handshake against the server history.
+func (s *Server) checkReplay(r *Request) error {
+	if _, ok := r.replaySince(); ok && s.History != nil && !s.History.Stamp {
+		return ErrHistoryNotStamped
+	}
+	return nil
+}
+
+// Get the sequence number requested to replay from on handshake.
+func (r *Request) replaySince() (uint64, bool) {
+	value := r.Header(ReplayHeader)
+	if value == "" {
+		value = r.Query().Get(ReplayQuery)
+	}
+	if value == "" {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
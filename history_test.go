@@ -0,0 +1,93 @@
+package aun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func recordText(h *History, message string) *Frame {
+	frame, _ := BuildSingleFrame([]byte(message), 1, TextFrame)
+	return h.record(frame)
+}
+
+func TestHistoryKeepsMessagesUnchanged(t *testing.T) {
+	h := NewHistory(2, 0)
+	for _, m := range []string{"a", "b", "c"} {
+		if sent := recordText(h, m); string(sent.PayloadData) != m {
+			t.Fatalf("sent %q, want %q", sent.PayloadData, m)
+		}
+	}
+	entries := h.Since(0)
+	if len(entries) != 2 || entries[0].Seq != 2 || string(entries[1].Payload) != "c" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestHistoryStamp(t *testing.T) {
+	h := NewHistory(10, 0)
+	h.Stamp = true
+
+	if sent := recordText(h, "hello"); string(sent.PayloadData) != `{"seq":1,"data":"hello"}` {
+		t.Fatalf("stamped text = %s", sent.PayloadData)
+	}
+
+	frame, _ := BuildSingleFrame([]byte{1, 2}, 1, BinaryFrame)
+	sent := h.record(frame)
+	if binary.BigEndian.Uint64(sent.PayloadData) != 2 || !bytes.Equal(sent.PayloadData[8:], []byte{1, 2}) {
+		t.Fatalf("stamped binary = %v", sent.PayloadData)
+	}
+
+	// invalid UTF-8 can't be kept in JSON string
+	invalid := string([]byte{0xff, 'a'})
+	if sent := recordText(h, invalid); string(sent.PayloadData) != invalid {
+		t.Fatalf("invalid UTF-8 text is modified: %q", sent.PayloadData)
+	}
+
+	if entries := h.Since(1); len(entries) != 2 || entries[0].Seq != 2 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestReplayRequiresStamp(t *testing.T) {
+	history := NewHistory(10, 0)
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.History = history
+	})
+	if c, err := Dial(url + "?since=0"); err == nil {
+		closeClient(c)
+		t.Fatal("replay is accepted without stamping")
+	}
+	// connection without replay request is accepted
+	dialTest(t, url, connected)
+}
+
+func TestReplayOnHandshake(t *testing.T) {
+	history := NewHistory(10, 0)
+	history.Stamp = true
+	s, url, connected := newTestServer(t, func(s *Server) {
+		s.History = history
+	})
+	first, _ := dialTest(t, url, connected)
+	s.Notify([]byte("a"))
+	s.Notify([]byte("b"))
+	expectMessage(t, first, `{"seq":1,"data":"a"}`)
+	expectMessage(t, first, `{"seq":2,"data":"b"}`)
+
+	late, _ := dialTest(t, url+"?since=1", connected)
+	expectMessage(t, late, `{"seq":2,"data":"b"}`)
+}
+
+func TestJoinSinceRequiresStamp(t *testing.T) {
+	hub, url, connected := newTestHub(t)
+	_, c := dialTest(t, url, connected)
+
+	hub.EnableHistory("plain", 10, 0)
+	if hub.JoinSince(c, "plain", 0) {
+		t.Fatal("joined with replay without stamping")
+	}
+	hub.EnableHistory("stamped", 10, 0).Stamp = true
+	if !hub.JoinSince(c, "stamped", 0) {
+		t.Fatal("join with replay failed")
+	}
+}
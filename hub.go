@@ -0,0 +1,306 @@
+package aun
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// On topic join/leave hook handler
+type TopicHandler func(conn *Connection, topic string)
+
+// Topic based publish/subscribe between connections.
+// Memberships are removed automatically when the connection is closed.
+type Hub struct {
+	server *Server
+	mutex  sync.RWMutex
+
+	// topic -> members
+	topics map[string]map[*Connection]struct{}
+
+	// connection -> joined topics
+	joined map[*Connection]map[string]struct{}
+
+	// optional hooks
+	OnJoin  TopicHandler
+	OnLeave TopicHandler
+
+	// Internal hooks run synchronously on leaving
+	leaveHooks []TopicHandler
+
+	// Presence trackers, restored on session resumption
+	presences []*Presence
+
+	// Message history per topic
+	histories map[string]*History
+
+	// Broker channel of the hub
+	channel string
+}
+
+// Create new hub on the server.
+func NewHub(s *Server) *Hub {
+	h := &Hub{
+		server:    s,
+		topics:    make(map[string]map[*Connection]struct{}),
+		joined:    make(map[*Connection]map[string]struct{}),
+		histories: make(map[string]*History),
+	}
+	s.addLeaveHook(h.leaveAll)
+	s.addHub(h)
+	if broker := s.currentBroker(); broker != nil {
+		if err := h.subscribe(broker); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return h
+}
+
+// Join connection to the topic.
+// Returns false if already joined, or the connection is closed.
+func (h *Hub) Join(conn *Connection, topic string) bool {
+	if !h.add(conn, topic) {
+		return false
+	}
+	if h.OnJoin != nil {
+		h.OnJoin(conn, topic)
+	}
+	return true
+}
+
+// Join connection to the topic,
+// and replay the topic history after the sequence number before any live message.
+// Returns false without joining if the history is not stamped ( see History.Stamp ).
+func (h *Hub) JoinSince(conn *Connection, topic string, seq uint64) bool {
+	history := h.History(topic)
+	if history != nil && !history.Stamp {
+		return false
+	}
+
+	h.server.fanoutMutex.Lock()
+	if history != nil {
+		conn.replay(history.Since(seq))
+	}
+	ok := h.add(conn, topic)
+	h.server.fanoutMutex.Unlock()
+
+	if ok && h.OnJoin != nil {
+		h.OnJoin(conn, topic)
+	}
+	return ok
+}
+
+// Add membership.
+func (h *Hub) add(conn *Connection, topic string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if conn.State() == CLOSED {
+		return false
+	}
+	if _, ok := h.joined[conn][topic]; ok {
+		return false
+	}
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*Connection]struct{})
+	}
+	if h.joined[conn] == nil {
+		h.joined[conn] = make(map[string]struct{})
+	}
+	h.topics[topic][conn] = struct{}{}
+	h.joined[conn][topic] = struct{}{}
+	return true
+}
+
+// Record messages published to the topic, for replaying by JoinSince().
+func (h *Hub) EnableHistory(topic string, size int, maxAge time.Duration) *History {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.histories[topic] == nil {
+		h.histories[topic] = NewHistory(size, maxAge)
+	}
+	return h.histories[topic]
+}
+
+// Get history of the topic ( nil if disabled ).
+func (h *Hub) History(topic string) *History {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.histories[topic]
+}
+
+// Leave connection from the topic.
+// Returns false if not joined.
+func (h *Hub) Leave(conn *Connection, topic string) bool {
+	h.mutex.Lock()
+	ok := h.remove(conn, topic)
+	hooks := h.leaveHooks
+	h.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	for _, hook := range hooks {
+		hook(conn, topic)
+	}
+	if h.OnLeave != nil {
+		h.OnLeave(conn, topic)
+	}
+	return true
+}
+
+// Remove membership, must be called with lock.
+func (h *Hub) remove(conn *Connection, topic string) bool {
+	if _, ok := h.joined[conn][topic]; !ok {
+		return false
+	}
+	delete(h.joined[conn], topic)
+	if len(h.joined[conn]) == 0 {
+		delete(h.joined, conn)
+	}
+	delete(h.topics[topic], conn)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+	return true
+}
+
+// Leave closed connection from all topics.
+// OnLeave hooks run on the connection worker.
+func (h *Hub) leaveAll(conn *Connection) {
+	h.mutex.Lock()
+	topics := make([]string, 0, len(h.joined[conn]))
+	for topic := range h.joined[conn] {
+		topics = append(topics, topic)
+		h.remove(conn, topic)
+	}
+	hooks := h.leaveHooks
+	h.mutex.Unlock()
+
+	for _, topic := range topics {
+		for _, hook := range hooks {
+			hook(conn, topic)
+		}
+	}
+
+	if len(topics) > 0 && h.OnLeave != nil {
+		h.server.dispatch(conn, func() {
+			for _, topic := range topics {
+				h.OnLeave(conn, topic)
+			}
+		})
+	}
+}
+
+// Send text message to all members of the topic.
+// Members on other nodes receive it through the server broker.
+func (h *Hub) Publish(topic string, message []byte) error {
+	return h.publishExcept(topic, message, nil)
+}
+
+// Send text message to members of the topic except the connection.
+// Members on other nodes receive it through the server broker.
+func (h *Hub) publishExcept(topic string, message []byte, except *Connection) error {
+	var exceptId string
+	if except != nil {
+		exceptId = except.Id
+	}
+	if broker := h.server.currentBroker(); broker != nil {
+		m := &brokerMessage{opcode: TextFrame, except: exceptId, topic: topic, payload: message}
+		return broker.Publish(h.channel, m.encode())
+	}
+
+	frame, err := BuildSingleFrame(message, 1, TextFrame)
+	if err != nil {
+		return err
+	}
+	h.publishLocal(topic, frame, exceptId)
+	return nil
+}
+
+// Send message frame to members of the topic on this node, except the connection ID.
+func (h *Hub) publishLocal(topic string, frame *Frame, except string) {
+	members := h.eachMember(topic)
+	if except != "" {
+		all := members
+		members = func(fn func(*Connection) bool) {
+			all(func(c *Connection) bool {
+				if c.Id == except {
+					return true
+				}
+				return fn(c)
+			})
+		}
+	}
+
+	history := h.History(topic)
+	if history == nil {
+		h.server.deliver(frame, members)
+		return
+	}
+
+	// recording and sending must not be interleaved with JoinSince()
+	h.server.fanoutMutex.Lock()
+	defer h.server.fanoutMutex.Unlock()
+	h.server.send(history.record(frame), members)
+}
+
+// Register internal hook for leaving.
+// Hooks may run on the server loop, so they must not block.
+func (h *Hub) addLeaveHook(hook TopicHandler) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.leaveHooks = append(h.leaveHooks, hook)
+}
+
+// Register presence tracker of the hub.
+func (h *Hub) addPresence(p *Presence) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.presences = append(h.presences, p)
+}
+
+// Get presence trackers of the hub.
+func (h *Hub) presenceList() []*Presence {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.presences
+}
+
+// Get members of the topic.
+func (h *Hub) Members(topic string) []*Connection {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	members := make([]*Connection, 0, len(h.topics[topic]))
+	for c := range h.topics[topic] {
+		members = append(members, c)
+	}
+	return members
+}
+
+// Get topics which the connection joined.
+func (h *Hub) Topics(conn *Connection) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	topics := make([]string, 0, len(h.joined[conn]))
+	for topic := range h.joined[conn] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Iterator over the topic member snapshot.
+func (h *Hub) eachMember(topic string) func(func(*Connection) bool) {
+	members := h.Members(topic)
+	return func(fn func(*Connection) bool) {
+		for _, c := range members {
+			if !fn(c) {
+				return
+			}
+		}
+	}
+}
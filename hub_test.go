@@ -0,0 +1,87 @@
+package aun
+
+import (
+	"testing"
+	"time"
+)
+
+// Hub on the test server without broadcasting.
+func newTestHub(t *testing.T) (*Hub, string, chan *Connection) {
+	t.Helper()
+	var hub *Hub
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		hub = NewHub(s)
+	})
+	return hub, url, connected
+}
+
+func TestHubPublishToMembers(t *testing.T) {
+	hub, url, connected := newTestHub(t)
+	clientA, a := dialTest(t, url, connected)
+	clientB, b := dialTest(t, url, connected)
+	clientC, c := dialTest(t, url, connected)
+
+	var joined []string
+	hub.OnJoin = func(conn *Connection, topic string) {
+		joined = append(joined, conn.Id+":"+topic)
+	}
+	if !hub.Join(a, "room") || !hub.Join(b, "room") || !hub.Join(c, "lobby") {
+		t.Fatal("join failed")
+	}
+	if hub.Join(a, "room") {
+		t.Fatal("joined the same topic twice")
+	}
+	if len(joined) != 3 || joined[0] != a.Id+":room" {
+		t.Fatalf("OnJoin called with %v", joined)
+	}
+	if members := hub.Members("room"); len(members) != 2 {
+		t.Fatalf("room has %d members, want 2", len(members))
+	}
+	if topics := hub.Topics(c); len(topics) != 1 || topics[0] != "lobby" {
+		t.Fatalf("topics of c = %v", topics)
+	}
+
+	if err := hub.Publish("room", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, clientA, "hello")
+	expectMessage(t, clientB, "hello")
+	expectNoMessage(t, clientC, c)
+
+	if !hub.Leave(a, "room") || hub.Leave(a, "room") {
+		t.Fatal("leave is not reported once")
+	}
+	hub.Publish("room", []byte("after leave"))
+	expectMessage(t, clientB, "after leave")
+	expectNoMessage(t, clientA, a)
+}
+
+func TestHubLeavesClosedConnection(t *testing.T) {
+	hub, url, connected := newTestHub(t)
+	client, c := dialTest(t, url, connected)
+
+	left := make(chan string, 2)
+	hub.OnLeave = func(conn *Connection, topic string) {
+		left <- topic
+	}
+	hub.Join(c, "room")
+	hub.Join(c, "lobby")
+	closeClient(client)
+
+	topics := map[string]bool{}
+	for len(topics) < 2 {
+		select {
+		case topic := <-left:
+			topics[topic] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OnLeave called for %v", topics)
+		}
+	}
+	if len(hub.Members("room")) != 0 || len(hub.Topics(c)) != 0 {
+		t.Fatal("closed connection is still a member")
+	}
+	if hub.Join(c, "room") {
+		t.Fatal("closed connection joined")
+	}
+}
@@ -0,0 +1,471 @@
+package aun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// JSON-RPC 2.0 subprotocol name
+const JSONRPCSubprotocol = "jsonrpc"
+
+// JSON-RPC version
+const jsonrpcVersion = "2.0"
+
+var (
+	contextType    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	connectionType = reflect.TypeOf((*Connection)(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// JSON-RPC request or notification.
+type jsonrpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  *string         `json:"method"`
+	Params  json.RawMessage `json:"params"`
+
+	// nil for notification
+	Id json.RawMessage `json:"id"`
+}
+
+// JSON-RPC response.
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// JSON-RPC notification from the server.
+type jsonrpcNotification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// Registered Go function.
+type jsonrpcMethod struct {
+	fn reflect.Value
+
+	// Indexes of injected context and connection arguments ( -1 if absent )
+	ctxIndex  int
+	connIndex int
+
+	// Types of the arguments decoded from params
+	params []reflect.Type
+
+	// Whether the function returns result and error
+	hasResult bool
+	hasError  bool
+}
+
+// JSON-RPC 2.0 server on connections negotiated with "jsonrpc" subprotocol.
+//
+// Registered functions are called by reflection.
+// context.Context and *Connection arguments are injected, and the others are decoded from
+// positional params, or named params when the function has a single struct or map argument:
+//
+//	j := aun.NewJSONRPC(srv)
+//	j.Register("add", func(a, b int) int { return a + b })
+//	j.Register("greet", func(ctx context.Context, conn *aun.Connection, p struct{ Name string }) (string, error) {
+//	    return "hello " + p.Name, nil
+//	})
+type JSONRPC struct {
+	server *Server
+
+	// Timeout of the function call ( no timeout if zero )
+	Timeout time.Duration
+
+	// Max running calls per connection, unlimited if zero ( default 64 )
+	// A batch takes a call per request, and is rejected as a whole when the calls don't fit.
+	MaxConcurrent int
+
+	// Max requests in a batch, unlimited if zero ( default 32 )
+	MaxBatch int
+
+	mutex   sync.RWMutex
+	methods map[string]*jsonrpcMethod
+
+	// Context per connection, cancelled on close
+	contexts map[*Connection]*connectionContext
+
+	// Running calls per connection
+	running map[*Connection]int
+}
+
+// Context cancelled on connection close.
+type connectionContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Enable JSON-RPC 2.0 subprotocol on the server.
+func NewJSONRPC(s *Server) *JSONRPC {
+	j := &JSONRPC{
+		server:        s,
+		MaxConcurrent: 64,
+		MaxBatch:      32,
+		methods:       make(map[string]*jsonrpcMethod),
+		contexts:      make(map[*Connection]*connectionContext),
+		running:       make(map[*Connection]int),
+	}
+	s.addSubprotocol(JSONRPCSubprotocol)
+	s.addMessageHook(j.handle)
+	s.addLeaveHook(j.leave)
+	return j
+}
+
+// Register Go function as the method.
+// The function may return (result, error), (result), (error) or nothing.
+func (j *JSONRPC) Register(name string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return errors.New("Method must be a function")
+	}
+
+	m := &jsonrpcMethod{fn: v, ctxIndex: -1, connIndex: -1}
+	for i := 0; i < t.NumIn(); i++ {
+		switch in := t.In(i); {
+		case in == contextType && m.ctxIndex < 0:
+			m.ctxIndex = i
+		case in == connectionType && m.connIndex < 0:
+			m.connIndex = i
+		default:
+			m.params = append(m.params, in)
+		}
+	}
+	if t.IsVariadic() {
+		return errors.New("Variadic function is not supported")
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		if t.Out(0) == errorType {
+			m.hasError = true
+		} else {
+			m.hasResult = true
+		}
+	case 2:
+		if t.Out(1) != errorType {
+			return errors.New("Second return value must be error")
+		}
+		m.hasResult = true
+		m.hasError = true
+	default:
+		return errors.New("Function must return at most result and error")
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.methods[name] = m
+	return nil
+}
+
+// Send notification to the connection.
+func (j *JSONRPC) Notify(conn *Connection, method string, params interface{}) error {
+	data, err := json.Marshal(jsonrpcNotification{
+		Version: jsonrpcVersion,
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.enqueueMessage(data, TextFrame)
+}
+
+// Message hook to handle messages on JSON-RPC connections.
+// Calls run on their own goroutines, so the connection worker is not blocked.
+func (j *JSONRPC) handle(c *Connection, frame *Frame) bool {
+	if c.Subprotocol != JSONRPCSubprotocol || frame.Opcode != TextFrame {
+		return false
+	}
+
+	payload := bytes.TrimSpace(frame.PayloadData)
+	isBatch := len(payload) > 0 && payload[0] == '['
+	var batch []json.RawMessage
+	if isBatch {
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			j.reply(c, j.errorResponse(nil, RPCParseError, "Parse error"))
+			return true
+		}
+		if len(batch) == 0 || (j.MaxBatch > 0 && len(batch) > j.MaxBatch) {
+			j.reply(c, j.errorResponse(nil, RPCInvalidRequest, "Invalid Request"))
+			return true
+		}
+	} else {
+		if !json.Valid(payload) {
+			j.reply(c, j.errorResponse(nil, RPCParseError, "Parse error"))
+			return true
+		}
+		batch = []json.RawMessage{payload}
+	}
+
+	if !j.acquire(c, len(batch)) {
+		var id json.RawMessage
+		if !isBatch {
+			req := &jsonrpcRequest{}
+			// notification is not responded even on error
+			if json.Unmarshal(payload, req) != nil || req.Id == nil {
+				return true
+			}
+			id = req.Id
+		}
+		j.reply(c, j.errorResponse(id, RPCServerError, "Too many concurrent calls"))
+		return true
+	}
+
+	ctx := j.context(c)
+	go func() {
+		defer j.release(c, len(batch))
+		if isBatch {
+			j.reply(c, j.process(ctx, c, batch))
+		} else if response := j.call(ctx, c, payload); response != nil {
+			j.reply(c, response)
+		}
+	}()
+	return true
+}
+
+// Call the requests of the batch concurrently, and return the responses ( nil if nothing to respond ).
+func (j *JSONRPC) process(ctx context.Context, c *Connection, batch []json.RawMessage) []*jsonrpcResponse {
+	responses := make([]*jsonrpcResponse, len(batch))
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		wg.Add(1)
+		go func(i int, raw json.RawMessage) {
+			defer wg.Done()
+			responses[i] = j.call(ctx, c, raw)
+		}(i, raw)
+	}
+	wg.Wait()
+
+	var results []*jsonrpcResponse
+	for _, response := range responses {
+		if response != nil {
+			results = append(results, response)
+		}
+	}
+	return results
+}
+
+// Send the response or batch of responses, nothing is sent for empty batch.
+func (j *JSONRPC) reply(c *Connection, response interface{}) {
+	if results, ok := response.([]*jsonrpcResponse); ok && len(results) == 0 {
+		return
+	}
+	if data := j.encode(response); data != nil {
+		c.enqueueMessage(data, TextFrame)
+	}
+}
+
+// Reserve n calls of the connection, false if they exceed MaxConcurrent.
+func (j *JSONRPC) acquire(c *Connection, n int) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.MaxConcurrent > 0 && j.running[c]+n > j.MaxConcurrent {
+		return false
+	}
+	j.running[c] += n
+	return true
+}
+
+// Release n finished calls of the connection.
+func (j *JSONRPC) release(c *Connection, n int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.running[c] -= n; j.running[c] <= 0 {
+		delete(j.running, c)
+	}
+}
+
+// Call the method, and return response ( nil for notification ).
+func (j *JSONRPC) call(ctx context.Context, c *Connection, raw json.RawMessage) *jsonrpcResponse {
+	req := &jsonrpcRequest{}
+	if err := json.Unmarshal(raw, req); err != nil || req.Version != jsonrpcVersion || req.Method == nil || !validId(req.Id) {
+		return j.errorResponse(nil, RPCInvalidRequest, "Invalid Request")
+	}
+
+	j.mutex.RLock()
+	m, ok := j.methods[*req.Method]
+	j.mutex.RUnlock()
+
+	var response *jsonrpcResponse
+	if !ok {
+		response = j.errorResponse(req.Id, RPCMethodNotFound, "Method not found")
+	} else {
+		response = j.invoke(ctx, c, m, req)
+	}
+
+	// notification is not responded even on error
+	if req.Id == nil {
+		return nil
+	}
+	return response
+}
+
+// Decode params and call the function.
+func (j *JSONRPC) invoke(ctx context.Context, c *Connection, m *jsonrpcMethod, req *jsonrpcRequest) (response *jsonrpcResponse) {
+	params, err := m.decode(req.Params)
+	if err != nil {
+		return j.errorResponse(req.Id, RPCInvalidParams, err.Error())
+	}
+
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+
+	args := make([]reflect.Value, 0, m.fn.Type().NumIn())
+	for i := 0; i < m.fn.Type().NumIn(); i++ {
+		switch i {
+		case m.ctxIndex:
+			args = append(args, reflect.ValueOf(ctx))
+		case m.connIndex:
+			args = append(args, reflect.ValueOf(c))
+		default:
+			args = append(args, params[0])
+			params = params[1:]
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			j.server.handleError(c, fmt.Errorf("JSON-RPC handler panic: %v", r))
+			response = j.errorResponse(req.Id, RPCInternalError, "Internal error")
+		}
+	}()
+	out := m.fn.Call(args)
+
+	if m.hasError {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			rpcErr, ok := err.(*RPCError)
+			if !ok {
+				rpcErr = &RPCError{Code: RPCServerError, Message: err.Error()}
+			}
+			return &jsonrpcResponse{Version: jsonrpcVersion, Error: rpcErr, Id: req.Id}
+		}
+	}
+	// result member is required on success
+	var result interface{} = json.RawMessage("null")
+	if m.hasResult {
+		if data, err := json.Marshal(out[0].Interface()); err == nil {
+			result = json.RawMessage(data)
+		} else {
+			return j.errorResponse(req.Id, RPCInternalError, err.Error())
+		}
+	}
+	return &jsonrpcResponse{Version: jsonrpcVersion, Result: result, Id: req.Id}
+}
+
+// Decode params to the function argument values.
+// Positional params are decoded in order, named params are decoded to the single argument.
+func (m *jsonrpcMethod) decode(raw json.RawMessage) ([]reflect.Value, error) {
+	values := make([]reflect.Value, len(m.params))
+	for i, t := range m.params {
+		values[i] = reflect.New(t)
+	}
+
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+	case raw[0] == '[':
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		if len(list) > len(m.params) {
+			return nil, fmt.Errorf("Too many params, expected %d", len(m.params))
+		}
+		for i, item := range list {
+			if err := json.Unmarshal(item, values[i].Interface()); err != nil {
+				return nil, err
+			}
+		}
+	case raw[0] == '{':
+		if len(m.params) != 1 {
+			return nil, errors.New("Named params need single argument")
+		}
+		if err := json.Unmarshal(raw, values[0].Interface()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Params must be array or object")
+	}
+
+	for i := range values {
+		values[i] = values[i].Elem()
+	}
+	return values, nil
+}
+
+// Create error response.
+func (j *JSONRPC) errorResponse(id json.RawMessage, code int, message string) *jsonrpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{
+		Version: jsonrpcVersion,
+		Error:   &RPCError{Code: code, Message: message},
+		Id:      id,
+	}
+}
+
+// Encode response.
+func (j *JSONRPC) encode(response interface{}) []byte {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Get context of the connection.
+func (j *JSONRPC) context(c *Connection) context.Context {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if cc, ok := j.contexts[c]; ok {
+		return cc.ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.State() == CLOSED {
+		cancel()
+		return ctx
+	}
+	j.contexts[c] = &connectionContext{ctx: ctx, cancel: cancel}
+	return ctx
+}
+
+// Server leave hook, cancel running calls of the closed connection.
+func (j *JSONRPC) leave(c *Connection) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if cc, ok := j.contexts[c]; ok {
+		cc.cancel()
+		delete(j.contexts, c)
+	}
+}
+
+// Check request ID is string, number or null ( or absent ).
+func validId(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package aun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// JSON-RPC with test methods, and a connection negotiated with the subprotocol.
+func newTestJSONRPC(t *testing.T) (*JSONRPC, *Connection) {
+	t.Helper()
+	j := NewJSONRPC(&Server{})
+	j.Register("add", func(a, b int) int { return a + b })
+	j.Register("greet", func(p struct{ Name string }) (string, error) {
+		return "hello " + p.Name, nil
+	})
+	c := NewConnection(discardConn{}, 1024)
+	c.Subprotocol = JSONRPCSubprotocol
+	c.setState(CONNECTED)
+	return j, c
+}
+
+// Handle the message on the connection.
+func sendJSONRPC(t *testing.T, j *JSONRPC, c *Connection, message string) {
+	t.Helper()
+	frame, _ := BuildSingleFrame([]byte(message), 1, TextFrame)
+	if !j.handle(c, frame) {
+		t.Fatalf("message %s is not consumed", message)
+	}
+}
+
+// Read the next queued response of the connection.
+func readJSONRPC(t *testing.T, c *Connection) string {
+	t.Helper()
+	select {
+	case m := <-c.Write:
+		return string(m.(*Frame).PayloadData)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+	}
+	return ""
+}
+
+func TestJSONRPCResponses(t *testing.T) {
+	for _, test := range []struct {
+		name, request, response string
+	}{
+		{"request", `{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1}`,
+			`{"jsonrpc":"2.0","result":3,"id":1}`},
+		{"named params", `{"jsonrpc":"2.0","method":"greet","params":{"Name":"bob"},"id":"g"}`,
+			`{"jsonrpc":"2.0","result":"hello bob","id":"g"}`},
+		{"parse error", `{"jsonrpc":"2.0","method"`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+		{"batch parse error", `[{"jsonrpc":"2.0"`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+		{"invalid request", `{"jsonrpc":"1.0","method":"add","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"empty batch", `[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"method not found", `{"jsonrpc":"2.0","method":"sub","id":2}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":2}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, c := newTestJSONRPC(t)
+			sendJSONRPC(t, j, c, test.request)
+			if response := readJSONRPC(t, c); response != test.response {
+				t.Fatalf("response = %s, want %s", response, test.response)
+			}
+		})
+	}
+}
+
+func TestJSONRPCInvalidParams(t *testing.T) {
+	j, c := newTestJSONRPC(t)
+	for _, params := range []string{`["x","y"]`, `[1,2,3]`, `{"a":1}`, `1`} {
+		sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"add","params":`+params+`,"id":1}`)
+		var response jsonrpcResponse
+		if err := json.Unmarshal([]byte(readJSONRPC(t, c)), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Error == nil || response.Error.Code != RPCInvalidParams || string(response.Id) != "1" {
+			t.Fatalf("params %s: response = %+v", params, response)
+		}
+	}
+}
+
+func TestJSONRPCNotification(t *testing.T) {
+	j, c := newTestJSONRPC(t)
+	notified := make(chan string, 2)
+	j.Register("log", func(line string) { notified <- line })
+
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"log","params":["hi"]}`)
+	// errors of notifications are not responded either
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"missing"}`)
+	if line := <-notified; line != "hi" {
+		t.Fatalf("notified %q", line)
+	}
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"add","params":[1,1],"id":1}`)
+	if response := readJSONRPC(t, c); response != `{"jsonrpc":"2.0","result":2,"id":1}` {
+		t.Fatalf("response = %s", response)
+	}
+	select {
+	case m := <-c.Write:
+		t.Fatalf("notification is responded: %s", m.(*Frame).PayloadData)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	j, c := newTestJSONRPC(t)
+	j.Register("log", func(line string) {})
+
+	sendJSONRPC(t, j, c, `[
+		{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1},
+		{"jsonrpc":"2.0","method":"log","params":["hi"]},
+		{"jsonrpc":"2.0","method":"sub","id":2},
+		1
+	]`)
+	want := `[{"jsonrpc":"2.0","result":3,"id":1},` +
+		`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":2},` +
+		`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`
+	if response := readJSONRPC(t, c); response != want {
+		t.Fatalf("response = %s, want %s", response, want)
+	}
+
+	// batch of notifications is not responded
+	sendJSONRPC(t, j, c, `[{"jsonrpc":"2.0","method":"log","params":["a"]},{"jsonrpc":"2.0","method":"log","params":["b"]}]`)
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"add","params":[2,2],"id":3}`)
+	if response := readJSONRPC(t, c); response != `{"jsonrpc":"2.0","result":4,"id":3}` {
+		t.Fatalf("response = %s", response)
+	}
+}
+
+func TestJSONRPCRejectsLargeBatch(t *testing.T) {
+	j, c := newTestJSONRPC(t)
+	j.MaxBatch = 2
+
+	batch := `[`
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			batch += ","
+		}
+		batch += fmt.Sprintf(`{"jsonrpc":"2.0","method":"add","params":[1,2],"id":%d}`, i)
+	}
+	sendJSONRPC(t, j, c, batch+`]`)
+	if response := readJSONRPC(t, c); response != `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}` {
+		t.Fatalf("response = %s", response)
+	}
+}
+
+func TestJSONRPCRejectsExcessCalls(t *testing.T) {
+	j, c := newTestJSONRPC(t)
+	j.MaxConcurrent = 2
+	release := make(chan struct{})
+	j.Register("wait", func(ctx context.Context) string {
+		<-release
+		return "done"
+	})
+
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"wait","id":1}`)
+	sendJSONRPC(t, j, c, `[{"jsonrpc":"2.0","method":"wait","id":2},{"jsonrpc":"2.0","method":"wait","id":3}]`)
+	if response := readJSONRPC(t, c); response != `{"jsonrpc":"2.0","error":{"code":-32000,"message":"Too many concurrent calls"},"id":null}` {
+		t.Fatalf("batch over the limit: %s", response)
+	}
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"wait","id":2}`)
+	sendJSONRPC(t, j, c, `{"jsonrpc":"2.0","method":"wait","id":3}`)
+	if response := readJSONRPC(t, c); response != `{"jsonrpc":"2.0","error":{"code":-32000,"message":"Too many concurrent calls"},"id":3}` {
+		t.Fatalf("call over the limit: %s", response)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		var response jsonrpcResponse
+		json.Unmarshal([]byte(readJSONRPC(t, c)), &response)
+		if response.Error != nil {
+			t.Fatalf("running call failed: %+v", response.Error)
+		}
+	}
+	eventually(t, "finished calls are still counted", func() bool {
+		j.mutex.RLock()
+		defer j.mutex.RUnlock()
+		return len(j.running) == 0
+	})
+}
@@ -0,0 +1,44 @@
+package aun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// Mask ( or unmask ) the payload in place.
+// pos is the masking key position of the first byte,
+// and returns the key position for the following byte.
+//
+// Processes 8 bytes at a time:
+// payload-i ^ masking-key-j mod 4
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	if len(b) >= 8 {
+		// rotate key to start from pos, and repeat twice for 64 bits word
+		var rotated [4]byte
+		for i := range rotated {
+			rotated[i] = key[(pos+i)&3]
+		}
+		k := uint64(binary.LittleEndian.Uint32(rotated[:]))
+		k |= k << 32
+
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^k)
+			b = b[8:]
+		}
+	}
+
+	// remaining bytes
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+// Generate random masking key for C->S frame.
+func newMaskingKey() []byte {
+	key := make([]byte, 4)
+	io.ReadFull(rand.Reader, key)
+	return key
+}
@@ -0,0 +1,95 @@
+package aun
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Byte-by-byte masking ( before word-at-a-time ).
+func maskBytesSimple(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + 3)
+	}
+	return b
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for _, n := range []int{0, 1, 3, 4, 7, 8, 9, 15, 16, 17, 31, 64, 1000} {
+		for pos := 0; pos < 4; pos++ {
+			got := testPayload(n)
+			want := testPayload(n)
+			gotPos := maskBytes(key, pos, got)
+			wantPos := maskBytesSimple(key, pos, want)
+			if !bytes.Equal(got, want) {
+				t.Fatalf("len %d pos %d: masked bytes differ", n, pos)
+			}
+			if gotPos != wantPos {
+				t.Fatalf("len %d pos %d: next position = %d, want %d", n, pos, gotPos, wantPos)
+			}
+		}
+	}
+}
+
+func TestMaskBytesUnaligned(t *testing.T) {
+	key := [4]byte{0xde, 0xad, 0xbe, 0xef}
+	want := testPayload(100)
+	maskBytesSimple(key, 0, want)
+
+	// mask in chunks of odd sizes, so the following chunk starts at unaligned key position and offset
+	got := testPayload(100)
+	pos := 0
+	rest := got
+	for _, n := range []int{1, 2, 5, 9, 3, 13, 7, 60} {
+		pos = maskBytes(key, pos, rest[:n])
+		rest = rest[n:]
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("chunked masking differs from single pass")
+	}
+}
+
+func TestMaskBytesRoundTrip(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	for _, n := range []int{1, 5, 8, 33, 4096} {
+		original := testPayload(n)
+		b := testPayload(n)
+		maskBytes(key, 2, b)
+		if n >= 4 && bytes.Equal(b, original) {
+			t.Fatalf("len %d: payload is not masked", n)
+		}
+		maskBytes(key, 2, b)
+		if !bytes.Equal(b, original) {
+			t.Fatalf("len %d: unmasked payload differs", n)
+		}
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for _, n := range []int{16, 1024, 65536} {
+		payload := testPayload(n)
+		b.Run(fmt.Sprintf("word/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				maskBytes(key, 1, payload)
+			}
+		})
+		b.Run(fmt.Sprintf("byte/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				maskBytesSimple(key, 1, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package aun
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queued messages per peer, dropped when full
+const meshQueueSize = 1024
+
+// Max size of a mesh message
+const meshMaxMessageSize = 16 << 20
+
+// Timeout of connecting and authenticating peers
+const meshHandshakeTimeout = 5 * time.Second
+
+// Random challenge size of the peer authentication
+const meshNonceSize = 32
+
+var ErrMeshUnauthenticated = errors.New("Mesh peer authentication failed")
+
+// Mesh broker settings.
+// Peers must be authenticated by Secret, or by client certificates of TLSConfig.
+type MeshConfig struct {
+	// Listen address of this node
+	Addr string
+
+	// Peer node addresses, the own address is ignored
+	Peers []string
+
+	// Shared secret of the nodes.
+	// Peers prove the secret by HMAC challenge on connecting, the secret is never sent.
+	Secret []byte
+
+	// TLS for the peer connections, used for both listening and dialing.
+	// Set ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS.
+	TLSConfig *tls.Config
+
+	// Report rejected peers and dropped messages, must not block
+	OnError func(err error)
+}
+
+// Broker connecting aun nodes over TCP.
+//
+// Every node listens on its own address and dials all peers,
+// so the published message is sent directly to each node:
+//
+//	broker, _ := aun.NewMeshBroker(aun.MeshConfig{
+//		Addr:   "10.0.0.1:7000",
+//		Peers:  []string{"10.0.0.1:7000", "10.0.0.2:7000", "10.0.0.3:7000"},
+//		Secret: secret,
+//	})
+//	srv.UseBroker(broker)
+//
+// Peers are reconnected automatically. Messages are queued while a peer is down,
+// and dropped when the queue is full.
+type MeshBroker struct {
+	local    *MemoryBroker
+	listener net.Listener
+	config   MeshConfig
+
+	// Messages dropped by full peer queues
+	dropped atomic.Int64
+
+	mutex sync.Mutex
+	peers map[string]*meshPeer
+
+	// Accepted connections from peers
+	inbound map[net.Conn]struct{}
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Outbound connection to a peer.
+type meshPeer struct {
+	broker *MeshBroker
+	addr   string
+	queue  chan []byte
+
+	// Closed when the peer is removed or the broker is closed
+	removed chan struct{}
+	closed  chan struct{}
+}
+
+// Create mesh broker listening on the address, and connect to the peers.
+func NewMeshBroker(config MeshConfig) (*MeshBroker, error) {
+	mutualTLS := config.TLSConfig != nil && config.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert
+	if len(config.Secret) == 0 && !mutualTLS {
+		return nil, errors.New("Mesh broker requires Secret or mutual TLS")
+	}
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.TLSConfig != nil {
+		listener = tls.NewListener(listener, config.TLSConfig)
+	}
+	b := &MeshBroker{
+		local:    NewMemoryBroker(),
+		listener: listener,
+		config:   config,
+		peers:    make(map[string]*meshPeer),
+		inbound:  make(map[net.Conn]struct{}),
+		closed:   make(chan struct{}),
+	}
+	go b.accept()
+	for _, peer := range config.Peers {
+		b.AddPeer(peer)
+	}
+	return b, nil
+}
+
+// Get the number of messages dropped by full peer queues.
+func (b *MeshBroker) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Report error to OnError.
+func (b *MeshBroker) report(err error) {
+	if b.config.OnError != nil {
+		b.config.OnError(err)
+	}
+}
+
+// Get the listening address.
+func (b *MeshBroker) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Connect to the peer node.
+// The own address is ignored, so all nodes can share the same peer list.
+func (b *MeshBroker) AddPeer(addr string) {
+	if addr == b.listener.Addr().String() {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	select {
+	case <-b.closed:
+		return
+	default:
+	}
+	if _, ok := b.peers[addr]; ok {
+		return
+	}
+	p := &meshPeer{
+		broker:  b,
+		addr:    addr,
+		queue:   make(chan []byte, meshQueueSize),
+		removed: make(chan struct{}),
+		closed:  b.closed,
+	}
+	b.peers[addr] = p
+	go p.run()
+}
+
+// Remove the peer node.
+func (b *MeshBroker) RemovePeer(addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if p, ok := b.peers[addr]; ok {
+		close(p.removed)
+		delete(b.peers, addr)
+	}
+}
+
+// Send message to local subscribers and all peers.
+func (b *MeshBroker) Publish(channel string, message []byte) error {
+	if len(channel) > 0xFFFF {
+		return errors.New("Channel name is too long")
+	}
+	if 2+len(channel)+len(message) > meshMaxMessageSize {
+		return errors.New("Message is too large")
+	}
+	data := make([]byte, 0, 6+len(channel)+len(message))
+	data = binary.BigEndian.AppendUint32(data, uint32(2+len(channel)+len(message)))
+	data = binary.BigEndian.AppendUint16(data, uint16(len(channel)))
+	data = append(data, channel...)
+	data = append(data, message...)
+
+	var dropped []string
+	b.mutex.Lock()
+	for _, p := range b.peers {
+		select {
+		case p.queue <- data:
+		default:
+			// peer is down or too slow
+			dropped = append(dropped, p.addr)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, addr := range dropped {
+		b.dropped.Add(1)
+		b.report(fmt.Errorf("Mesh peer %s queue is full, message dropped", addr))
+	}
+
+	return b.local.Publish(channel, message)
+}
+
+// Add handler of the channel on this node.
+func (b *MeshBroker) Subscribe(channel string, handler func([]byte)) (func(), error) {
+	return b.local.Subscribe(channel, handler)
+}
+
+// Stop listening and disconnect all peers.
+func (b *MeshBroker) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.closed)
+		err = b.listener.Close()
+
+		b.mutex.Lock()
+		for conn := range b.inbound {
+			conn.Close()
+		}
+		b.peers = make(map[string]*meshPeer)
+		b.mutex.Unlock()
+
+		b.local.Close()
+	})
+	return err
+}
+
+// Accept connections from peers.
+func (b *MeshBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			fmt.Println(err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		b.mutex.Lock()
+		b.inbound[conn] = struct{}{}
+		b.mutex.Unlock()
+
+		go b.receive(conn)
+	}
+}
+
+// Read messages from the peer, and dispatch to local subscribers.
+// Received messages are not forwarded, since every node connects to all peers.
+func (b *MeshBroker) receive(conn net.Conn) {
+	defer func() {
+		b.mutex.Lock()
+		delete(b.inbound, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+
+	if err := b.authenticate(conn); err != nil {
+		b.report(fmt.Errorf("Mesh peer %s rejected: %w", conn.RemoteAddr(), err))
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size < 2 || size > meshMaxMessageSize {
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return
+		}
+		channelSize := int(binary.BigEndian.Uint16(data))
+		if 2+channelSize > len(data) {
+			return
+		}
+		b.local.Publish(string(data[2:2+channelSize]), data[2+channelSize:])
+	}
+}
+
+// Authenticate the connecting peer:
+// send the challenge, verify the peer proof, and prove the secret to the peer.
+func (b *MeshBroker) authenticate(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+	}
+	secret := b.config.Secret
+	if len(secret) == 0 {
+		return nil
+	}
+
+	challenge := make([]byte, meshNonceSize)
+	if _, err := io.ReadFull(rand.Reader, challenge); err != nil {
+		return err
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return err
+	}
+	// peer nonce + proof
+	reply := make([]byte, meshNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	nonce, proof := reply[:meshNonceSize], reply[meshNonceSize:]
+	if !hmac.Equal(proof, meshProof(secret, "client", challenge, nonce)) {
+		return ErrMeshUnauthenticated
+	}
+	_, err := conn.Write(meshProof(secret, "server", challenge, nonce))
+	return err
+}
+
+// Prove the secret to the listening peer, and verify the listening peer knows it too.
+func (p *meshPeer) authenticate(conn net.Conn) error {
+	secret := p.broker.config.Secret
+	if len(secret) == 0 {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, meshNonceSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return err
+	}
+	nonce := make([]byte, meshNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(nonce, meshProof(secret, "client", challenge, nonce)...)); err != nil {
+		return err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, meshProof(secret, "server", challenge, nonce)) {
+		return ErrMeshUnauthenticated
+	}
+	return nil
+}
+
+// HMAC of the role and both nonces.
+func meshProof(secret []byte, role string, challenge, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("aun-mesh-" + role))
+	mac.Write(challenge)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// Connect to the peer with TLS if configured.
+func (p *meshPeer) dial() (net.Conn, error) {
+	config := p.broker.config.TLSConfig
+	if config == nil {
+		return net.DialTimeout("tcp", p.addr, meshHandshakeTimeout)
+	}
+	dialer := &net.Dialer{Timeout: meshHandshakeTimeout}
+	return tls.DialWithDialer(dialer, "tcp", p.addr, config)
+}
+
+// Write queued messages to the peer, reconnect on error.
+func (p *meshPeer) run() {
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := p.dial()
+		if err == nil {
+			if err = p.authenticate(conn); err != nil {
+				conn.Close()
+				p.broker.report(fmt.Errorf("Mesh peer %s: %w", p.addr, err))
+			}
+		}
+		if err != nil {
+			select {
+			case <-p.removed:
+				return
+			case <-p.closed:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 5*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = 100 * time.Millisecond
+		if !p.write(conn) {
+			return
+		}
+	}
+}
+
+// Write queued messages until error.
+// Returns false when the peer is removed or broker is closed.
+func (p *meshPeer) write(conn net.Conn) bool {
+	defer conn.Close()
+
+	for {
+		select {
+		case <-p.removed:
+			return false
+		case <-p.closed:
+			return false
+		case data := <-p.queue:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(data); err != nil {
+				return true
+			}
+		}
+	}
+}
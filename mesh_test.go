@@ -0,0 +1,139 @@
+package aun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testMeshSecret = []byte("mesh-secret")
+
+func newTestMesh(t *testing.T, secret []byte, onError func(error)) *MeshBroker {
+	t.Helper()
+	b, err := NewMeshBroker(MeshConfig{Addr: "127.0.0.1:0", Secret: secret, OnError: onError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// Publish until the peer receives, messages are dropped silently while the peer is connecting.
+// Messages of the own node are delivered locally too, so others are skipped.
+func publishUntilReceived(t *testing.T, b *MeshBroker, received chan []byte, message string) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := b.Publish("room", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-received:
+			if string(m) == message {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("message is not delivered to the peer")
+		}
+	}
+}
+
+func TestMeshBrokerExchange(t *testing.T) {
+	a := newTestMesh(t, testMeshSecret, nil)
+	b := newTestMesh(t, testMeshSecret, nil)
+	a.AddPeer(b.Addr().String())
+	b.AddPeer(a.Addr().String())
+
+	receivedA := make(chan []byte, meshQueueSize)
+	receivedB := make(chan []byte, meshQueueSize)
+	a.Subscribe("room", func(m []byte) { receivedA <- m })
+	b.Subscribe("room", func(m []byte) { receivedB <- m })
+
+	publishUntilReceived(t, a, receivedB, "from a")
+	publishUntilReceived(t, b, receivedA, "from b")
+}
+
+func TestMeshBrokerRejectsWrongSecret(t *testing.T) {
+	var mutex sync.Mutex
+	var errs []error
+	a := newTestMesh(t, testMeshSecret, func(err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	})
+	received := make(chan []byte, 1)
+	a.Subscribe("room", func(m []byte) { received <- m })
+
+	b := newTestMesh(t, []byte("wrong"), nil)
+	b.AddPeer(a.Addr().String())
+	b.Publish("room", []byte("forged"))
+
+	// raw TCP peer without handshake
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := binary.BigEndian.AppendUint32(nil, uint32(2+4+6))
+	data = binary.BigEndian.AppendUint16(data, 4)
+	data = append(data, "roomforged"...)
+	for i := 0; i < 10; i++ {
+		conn.Write(data)
+	}
+
+	select {
+	case m := <-received:
+		t.Fatalf("unauthenticated peer delivered %q", m)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, err := range errs {
+		if errors.Is(err, ErrMeshUnauthenticated) {
+			return
+		}
+	}
+	t.Fatalf("rejected peer is not reported, errors: %v", errs)
+}
+
+func TestMeshBrokerRequiresAuthentication(t *testing.T) {
+	if _, err := NewMeshBroker(MeshConfig{Addr: "127.0.0.1:0"}); err == nil {
+		t.Fatal("mesh broker is created without Secret or mutual TLS")
+	}
+}
+
+func TestMeshBrokerReportsDrops(t *testing.T) {
+	// reserve the address and close, so the peer is down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	var reported int
+	var mutex sync.Mutex
+	b := newTestMesh(t, testMeshSecret, func(err error) {
+		mutex.Lock()
+		reported++
+		mutex.Unlock()
+	})
+	b.AddPeer(down)
+
+	for i := 0; i < meshQueueSize+3; i++ {
+		b.Publish("room", []byte("message"))
+	}
+	if dropped := b.Dropped(); dropped != 3 {
+		t.Fatalf("dropped = %d, want 3", dropped)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if reported < 3 {
+		t.Fatalf("reported %d errors, want at least 3", reported)
+	}
+}
@@ -0,0 +1,279 @@
+package aun
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+)
+
+// MessagePack codec, encoded as binary frame.
+// Struct fields are named by json tag. Extension types are not supported.
+type MessagePackCodec struct{}
+
+// Codec interface implement.
+func (MessagePackCodec) Name() string {
+	return "msgpack"
+}
+
+// Codec interface implement.
+func (MessagePackCodec) Opcode() int {
+	return BinaryFrame
+}
+
+// Codec interface implement.
+func (MessagePackCodec) Marshal(v interface{}) ([]byte, error) {
+	w := &msgpackWriter{}
+	if err := encodeValue(w, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+// Codec interface implement.
+func (MessagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	return decodeAll(&msgpackReader{data: data}, v)
+}
+
+// MessagePack encoder.
+type msgpackWriter struct {
+	buf []byte
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeNil() {
+	w.buf = append(w.buf, 0xc0)
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		w.writeUint(uint64(i))
+	case i >= -32:
+		w.buf = append(w.buf, byte(i))
+	case i >= math.MinInt8:
+		w.buf = append(w.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xd2), uint32(i))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xd3), uint64(i))
+	}
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		w.buf = append(w.buf, byte(u))
+	case u <= math.MaxUint8:
+		w.buf = append(w.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xce), uint32(u))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcf), u)
+	}
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeFloat(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcb), math.Float64bits(f))
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		w.buf = append(w.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xda), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xdb), uint32(n))
+	}
+	w.buf = append(w.buf, s...)
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeBytes(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xc5), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xc6), uint32(n))
+	}
+	w.buf = append(w.buf, b...)
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeArray(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xdc), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xdd), uint32(n))
+	}
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeMap(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xde), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xdf), uint32(n))
+	}
+}
+
+// valueWriter interface implement.
+func (w *msgpackWriter) writeRaw(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// MessagePack decoder.
+type msgpackReader struct {
+	depthLimit
+	data []byte
+	pos  int
+}
+
+// valueReader interface implement.
+func (r *msgpackReader) position() int {
+	return r.pos
+}
+
+// valueReader interface implement.
+func (r *msgpackReader) input() []byte {
+	return r.data
+}
+
+// valueReader interface implement.
+// MessagePack has no indefinite length container.
+func (r *msgpackReader) readEnd() (bool, error) {
+	return false, nil
+}
+
+// Read n bytes.
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, errShortData
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// Read n bytes big endian unsigned integer.
+func (r *msgpackReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// valueReader interface implement.
+func (r *msgpackReader) readItem() (codecItem, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return codecItem{}, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return codecItem{kind: itemInt, i: int64(c)}, nil
+	case c >= 0xe0:
+		return codecItem{kind: itemInt, i: int64(int8(c))}, nil
+	case c&0xe0 == 0xa0:
+		return r.str(itemString, int(c&0x1f))
+	case c&0xf0 == 0x90:
+		return codecItem{kind: itemArray, n: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x80:
+		return codecItem{kind: itemMap, n: int(c & 0x0f)}, nil
+	}
+
+	switch c {
+	case 0xc0:
+		return codecItem{kind: itemNil}, nil
+	case 0xc2, 0xc3:
+		return codecItem{kind: itemBool, b: c == 0xc3}, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.uint(1 << (c - 0xcc))
+		return codecItem{kind: itemUint, u: u}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := r.uint(size)
+		// sign extension
+		shift := 64 - size*8
+		return codecItem{kind: itemInt, i: int64(u<<shift) >> shift}, err
+	case 0xca:
+		u, err := r.uint(4)
+		return codecItem{kind: itemFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := r.uint(8)
+		return codecItem{kind: itemFloat, f: math.Float64frombits(u)}, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (c - 0xd9))
+		if err != nil {
+			return codecItem{}, err
+		}
+		return r.str(itemString, int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (c - 0xc4))
+		if err != nil {
+			return codecItem{}, err
+		}
+		return r.str(itemBytes, int(n))
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		return codecItem{kind: itemArray, n: int(n)}, r.checkLength(n, err)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		return codecItem{kind: itemMap, n: int(n)}, r.checkLength(n, err)
+	}
+	return codecItem{}, errors.New("Unsupported MessagePack type")
+}
+
+// Read string or binary.
+func (r *msgpackReader) str(kind itemKind, n int) (codecItem, error) {
+	b, err := r.next(n)
+	return codecItem{kind: kind, s: b}, err
+}
+
+// Check the number of elements is possible in the remaining data.
+func (r *msgpackReader) checkLength(n uint64, err error) error {
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		return errShortData
+	}
+	return nil
+}
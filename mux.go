@@ -0,0 +1,575 @@
+package aun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Multiplexing subprotocol name
+const MuxSubprotocol = "mux"
+
+// Receive window per stream by default
+const DefaultMuxWindow = 256 * 1024
+
+// Open streams per connection by default
+const DefaultMuxMaxStreams = 256
+
+// Multiplexing message types
+const (
+	muxOpen   = 1
+	muxData   = 2
+	muxClose  = 3
+	muxWindow = 4
+)
+
+const (
+	// Message type(1) | stream ID(4)
+	muxHeaderSize = 5
+
+	// Max data size of single message
+	muxChunkSize = 32 * 1024
+
+	// Streams waiting for Accept() on the client
+	muxAcceptBacklog = 64
+)
+
+var (
+	ErrStreamClosed      = errors.New("Stream is closed")
+	ErrStreamReset       = errors.New("Stream is reset by flow control violation")
+	ErrNotMuxSubprotocol = errors.New("Connection is not negotiated with mux subprotocol")
+	ErrTooManyStreams    = errors.New("Too many open streams")
+	ErrMuxDroppingPolicy = errors.New("Mux is not available with slow consumer policy dropping messages")
+)
+
+// Logical stream multiplexing over the WebSocket connection.
+//
+// Streams are carried by binary messages of the "mux" subprotocol:
+//
+//	type(1) | stream ID(4) | payload
+//
+//	open   payload is receive window(4) | stream name
+//	data   payload is stream data up to the window granted by the peer
+//	close  no payload, the stream is closed in both directions
+//	window payload is bytes(4) granted to send more
+//
+// Streams opened by the client have odd ID, and by the server have even ID.
+// Opens over MaxStreams are refused by the close message.
+// Slow consumer policy must not drop messages ( SlowConsumerBlock or SlowConsumerDisconnect ),
+// connections with the dropping policy are closed on the first mux message.
+type Mux struct {
+	server *Server
+
+	// Handler of the stream opened by the client, runs on its own goroutine.
+	// The stream is rejected if nil.
+	OnStream func(stream *Stream)
+
+	// Receive window per stream ( DefaultMuxWindow if zero )
+	Window int
+
+	// Max open streams per connection, unlimited if zero ( default DefaultMuxMaxStreams )
+	MaxStreams int
+
+	mutex    sync.Mutex
+	sessions map[*Connection]*MuxSession
+}
+
+// Streams over single connection.
+type MuxSession struct {
+	// Send single mux message
+	send func(message []byte) error
+
+	// Receive window per stream
+	window int
+
+	// Max open streams, unlimited if zero
+	maxStreams int
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextId  uint32
+	err     error
+
+	// Server connection ( nil on the client )
+	conn *Connection
+
+	// Handler of the stream opened by the peer
+	onStream func(stream *Stream)
+
+	// Streams waiting for Accept() on the client
+	accept chan *Stream
+
+	// Client connection ( nil on the server )
+	client *ClientConn
+}
+
+// Logical stream, implements io.ReadWriteCloser.
+type Stream struct {
+	// Stream ID
+	Id uint32
+
+	// Stream name given by the opener
+	Name string
+
+	// Server connection of the stream ( nil on the client )
+	Conn *Connection
+
+	session *MuxSession
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// Received data not read yet
+	buffer bytes.Buffer
+
+	// Bytes allowed to send
+	credit int
+
+	// Bytes the peer can send, and read bytes not granted yet
+	window   int
+	consumed int
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+// Enable multiplexing subprotocol on the server.
+func NewMux(s *Server) *Mux {
+	m := &Mux{
+		server:     s,
+		MaxStreams: DefaultMuxMaxStreams,
+		sessions:   make(map[*Connection]*MuxSession),
+	}
+	s.addSubprotocol(MuxSubprotocol)
+	s.addMessageHook(m.handle)
+	s.addLeaveHook(m.leave)
+	return m
+}
+
+// Open new stream to the client.
+func (m *Mux) Open(conn *Connection, name string) (*Stream, error) {
+	if conn.Subprotocol != MuxSubprotocol {
+		return nil, ErrNotMuxSubprotocol
+	}
+	return m.session(conn).Open(name)
+}
+
+// Message hook to handle binary messages on mux connections.
+func (m *Mux) handle(c *Connection, frame *Frame) bool {
+	if c.Subprotocol != MuxSubprotocol || frame.Opcode != BinaryFrame {
+		return false
+	}
+	if dropsMessages(c) {
+		go c.CloseWith(CloseInternalError, "mux needs slow consumer policy not dropping messages")
+		return true
+	}
+	m.session(c).receive(frame.PayloadData)
+	return true
+}
+
+// Get or create session of the connection.
+func (m *Mux) session(c *Connection) *MuxSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if session, ok := m.sessions[c]; ok {
+		return session
+	}
+	if dropsMessages(c) {
+		session := newMuxSession(nil, 0, 2)
+		session.close(ErrMuxDroppingPolicy)
+		return session
+	}
+	// mux message is sent as single frame, so queued frames are bounded by the stream windows
+	send := func(message []byte) error {
+		frame, err := BuildSingleFrame(message, 1, BinaryFrame)
+		if err != nil {
+			return err
+		}
+		return c.enqueue(frame)
+	}
+	session := newMuxSession(send, m.Window, 2)
+	session.maxStreams = m.MaxStreams
+	session.conn = c
+	session.onStream = func(stream *Stream) {
+		if m.OnStream == nil {
+			stream.Close()
+			return
+		}
+		go m.OnStream(stream)
+	}
+	if c.State() == CLOSED {
+		session.close(ErrConnectionClosed)
+		return session
+	}
+	m.sessions[c] = session
+	return session
+}
+
+// Check the slow consumer policy of the connection drops messages.
+// Dropped mux message breaks the stream windows.
+func dropsMessages(c *Connection) bool {
+	return c.queuePolicy == SlowConsumerDropOldest || c.queuePolicy == SlowConsumerDropNewest
+}
+
+// Server leave hook, close streams of the connection.
+func (m *Mux) leave(c *Connection) {
+	m.mutex.Lock()
+	session, ok := m.sessions[c]
+	delete(m.sessions, c)
+	m.mutex.Unlock()
+
+	if ok {
+		session.close(ErrConnectionClosed)
+	}
+}
+
+// Start multiplexing on the client connection negotiated with "mux" subprotocol.
+// The connection is read by the session, so ReadMessage() must not be called.
+//
+//	dialer := &aun.Dialer{Subprotocols: []string{aun.MuxSubprotocol}}
+//	conn, _ := dialer.Dial("ws://localhost:12345/")
+//	session, _ := aun.NewMuxClient(conn)
+//	stream, _ := session.Open("chat")
+func NewMuxClient(c *ClientConn) (*MuxSession, error) {
+	if c.Subprotocol != MuxSubprotocol {
+		return nil, ErrNotMuxSubprotocol
+	}
+	session := newMuxSession(c.SendBinary, 0, 1)
+	session.client = c
+	session.accept = make(chan *Stream, muxAcceptBacklog)
+	session.onStream = func(stream *Stream) {
+		// accept channel is closed with the session error
+		session.mutex.Lock()
+		accepted := false
+		if session.err == nil {
+			select {
+			case session.accept <- stream:
+				accepted = true
+			default:
+			}
+		}
+		session.mutex.Unlock()
+		if !accepted {
+			stream.Close()
+		}
+	}
+
+	go func() {
+		for {
+			opcode, message, err := c.ReadMessage()
+			if err != nil {
+				session.close(err)
+				return
+			}
+			if opcode == BinaryFrame {
+				session.receive(message)
+			}
+		}
+	}()
+	return session, nil
+}
+
+// Create session, firstId is the first ID of the streams opened by this side.
+func newMuxSession(send func([]byte) error, window int, firstId uint32) *MuxSession {
+	if window <= 0 {
+		window = DefaultMuxWindow
+	}
+	return &MuxSession{
+		send:    send,
+		window:  window,
+		streams: make(map[uint32]*Stream),
+		nextId:  firstId,
+	}
+}
+
+// Open new stream to the peer.
+// The stream can be written after the peer grants the window.
+func (s *MuxSession) Open(name string) (*Stream, error) {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return nil, s.err
+	}
+	if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+		s.mutex.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	id := s.nextId
+	s.nextId += 2
+	stream := s.newStream(id, name, 0)
+	s.streams[id] = stream
+	s.mutex.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(s.window))
+	payload = append(payload, name...)
+	if err := s.sendMessage(muxOpen, id, payload); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Wait for the stream opened by the server ( client only ).
+func (s *MuxSession) Accept() (*Stream, error) {
+	if s.accept == nil {
+		return nil, errors.New("Accept is available on the client only")
+	}
+	stream, ok := <-s.accept
+	if !ok {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return nil, s.err
+	}
+	return stream, nil
+}
+
+// Close all streams and the client connection.
+func (s *MuxSession) Close() error {
+	s.close(ErrConnectionClosed)
+	if s.client != nil {
+		return s.client.Close()
+	}
+	return nil
+}
+
+// Create stream.
+func (s *MuxSession) newStream(id uint32, name string, credit int) *Stream {
+	stream := &Stream{
+		Id:      id,
+		Name:    name,
+		Conn:    s.conn,
+		session: s,
+		credit:  credit,
+		window:  s.window,
+	}
+	stream.cond = sync.NewCond(&stream.mutex)
+	return stream
+}
+
+// Handle received mux message.
+func (s *MuxSession) receive(message []byte) {
+	if len(message) < muxHeaderSize {
+		return
+	}
+	id := binary.BigEndian.Uint32(message[1:muxHeaderSize])
+	payload := message[muxHeaderSize:]
+
+	switch message[0] {
+	case muxOpen:
+		if len(payload) < 4 || id%2 == s.nextId%2 {
+			return
+		}
+		s.mutex.Lock()
+		if _, exists := s.streams[id]; exists || s.err != nil {
+			s.mutex.Unlock()
+			return
+		}
+		if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+			s.mutex.Unlock()
+			s.sendMessage(muxClose, id, nil)
+			return
+		}
+		stream := s.newStream(id, string(payload[4:]), int(binary.BigEndian.Uint32(payload)))
+		s.streams[id] = stream
+		s.mutex.Unlock()
+
+		// grant our window to the opener
+		if err := s.sendMessage(muxWindow, id, binary.BigEndian.AppendUint32(nil, uint32(s.window))); err != nil {
+			return
+		}
+		s.onStream(stream)
+
+	case muxData:
+		if stream := s.get(id); stream != nil {
+			stream.push(payload)
+		}
+
+	case muxClose:
+		if stream := s.get(id); stream != nil {
+			s.remove(id)
+			stream.closeRemote(nil)
+		}
+
+	case muxWindow:
+		if len(payload) < 4 {
+			return
+		}
+		if stream := s.get(id); stream != nil {
+			stream.grant(int(binary.BigEndian.Uint32(payload)))
+		}
+	}
+}
+
+// Find stream by ID.
+func (s *MuxSession) get(id uint32) *Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+// Forget the stream.
+func (s *MuxSession) remove(id uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.streams, id)
+}
+
+// Send mux message.
+func (s *MuxSession) sendMessage(kind byte, id uint32, payload []byte) error {
+	message := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	message[0] = kind
+	binary.BigEndian.PutUint32(message[1:], id)
+	return s.send(append(message, payload...))
+}
+
+// Close all streams with the error.
+func (s *MuxSession) close(err error) {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.closeRemote(err)
+	}
+	if s.accept != nil {
+		close(s.accept)
+	}
+}
+
+// Read stream data.
+// Returns io.EOF after the peer closed the stream and the received data is drained.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mutex.Lock()
+	for st.buffer.Len() == 0 && !st.localClosed && !st.remoteClosed {
+		st.cond.Wait()
+	}
+	switch {
+	case st.localClosed:
+		st.mutex.Unlock()
+		return 0, ErrStreamClosed
+	case st.buffer.Len() == 0:
+		err := st.err
+		st.mutex.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	n, _ := st.buffer.Read(p)
+	// grant the read bytes to the peer by half window
+	var grant int
+	st.consumed += n
+	if st.consumed >= st.session.window/2 && !st.remoteClosed {
+		grant = st.consumed
+		st.window += grant
+		st.consumed = 0
+	}
+	st.mutex.Unlock()
+
+	if grant > 0 {
+		st.session.sendMessage(muxWindow, st.Id, binary.BigEndian.AppendUint32(nil, uint32(grant)))
+	}
+	return n, nil
+}
+
+// Write stream data.
+// Blocks while the window granted by the peer is exhausted.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mutex.Lock()
+		for st.credit == 0 && !st.localClosed && !st.remoteClosed {
+			st.cond.Wait()
+		}
+		switch {
+		case st.localClosed, st.remoteClosed && st.err == nil:
+			st.mutex.Unlock()
+			return written, ErrStreamClosed
+		case st.remoteClosed:
+			err := st.err
+			st.mutex.Unlock()
+			return written, err
+		}
+		n := min(len(p), st.credit, muxChunkSize)
+		st.credit -= n
+		st.mutex.Unlock()
+
+		if err := st.session.sendMessage(muxData, st.Id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close the stream in both directions.
+func (st *Stream) Close() error {
+	st.mutex.Lock()
+	if st.localClosed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	notify := !st.remoteClosed
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+
+	st.session.remove(st.Id)
+	if notify {
+		return st.session.sendMessage(muxClose, st.Id, nil)
+	}
+	return nil
+}
+
+// Store received data.
+// Data over the window is a protocol violation, and the stream is reset.
+func (st *Stream) push(data []byte) {
+	st.mutex.Lock()
+	if st.localClosed || st.remoteClosed {
+		st.mutex.Unlock()
+		return
+	}
+	if len(data) > st.window {
+		st.mutex.Unlock()
+		st.session.remove(st.Id)
+		st.closeRemote(ErrStreamReset)
+		st.session.sendMessage(muxClose, st.Id, nil)
+		return
+	}
+	st.window -= len(data)
+	st.buffer.Write(data)
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+}
+
+// Add bytes allowed to send.
+func (st *Stream) grant(n int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.credit += n
+	st.cond.Broadcast()
+}
+
+// Mark closed by the peer, or by the session error.
+func (st *Stream) closeRemote(err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.remoteClosed {
+		return
+	}
+	st.remoteClosed = true
+	st.err = err
+	st.cond.Broadcast()
+}
@@ -0,0 +1,302 @@
+package aun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// Mux on the test server, and the client session over a dialed connection.
+func newTestMux(t *testing.T, setup func(s *Server, m *Mux)) (*Mux, *MuxSession, *Connection) {
+	t.Helper()
+	var mux *Mux
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		mux = NewMux(s)
+		if setup != nil {
+			setup(s, mux)
+		}
+	})
+	client, c := dialTestWith(t, &Dialer{Subprotocols: []string{MuxSubprotocol}}, url, connected)
+	// the session reads the connection until closed
+	client.SetReadDeadline(time.Time{})
+	session, err := NewMuxClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return mux, session, c
+}
+
+// Session sending mux messages to the channel, and passing opened streams to another.
+func newTestMuxSession(window int, firstId uint32) (*MuxSession, chan []byte, chan *Stream) {
+	sent := make(chan []byte, 16)
+	opened := make(chan *Stream, 16)
+	s := newMuxSession(func(message []byte) error {
+		sent <- message
+		return nil
+	}, window, firstId)
+	s.onStream = func(stream *Stream) { opened <- stream }
+	return s, sent, opened
+}
+
+// Encode mux message.
+func muxMessage(kind byte, id uint32, payload []byte) []byte {
+	message := []byte{kind}
+	message = binary.BigEndian.AppendUint32(message, id)
+	return append(message, payload...)
+}
+
+// Encode open message with the receive window.
+func muxOpenMessage(id uint32, window int, name string) []byte {
+	return muxMessage(muxOpen, id, append(binary.BigEndian.AppendUint32(nil, uint32(window)), name...))
+}
+
+// Wait for the next sent message of the kind.
+func expectMuxMessage(t *testing.T, sent chan []byte, kind byte, id uint32) []byte {
+	t.Helper()
+	select {
+	case message := <-sent:
+		if message[0] != kind || binary.BigEndian.Uint32(message[1:]) != id {
+			t.Fatalf("sent type %d of stream %d, want type %d of stream %d", message[0], binary.BigEndian.Uint32(message[1:]), kind, id)
+		}
+		return message[muxHeaderSize:]
+	case <-time.After(5 * time.Second):
+		t.Fatalf("type %d of stream %d is not sent", kind, id)
+	}
+	return nil
+}
+
+func TestMuxOpenAndRoundTrip(t *testing.T) {
+	mux, session, c := newTestMux(t, func(s *Server, m *Mux) {
+		// echo until the client closes
+		m.OnStream = func(stream *Stream) {
+			io.Copy(stream, stream)
+			stream.Close()
+		}
+	})
+
+	// opened by the client
+	stream, err := session.Open("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Id%2 != 1 {
+		t.Fatalf("client stream has ID %d, want odd", stream.Id)
+	}
+	message := bytes.Repeat([]byte("0123456789"), 10000)
+	go stream.Write(message)
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(stream, echo); err != nil || !bytes.Equal(echo, message) {
+		t.Fatalf("echo of %d bytes, %v", len(echo), err)
+	}
+
+	// opened by the server
+	pushed, err := mux.Open(c, "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Id%2 != 0 {
+		t.Fatalf("server stream has ID %d, want even", pushed.Id)
+	}
+	accepted, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.Id != pushed.Id || accepted.Name != "push" {
+		t.Fatalf("accepted stream %d %q", accepted.Id, accepted.Name)
+	}
+	if _, err := pushed.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pushed.Close()
+
+	// data is readable after the close, then EOF
+	data, err := io.ReadAll(accepted)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
+
+func TestMuxWindowExhaustion(t *testing.T) {
+	read := make(chan *Stream, 1)
+	_, session, _ := newTestMux(t, func(s *Server, m *Mux) {
+		m.Window = 1024
+		m.OnStream = func(stream *Stream) { read <- stream }
+	})
+
+	stream, err := session.Open("upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-read
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, 3000))
+		written <- err
+	}()
+
+	// window of the server is exhausted until it reads
+	select {
+	case err := <-written:
+		t.Fatalf("write over the window returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stream.mutex.Lock()
+	credit := stream.credit
+	stream.mutex.Unlock()
+	if credit != 0 {
+		t.Fatalf("credit = %d, want 0", credit)
+	}
+
+	// read bytes are granted back
+	if _, err := io.ReadFull(server, make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("window is not granted")
+	}
+}
+
+func TestMuxWindowViolationResets(t *testing.T) {
+	s, sent, opened := newTestMuxSession(16, 2)
+	s.receive(muxOpenMessage(1, 1024, "upload"))
+	expectMuxMessage(t, sent, muxWindow, 1)
+	stream := <-opened
+
+	s.receive(muxMessage(muxData, 1, make([]byte, 10)))
+	// over the remaining window of 6 bytes
+	s.receive(muxMessage(muxData, 1, make([]byte, 10)))
+	expectMuxMessage(t, sent, muxClose, 1)
+
+	// buffered data is drained first
+	if _, err := io.ReadFull(stream, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("read after reset = %v, want %v", err, ErrStreamReset)
+	}
+	if s.get(1) != nil {
+		t.Fatal("reset stream is still open")
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	s, sent, opened := newTestMuxSession(1024, 2)
+	s.receive(muxOpenMessage(1, 1024, "a"))
+	expectMuxMessage(t, sent, muxWindow, 1)
+	remote := <-opened
+	s.receive(muxOpenMessage(3, 1024, "b"))
+	expectMuxMessage(t, sent, muxWindow, 3)
+	local := <-opened
+
+	// closed by the peer, received data is still readable
+	s.receive(muxMessage(muxData, 1, []byte("bye")))
+	s.receive(muxMessage(muxClose, 1, nil))
+	if data, err := io.ReadAll(remote); err != nil || string(data) != "bye" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if _, err := remote.Write([]byte("x")); err != ErrStreamClosed {
+		t.Fatalf("write after the peer closed = %v", err)
+	}
+	if err := remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closed by this side, the peer is notified once
+	local.Close()
+	local.Close()
+	expectMuxMessage(t, sent, muxClose, 3)
+	if _, err := local.Read(make([]byte, 1)); err != ErrStreamClosed {
+		t.Fatalf("read after close = %v", err)
+	}
+	if _, err := local.Write([]byte("x")); err != ErrStreamClosed {
+		t.Fatalf("write after close = %v", err)
+	}
+	select {
+	case message := <-sent:
+		t.Fatalf("unexpected message type %d", message[0])
+	default:
+	}
+
+	// session error closes the rest
+	stream, _ := s.Open("c")
+	expectMuxMessage(t, sent, muxOpen, stream.Id)
+	s.close(ErrConnectionClosed)
+	if _, err := stream.Read(make([]byte, 1)); err != ErrConnectionClosed {
+		t.Fatalf("read after session close = %v", err)
+	}
+	if _, err := s.Open("d"); err != ErrConnectionClosed {
+		t.Fatalf("open after session close = %v", err)
+	}
+}
+
+func TestMuxRejectsWrongParity(t *testing.T) {
+	s, sent, opened := newTestMuxSession(1024, 2)
+	// even IDs are opened by the server itself
+	s.receive(muxOpenMessage(2, 1024, "spoofed"))
+	select {
+	case message := <-sent:
+		t.Fatalf("open of wrong parity is answered with type %d", message[0])
+	case <-opened:
+		t.Fatal("stream of wrong parity is opened")
+	default:
+	}
+	if s.get(2) != nil {
+		t.Fatal("stream of wrong parity is registered")
+	}
+}
+
+func TestMuxMaxStreams(t *testing.T) {
+	s, sent, opened := newTestMuxSession(1024, 2)
+	s.maxStreams = 2
+
+	s.receive(muxOpenMessage(1, 1024, "a"))
+	expectMuxMessage(t, sent, muxWindow, 1)
+	<-opened
+	local, err := s.Open("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMuxMessage(t, sent, muxOpen, local.Id)
+
+	// refused by close
+	s.receive(muxOpenMessage(3, 1024, "c"))
+	expectMuxMessage(t, sent, muxClose, 3)
+	if s.get(3) != nil {
+		t.Fatal("stream over the limit is opened")
+	}
+	if _, err := s.Open("d"); err != ErrTooManyStreams {
+		t.Fatalf("open over the limit = %v", err)
+	}
+
+	// closed stream frees the slot
+	local.Close()
+	expectMuxMessage(t, sent, muxClose, local.Id)
+	s.receive(muxOpenMessage(5, 1024, "e"))
+	expectMuxMessage(t, sent, muxWindow, 5)
+}
+
+func TestMuxRejectsDroppingPolicy(t *testing.T) {
+	mux, session, c := newTestMux(t, func(s *Server, m *Mux) {
+		s.SlowConsumer = SlowConsumerDropOldest
+	})
+	if _, err := mux.Open(c, "push"); err != ErrMuxDroppingPolicy {
+		t.Fatalf("open = %v, want %v", err, ErrMuxDroppingPolicy)
+	}
+
+	session.Open("upload")
+	if _, err := session.Accept(); err == nil {
+		t.Fatal("session is not closed")
+	} else if ce, ok := err.(*CloseError); !ok || ce.Code != CloseInternalError {
+		t.Fatalf("session error = %v, want close %d", err, CloseInternalError)
+	}
+}
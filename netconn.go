@@ -0,0 +1,346 @@
+package aun
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Received bytes buffered by net.Conn adapter, socket reading waits while exceeded
+	netConnBufferSize = 1024 * 1024
+
+	// Max payload of the binary message written by net.Conn adapter
+	netConnFrameSize = 64 * 1024
+)
+
+// Connection adapted to net.Conn.
+// Binary messages are read as byte stream, and written bytes are sent as binary messages.
+type netConn struct {
+	conn *Connection
+
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+
+	// Closed and renewed when the buffer or deadlines are changed
+	notify chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Whether Close() is called
+	closed bool
+}
+
+// Frame written synchronously, the result is sent to done.
+type syncFrame struct {
+	*Frame
+	done chan error
+}
+
+// Accepts WebSocket connections of the server as net.Conn,
+// so existing servers ( gRPC, SSH, ... ) can run over WebSocket:
+//
+//	l := aun.NewListener(srv)
+//	go srv.Listen(1024)
+//	grpcServer.Serve(l)
+type Listener struct {
+	server *Server
+	conns  chan net.Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accepted connections waiting for Accept()
+const listenerBacklog = 128
+
+// Get the connection as net.Conn.
+// Binary messages are read as byte stream instead of OnMessage and broadcasting,
+// and Close() closes the connection with 1000.
+// Text messages are handled as usual.
+func (c *Connection) NetConn() net.Conn {
+	nc := &netConn{
+		conn:   c,
+		notify: make(chan struct{}),
+	}
+	if !c.netConn.CompareAndSwap(nil, nc) {
+		return c.netConn.Load()
+	}
+	if c.server != nil {
+		// messages received before adapting are passed by the hook
+		c.server.netConnOnce.Do(func() {
+			c.server.addMessageHook(c.server.handleNetConn)
+		})
+	}
+	return nc
+}
+
+// Message hook to pass binary messages to net.Conn adapter.
+func (s *Server) handleNetConn(c *Connection, frame *Frame) bool {
+	nc := c.netConn.Load()
+	if nc == nil || frame.Opcode != BinaryFrame {
+		return false
+	}
+	// worker must not wait for reading
+	nc.push(frame.PayloadData, false)
+	return true
+}
+
+// Store received data, waits while the buffer is full if wait is true.
+func (nc *netConn) push(data []byte, wait bool) {
+	for {
+		nc.mutex.Lock()
+		if nc.closed {
+			nc.mutex.Unlock()
+			return
+		}
+		if !wait || nc.buffer.Len() < netConnBufferSize {
+			nc.buffer.Write(data)
+			nc.signal()
+			nc.mutex.Unlock()
+			return
+		}
+		notify := nc.notify
+		nc.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-nc.conn.closed:
+			return
+		}
+	}
+}
+
+// Wake up waiting Read(), Write() and push(). Must be called with lock.
+func (nc *netConn) signal() {
+	close(nc.notify)
+	nc.notify = make(chan struct{})
+}
+
+// net.Conn interface implement.
+// Returns io.EOF after the connection is closed and the received data is drained.
+func (nc *netConn) Read(p []byte) (int, error) {
+	for {
+		nc.mutex.Lock()
+		if nc.closed {
+			nc.mutex.Unlock()
+			return 0, net.ErrClosed
+		}
+		if nc.buffer.Len() > 0 {
+			n, _ := nc.buffer.Read(p)
+			nc.signal()
+			nc.mutex.Unlock()
+			return n, nil
+		}
+		deadline, notify := nc.readDeadline, nc.notify
+		nc.mutex.Unlock()
+
+		select {
+		case <-nc.conn.closed:
+			// data may be pushed just before closing
+			nc.mutex.Lock()
+			empty := nc.buffer.Len() == 0
+			nc.mutex.Unlock()
+			if empty {
+				return 0, io.EOF
+			}
+			continue
+		default:
+		}
+
+		if err := waitNotify(notify, nc.conn.closed, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// net.Conn interface implement.
+// Data is sent as binary messages, and returns after written to socket.
+func (nc *netConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		nc.mutex.Lock()
+		closed, deadline := nc.closed, nc.writeDeadline
+		nc.mutex.Unlock()
+		if closed {
+			return written, net.ErrClosed
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := min(len(p), netConnFrameSize)
+		// copy the data, it may be written after returning on timeout
+		frame, err := BuildSingleFrame(append([]byte(nil), p[:n]...), 1, BinaryFrame)
+		if err != nil {
+			return written, err
+		}
+		sf := &syncFrame{Frame: frame, done: make(chan error, 1)}
+		if err := nc.conn.enqueue(sf); err != nil {
+			return written, err
+		}
+
+		if err := sf.wait(nc.conn.closed, deadline); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// net.Conn interface implement, closes the connection with 1000.
+func (nc *netConn) Close() error {
+	nc.mutex.Lock()
+	if nc.closed {
+		nc.mutex.Unlock()
+		return net.ErrClosed
+	}
+	nc.closed = true
+	nc.buffer.Reset()
+	nc.signal()
+	nc.mutex.Unlock()
+
+	nc.conn.CloseWith(CloseNormalClosure, "")
+	return nil
+}
+
+// net.Conn interface implement.
+func (nc *netConn) LocalAddr() net.Addr {
+	return nc.conn.conn.LocalAddr()
+}
+
+// net.Conn interface implement.
+func (nc *netConn) RemoteAddr() net.Addr {
+	return nc.conn.RemoteAddr()
+}
+
+// net.Conn interface implement.
+func (nc *netConn) SetDeadline(t time.Time) error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	nc.readDeadline = t
+	nc.writeDeadline = t
+	nc.signal()
+	return nil
+}
+
+// net.Conn interface implement.
+func (nc *netConn) SetReadDeadline(t time.Time) error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	nc.readDeadline = t
+	nc.signal()
+	return nil
+}
+
+// net.Conn interface implement.
+// Deadline is applied to the following writes.
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	nc.writeDeadline = t
+	return nil
+}
+
+// Wait for the frame written until the deadline.
+func (sf *syncFrame) wait(closed chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-sf.done:
+		return err
+	case <-closed:
+		return net.ErrClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Wait for notify or closed until the deadline.
+func waitNotify(notify, closed chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		select {
+		case <-notify:
+		case <-closed:
+		}
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-notify:
+	case <-closed:
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Accept WebSocket connections of the server as net.Conn.
+// Must be called before Listen(), connections are adapted on handshake.
+func NewListener(s *Server) *Listener {
+	l := &Listener{
+		server: s,
+		conns:  make(chan net.Conn, listenerBacklog),
+		closed: make(chan struct{}),
+	}
+	s.netListener.Store(l)
+	s.addJoinHook(l.join)
+	return l
+}
+
+// Server join hook, queue the connection to Accept().
+func (l *Listener) join(c *Connection) {
+	nc := c.netConn.Load()
+	if nc == nil {
+		return
+	}
+	select {
+	case <-l.closed:
+		go c.CloseWith(CloseGoingAway, "")
+		return
+	default:
+	}
+	select {
+	case l.conns <- nc:
+	default:
+		go c.CloseWith(CloseTryAgainLater, "")
+	}
+}
+
+// net.Listener interface implement.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// net.Listener interface implement.
+// Stops accepting, the server keeps running.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// net.Listener interface implement.
+func (l *Listener) Addr() net.Addr {
+	return l.server.addr
+}
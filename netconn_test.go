@@ -0,0 +1,212 @@
+package aun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Listener on the test server, and the accepted net.Conn of a dialed client.
+func newTestNetConn(t *testing.T) (*ClientConn, net.Conn) {
+	t.Helper()
+	var l *Listener
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		l = NewListener(s)
+	})
+	client, _ := dialTest(t, url, connected)
+	nc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, nc
+}
+
+func TestNetConnReadStream(t *testing.T) {
+	client, nc := newTestNetConn(t)
+
+	// messages are read as one byte stream
+	client.SendBinary([]byte("hello "))
+	client.SendBinary([]byte("world"))
+	data := make([]byte, 11)
+	if _, err := io.ReadFull(nc, data); err != nil || string(data) != "hello world" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	// data sent before the peer closed is drained, then EOF
+	client.SendBinary([]byte("bye"))
+	client.Close()
+	if data, err := io.ReadAll(nc); err != nil || string(data) != "bye" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
+
+func TestNetConnWriteSplitsFrames(t *testing.T) {
+	client, nc := newTestNetConn(t)
+
+	data := bytes.Repeat([]byte("0123456789"), 15000)
+	if n, err := nc.Write(data); err != nil || n != len(data) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	var received []byte
+	for _, want := range []int{netConnFrameSize, netConnFrameSize, len(data) - 2*netConnFrameSize} {
+		opcode, message, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != BinaryFrame || len(message) != want {
+			t.Fatalf("message of opcode %d and %d bytes, want binary of %d bytes", opcode, len(message), want)
+		}
+		received = append(received, message...)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("written data is broken")
+	}
+}
+
+func TestNetConnDeadlines(t *testing.T) {
+	client, nc := newTestNetConn(t)
+
+	nc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := nc.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read = %v, want deadline exceeded", err)
+	}
+	// cleared deadline
+	nc.SetReadDeadline(time.Time{})
+	client.SendBinary([]byte("x"))
+	if _, err := nc.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// deadline extended while reading wakes up the reader
+	done := make(chan error, 1)
+	go func() {
+		_, err := nc.Read(make([]byte, 1))
+		done <- err
+	}()
+	nc.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read = %v, want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader is not woken up by the deadline")
+	}
+
+	nc.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := nc.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write = %v, want deadline exceeded", err)
+	}
+	nc.SetDeadline(time.Time{})
+	if _, err := nc.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetConnClose(t *testing.T) {
+	client, nc := newTestNetConn(t)
+
+	if err := nc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := client.ReadMessage()
+	if ce, ok := err.(*CloseError); !ok || ce.Code != CloseNormalClosure {
+		t.Fatalf("close error = %v, want %d", err, CloseNormalClosure)
+	}
+	if err := nc.Close(); err != net.ErrClosed {
+		t.Fatalf("second close = %v", err)
+	}
+	if _, err := nc.Read(make([]byte, 1)); err != net.ErrClosed {
+		t.Fatalf("read after close = %v", err)
+	}
+	if _, err := nc.Write([]byte("x")); err != net.ErrClosed {
+		t.Fatalf("write after close = %v", err)
+	}
+}
+
+func TestNetConnBackpressure(t *testing.T) {
+	c, _ := newPipeConnection(t, 4, SlowConsumerBlock, 0)
+	nc := c.NetConn().(*netConn)
+
+	nc.push(make([]byte, netConnBufferSize), true)
+	pushed := make(chan struct{})
+	go func() {
+		nc.push([]byte("more"), true)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("data is buffered over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// reading makes room
+	if _, err := nc.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket reading is not resumed")
+	}
+	// the worker does not wait
+	nc.push([]byte("hook"), false)
+	if n := nc.buffer.Len(); n != netConnBufferSize-1024+len("more")+len("hook") {
+		t.Fatalf("buffered %d bytes", n)
+	}
+}
+
+func TestNetConnWriteDroppedByQueue(t *testing.T) {
+	c, _ := newPipeConnection(t, 1, SlowConsumerDropOldest, 0)
+	nc := c.NetConn()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := nc.Write([]byte("x"))
+		written <- err
+	}()
+	eventually(t, "write is not queued", func() bool {
+		return len(c.Write) == 1
+	})
+	// evicts the queued write
+	queueText(t, c, "y")
+	select {
+	case err := <-written:
+		if err != ErrQueueFull {
+			t.Fatalf("write = %v, want %v", err, ErrQueueFull)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write of the dropped frame is blocked")
+	}
+}
+
+func TestListenerBacklog(t *testing.T) {
+	l := &Listener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	first, _ := newPipeConnection(t, 4, SlowConsumerBlock, 0)
+	second, peer := newPipeConnection(t, 4, SlowConsumerBlock, 0)
+	first.NetConn()
+	second.NetConn()
+
+	l.join(first)
+	// over the backlog
+	l.join(second)
+	expectPeerClose(t, peer, CloseTryAgainLater)
+	if nc, err := l.Accept(); err != nil || nc != first.netConn.Load() {
+		t.Fatalf("accepted %v, %v", nc, err)
+	}
+
+	// closed listener refuses connections
+	l.Close()
+	third, peer := newPipeConnection(t, 4, SlowConsumerBlock, 0)
+	third.NetConn()
+	l.join(third)
+	expectPeerClose(t, peer, CloseGoingAway)
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Fatalf("accept after close = %v", err)
+	}
+}
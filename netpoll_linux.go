@@ -0,0 +1,167 @@
+//go:build linux
+
+package aun
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Number of events received at once
+const pollEvents = 256
+
+// Event waiting timeout in milliseconds, to check the poller is closed and idle connections
+const pollTimeout = 1000
+
+// Watching events. Connection is disarmed after an event until processed.
+const pollFlags = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// epoll based connection poller.
+// Idle connections have no goroutine and no read buffer,
+// the message is read and processed only when the socket is readable.
+type poller struct {
+	fd     int
+	mutex  sync.RWMutex
+	conns  map[int]*Connection
+	closed atomic.Bool
+}
+
+// Create new poller and start event loop.
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{
+		fd:    fd,
+		conns: make(map[int]*Connection),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Register connection to poller.
+func (p *poller) add(c *Connection) error {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return errors.New("Connection does not support netpoll")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return err
+	}
+
+	c.pollFd = fd
+	c.poller = p
+	p.mutex.Lock()
+	p.conns[fd] = c
+	p.mutex.Unlock()
+
+	event := &syscall.EpollEvent{Events: pollFlags, Fd: int32(fd)}
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+		p.mutex.Lock()
+		delete(p.conns, fd)
+		p.mutex.Unlock()
+		c.poller = nil
+		return err
+	}
+	return nil
+}
+
+// Re-arm connection after processing event.
+func (p *poller) rearm(c *Connection) error {
+	event := &syscall.EpollEvent{Events: pollFlags, Fd: int32(c.pollFd)}
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, c.pollFd, event)
+}
+
+// Unregister connection. Must be called before the socket is closed.
+func (p *poller) remove(c *Connection) {
+	p.mutex.Lock()
+	if registered, ok := p.conns[c.pollFd]; ok && registered == c {
+		delete(p.conns, c.pollFd)
+	}
+	p.mutex.Unlock()
+	syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, c.pollFd, nil)
+}
+
+// Event loop.
+func (p *poller) run() {
+	defer syscall.Close(p.fd)
+
+	events := make([]syscall.EpollEvent, pollEvents)
+	swept := time.Now()
+	for !p.closed.Load() {
+		if now := time.Now(); now.Sub(swept) >= pollTimeout*time.Millisecond {
+			p.closeIdle(now)
+			swept = now
+		}
+		n, err := syscall.EpollWait(p.fd, events, pollTimeout)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			fmt.Println(err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			p.mutex.RLock()
+			c, ok := p.conns[int(events[i].Fd)]
+			p.mutex.RUnlock()
+			if ok {
+				go p.serve(c)
+			}
+		}
+	}
+}
+
+// Close connections which received no data until the idle deadline.
+// Same as the socket read deadline in goroutine mode.
+func (p *poller) closeIdle(now time.Time) {
+	var idle []*Connection
+	p.mutex.RLock()
+	for _, c := range p.conns {
+		if c.idleDeadline.Load() < now.UnixNano() {
+			idle = append(idle, c)
+		}
+	}
+	p.mutex.RUnlock()
+
+	// shutdown unregisters the connection
+	for _, c := range idle {
+		c.shutdown()
+	}
+}
+
+// Read and process single message from readable connection.
+func (p *poller) serve(c *Connection) {
+	c.pollMutex.Lock()
+	defer c.pollMutex.Unlock()
+
+	data, err := c.readMessage()
+	if err != nil {
+		c.shutdown()
+		return
+	}
+	if err := c.process(data); err != nil {
+		fmt.Println(err)
+		c.shutdown()
+		return
+	}
+	c.extendIdle()
+	if err := p.rearm(c); err != nil {
+		c.shutdown()
+	}
+}
+
+// Stop event loop.
+func (p *poller) close() {
+	p.closed.Store(true)
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package aun
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNetPollServesConnections(t *testing.T) {
+	_, url, connected := newTestListener(t, true, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		s.OnReceive = func(c *Connection, opcode int, message []byte) {
+			c.Send(message)
+		}
+	})
+
+	clients := make([]*ClientConn, 3)
+	for i := range clients {
+		client, c := dialTest(t, url, connected)
+		if c.poller == nil {
+			t.Fatal("connection is not served by the poller")
+		}
+		clients[i] = client
+	}
+
+	// every message needs the connection re-armed
+	for round := 0; round < 5; round++ {
+		for i, client := range clients {
+			message := fmt.Sprintf("%d-%d", i, round)
+			if err := client.Send([]byte(message)); err != nil {
+				t.Fatal(err)
+			}
+			if _, echo, err := client.ReadMessage(); err != nil || string(echo) != message {
+				t.Fatalf("echo = %q, %v, want %s", echo, err, message)
+			}
+		}
+	}
+}
+
+func TestNetPollLargeMessage(t *testing.T) {
+	_, url, connected := newTestListener(t, true, nil)
+	client, _ := dialTest(t, url, connected)
+
+	// larger than the read buffer, frame is completed over several events
+	message := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := client.SendBinary(message); err != nil {
+		t.Fatal(err)
+	}
+	if _, echo, err := client.ReadMessage(); err != nil || !bytes.Equal(echo, message) {
+		t.Fatalf("echo of %d bytes, %v", len(echo), err)
+	}
+}
+
+func TestNetPollDetectsClose(t *testing.T) {
+	s, url, connected := newTestListener(t, true, nil)
+	graceful, _ := dialTest(t, url, connected)
+	abrupt, _ := dialTest(t, url, connected)
+	p := s.poller
+
+	closeClient(graceful)
+	// socket closed without closing frame
+	abrupt.shutdown()
+
+	eventually(t, "closed connections are not removed", func() bool {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+		return len(p.conns) == 0 && s.ConnectionCount() == 0
+	})
+}
+
+func TestNetPollClosesIdle(t *testing.T) {
+	s, url, connected := newTestListener(t, true, func(s *Server) {
+		s.IdleTimeout = 200 * time.Millisecond
+	})
+	client, c := dialTest(t, url, connected)
+	p := s.poller
+
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("message is received from the idle connection")
+	}
+	eventually(t, "idle connection is not unregistered", func() bool {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+		_, ok := p.conns[c.pollFd]
+		return !ok && s.ConnectionCount() == 0
+	})
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package aun
+
+import (
+	"errors"
+)
+
+// Netpoll mode is not supported on this platform.
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("Netpoll mode is supported only on Linux")
+}
+
+func (p *poller) add(c *Connection) error {
+	return errors.New("Netpoll mode is supported only on Linux")
+}
+
+func (p *poller) remove(c *Connection) {}
+
+func (p *poller) close() {}
@@ -0,0 +1,236 @@
+package aun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Presence event names
+const (
+	PresenceJoinEvent  = "presence_join"
+	PresenceLeaveEvent = "presence_leave"
+	PresenceStateEvent = "presence_state"
+)
+
+// User presence in the topic.
+type PresenceEntry struct {
+	UserId   string      `json:"user_id"`
+	Meta     interface{} `json:"meta,omitempty"`
+	JoinedAt time.Time   `json:"joined_at"`
+}
+
+// Presence event message sent to topic members.
+type presenceEvent struct {
+	Event string      `json:"event"`
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+}
+
+// Worker key prefix of presence events, events of a topic are published in order
+const presenceWorkerKey = "aun.presence."
+
+// Presence of a user, may have several connections.
+type presenceState struct {
+	entry PresenceEntry
+
+	// connection -> tracked metadata, for restoring on session resumption
+	conns map[*Connection]interface{}
+
+	// Pending leave, fired after grace period
+	timer *time.Timer
+}
+
+// Track which users are in the topics of the hub.
+//
+// Members receive "presence_join" and "presence_leave" events,
+// and the joined connection receives "presence_state" snapshot:
+//
+//	{"event": "presence_join", "topic": "room", "data": {"user_id": "...", "meta": ..., "joined_at": "..."}}
+//
+// A user leaves after the last connection has left and grace period is passed,
+// so reconnecting tabs don't cause join/leave flapping.
+//
+// With a broker, events reach the topic members on every node.
+// Presence is tracked per node, so List() and "presence_state" contain the users on this node,
+// and a user connected to several nodes joins and leaves on each of them.
+type Presence struct {
+	hub   *Hub
+	grace time.Duration
+	mutex sync.Mutex
+
+	// topic -> user ID -> presence
+	topics map[string]map[string]*presenceState
+}
+
+// Create presence tracker on the hub.
+func NewPresence(hub *Hub, grace time.Duration) *Presence {
+	p := &Presence{
+		hub:    hub,
+		grace:  grace,
+		topics: make(map[string]map[string]*presenceState),
+	}
+	hub.addLeaveHook(p.leave)
+	hub.addPresence(p)
+	return p
+}
+
+// Join connection to the topic, and track its user with metadata.
+// The connection must be bound to user by Server.Identify.
+func (p *Presence) Track(conn *Connection, topic string, meta interface{}) error {
+	if conn.UserId == "" {
+		return errors.New("Connection is not bound to user")
+	}
+
+	p.mutex.Lock()
+	if !p.hub.add(conn, topic) {
+		p.mutex.Unlock()
+		return errors.New("Failed to join topic")
+	}
+	p.track(conn, topic, meta)
+	err := p.send(conn, topic, PresenceStateEvent, p.list(topic))
+	p.mutex.Unlock()
+
+	// run without lock, the hook may use the presence
+	if p.hub.OnJoin != nil {
+		p.hub.OnJoin(conn, topic)
+	}
+	return err
+}
+
+// Track the user of the connection, must be called with lock.
+func (p *Presence) track(conn *Connection, topic string, meta interface{}) {
+	if p.topics[topic] == nil {
+		p.topics[topic] = make(map[string]*presenceState)
+	}
+
+	state, ok := p.topics[topic][conn.UserId]
+	if !ok {
+		state = &presenceState{
+			entry: PresenceEntry{
+				UserId:   conn.UserId,
+				Meta:     meta,
+				JoinedAt: time.Now(),
+			},
+			conns: make(map[*Connection]interface{}),
+		}
+		p.topics[topic][conn.UserId] = state
+		p.publish(topic, PresenceJoinEvent, state.entry, conn)
+	} else if state.timer != nil {
+		// reconnected within grace period
+		state.timer.Stop()
+		state.timer = nil
+	}
+	state.conns[conn] = meta
+}
+
+// Get tracked topics and metadata of the connection.
+func (p *Presence) tracked(conn *Connection) map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	topics := make(map[string]interface{})
+	for topic, users := range p.topics {
+		if state, ok := users[conn.UserId]; ok {
+			if meta, ok := state.conns[conn]; ok {
+				topics[topic] = meta
+			}
+		}
+	}
+	return topics
+}
+
+// Track the resumed connection again, its hub membership is restored by the server.
+func (p *Presence) restore(conn *Connection, topic string, meta interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.track(conn, topic, meta)
+	p.send(conn, topic, PresenceStateEvent, p.list(topic))
+}
+
+// Leave connection from the topic.
+func (p *Presence) Untrack(conn *Connection, topic string) bool {
+	return p.hub.Leave(conn, topic)
+}
+
+// Get users in the topic.
+func (p *Presence) List(topic string) []PresenceEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.list(topic)
+}
+
+// Get users in the topic, must be called with lock.
+func (p *Presence) list(topic string) []PresenceEntry {
+	entries := make([]PresenceEntry, 0, len(p.topics[topic]))
+	for _, state := range p.topics[topic] {
+		entries = append(entries, state.entry)
+	}
+	return entries
+}
+
+// Hub leave hook.
+func (p *Presence) leave(conn *Connection, topic string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state, ok := p.topics[topic][conn.UserId]
+	if !ok {
+		return
+	}
+	delete(state.conns, conn)
+	if len(state.conns) > 0 || state.timer != nil {
+		return
+	}
+	if p.grace <= 0 {
+		p.remove(topic, state)
+		return
+	}
+	state.timer = time.AfterFunc(p.grace, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		// user may be reconnected while waiting for the lock
+		if len(state.conns) == 0 && p.topics[topic][state.entry.UserId] == state {
+			p.remove(topic, state)
+		}
+	})
+}
+
+// Remove user from the topic and notify, must be called with lock.
+func (p *Presence) remove(topic string, state *presenceState) {
+	delete(p.topics[topic], state.entry.UserId)
+	if len(p.topics[topic]) == 0 {
+		delete(p.topics, topic)
+	}
+	p.publish(topic, PresenceLeaveEvent, state.entry, nil)
+}
+
+// Send presence event to topic members except the connection.
+// Members on other nodes receive it through the server broker, same as Hub.Publish().
+// Publishing runs on the worker of the topic, so leaving on the server loop is not blocked by a slow broker.
+func (p *Presence) publish(topic, event string, data interface{}, except *Connection) {
+	message, err := json.Marshal(presenceEvent{Event: event, Topic: topic, Data: data})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	p.hub.server.pool().dispatch(presenceWorkerKey+topic, func() {
+		if err := p.hub.publishExcept(topic, message, except); err != nil {
+			fmt.Println(err)
+		}
+	}, true)
+}
+
+// Send presence event to the connection.
+func (p *Presence) send(conn *Connection, topic, event string, data interface{}) error {
+	message, err := json.Marshal(presenceEvent{Event: event, Topic: topic, Data: data})
+	if err != nil {
+		return err
+	}
+	return conn.enqueueMessage(message, TextFrame)
+}
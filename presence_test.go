@@ -0,0 +1,172 @@
+package aun
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Broker blocking publishes until released.
+type blockingBroker struct {
+	*MemoryBroker
+	release chan struct{}
+}
+
+func (b *blockingBroker) Publish(channel string, message []byte) error {
+	<-b.release
+	return b.MemoryBroker.Publish(channel, message)
+}
+
+// Presence on the test server binding users by X-User header.
+func newTestPresence(t *testing.T, setup func(s *Server)) (*Presence, string, chan *Connection) {
+	t.Helper()
+	var presence *Presence
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		s.Identify = func(c *Connection, req *Request) (string, error) {
+			return req.Headers["X-User"], nil
+		}
+		if setup != nil {
+			setup(s)
+		}
+		presence = NewPresence(NewHub(s), 0)
+	})
+	return presence, url, connected
+}
+
+// Read the next presence event of the client.
+func readPresence(t *testing.T, client *ClientConn) presenceEvent {
+	t.Helper()
+	_, message, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event presenceEvent
+	if err := json.Unmarshal(message, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestPresenceEvents(t *testing.T) {
+	presence, url, connected := newTestPresence(t, nil)
+	alice, a := dialUser(t, url, "alice", connected)
+	bob, b := dialUser(t, url, "bob", connected)
+
+	if err := presence.Track(a, "room", "red"); err != nil {
+		t.Fatal(err)
+	}
+	if event := readPresence(t, alice); event.Event != PresenceStateEvent || len(event.Data.([]interface{})) != 1 {
+		t.Fatalf("unexpected state %+v", event)
+	}
+	if err := presence.Track(b, "room", "blue"); err != nil {
+		t.Fatal(err)
+	}
+	if event := readPresence(t, alice); event.Event != PresenceJoinEvent || event.Data.(map[string]interface{})["user_id"] != "bob" {
+		t.Fatalf("unexpected join %+v", event)
+	}
+	if event := readPresence(t, bob); event.Event != PresenceStateEvent || len(event.Data.([]interface{})) != 2 {
+		t.Fatalf("unexpected state %+v", event)
+	}
+
+	closeClient(bob)
+	if event := readPresence(t, alice); event.Event != PresenceLeaveEvent || event.Data.(map[string]interface{})["user_id"] != "bob" {
+		t.Fatalf("unexpected leave %+v", event)
+	}
+	if entries := presence.List("room"); len(entries) != 1 || entries[0].UserId != "alice" {
+		t.Fatalf("list = %+v", entries)
+	}
+}
+
+func TestPresenceOnJoinUsesPresence(t *testing.T) {
+	presence, url, connected := newTestPresence(t, nil)
+	_, a := dialUser(t, url, "alice", connected)
+
+	listed := make(chan int, 1)
+	presence.hub.OnJoin = func(conn *Connection, topic string) {
+		listed <- len(presence.List(topic))
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- presence.Track(a, "room", nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Track deadlocked on OnJoin")
+	}
+	if n := <-listed; n != 1 {
+		t.Fatalf("OnJoin listed %d users, want 1", n)
+	}
+}
+
+func TestPresenceLeaveDoesNotBlockServer(t *testing.T) {
+	broker := &blockingBroker{MemoryBroker: NewMemoryBroker(), release: make(chan struct{})}
+	defer close(broker.release)
+	presence, url, connected := newTestPresence(t, func(s *Server) {
+		s.UseBroker(broker)
+	})
+	alice, a := dialUser(t, url, "alice", connected)
+	presence.Track(a, "room", nil)
+
+	// leave event is published while the broker is stuck
+	closeClient(alice)
+	eventually(t, "closed connection is still tracked", func() bool {
+		return len(presence.List("room")) == 0
+	})
+
+	// joining goes through the server loop
+	joined := make(chan error, 1)
+	go func() {
+		d := &Dialer{Header: map[string]string{"X-User": "bob"}}
+		bob, err := d.Dial(url)
+		if err == nil {
+			closeClient(bob)
+		}
+		joined <- err
+	}()
+	select {
+	case err := <-joined:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server loop is blocked by the broker")
+	}
+}
+
+func TestPresenceRestoredOnResume(t *testing.T) {
+	presence, url, connected := newTestPresence(t, func(s *Server) {
+		s.Resume = time.Minute
+	})
+	alice, a := dialUser(t, url, "alice", connected)
+	presence.Track(a, "room", "red")
+	token := alice.Header.Get(ResumeHeader)
+
+	closeClient(alice)
+	eventually(t, "closed connection is still tracked", func() bool {
+		return len(presence.List("room")) == 0
+	})
+
+	d := &Dialer{Header: map[string]string{"X-User": "alice", ResumeHeader: token}}
+	resumed, c := dialTestWith(t, d, url, connected)
+	if c.Id != a.Id {
+		t.Fatal("session is not resumed")
+	}
+	entries := presence.List("room")
+	if len(entries) != 1 || entries[0].UserId != "alice" || entries[0].Meta != "red" {
+		t.Fatalf("list = %+v", entries)
+	}
+	if members := presence.hub.Members("room"); len(members) != 1 || members[0] != c {
+		t.Fatal("resumed connection is not a member")
+	}
+	// state is sent again for the resumed connection
+	for {
+		if event := readPresence(t, resumed); event.Event == PresenceStateEvent {
+			break
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package aun
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Messages from the client waiting for writing to the upstream
+	proxyQueueSize = 1024
+
+	// Points of each upstream on the consistent hash ring
+	proxyHashReplicas = 64
+)
+
+// Upstream selection of the proxy route.
+type ProxyBalance int
+
+const (
+	// Upstreams in turn
+	ProxyRoundRobin ProxyBalance = iota
+
+	// Upstream with the fewest proxied connections
+	ProxyLeastConnections
+
+	// Consistent hash on the request header ( client address if the header is empty ),
+	// so the same key reaches the same upstream while it is healthy
+	ProxyHash
+)
+
+// WebSocket reverse proxy and load balancer.
+//
+// Accepted connections are relayed to the upstream WebSocket server chosen by the request host and path:
+//
+//	p := aun.NewProxy(srv)
+//	p.Route("", "/chat", aun.ProxyLeastConnections, "ws://10.0.0.1:9000", "ws://10.0.0.2:9000")
+//	go srv.Listen(1024)
+//
+// Messages are relayed both ways instead of OnMessage and broadcasting,
+// and the closing status is propagated. Ping/pong is answered on each side.
+// Upstreams are checked by TCP connecting every HealthInterval, and skipped while unhealthy.
+type Proxy struct {
+	server *Server
+
+	// Dialer for the upstreams, request headers and subprotocol are set per connection
+	Dialer *Dialer
+
+	// Health check interval ( disabled if zero ) and timeout
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	mutex  sync.RWMutex
+	routes []*ProxyRoute
+
+	// Upstreams by URL, shared by the routes
+	upstreams map[string]*upstream
+
+	// Proxied connections
+	conns sync.Map
+
+	healthOnce sync.Once
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// Proxy route to the upstreams.
+type ProxyRoute struct {
+	// Request host without port ( any host if empty )
+	Host string
+
+	// Request path prefix
+	Path string
+
+	// Upstream selection
+	Balance ProxyBalance
+
+	// Request header for ProxyHash
+	HashHeader string
+
+	upstreams []*upstream
+	ring      []hashPoint
+	next      atomic.Uint64
+}
+
+// Upstream WebSocket server.
+type upstream struct {
+	url  *url.URL
+	addr string
+
+	healthy atomic.Bool
+	active  atomic.Int64
+}
+
+// Point of the consistent hash ring.
+type hashPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// Upstream status snapshot.
+type UpstreamStatus struct {
+	URL         string
+	Healthy     bool
+	Connections int64
+}
+
+// Connection relayed to the upstream.
+type proxyConn struct {
+	queue  chan *Frame
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex    sync.Mutex
+	upstream *ClientConn
+}
+
+// Enable reverse proxy on the server.
+func NewProxy(s *Server) *Proxy {
+	p := &Proxy{
+		server:         s,
+		Dialer:         DefaultDialer,
+		HealthInterval: 5 * time.Second,
+		HealthTimeout:  2 * time.Second,
+		upstreams:      make(map[string]*upstream),
+		closed:         make(chan struct{}),
+	}
+	s.addJoinHook(p.join)
+	s.addLeaveHook(p.leave)
+	s.addMessageHook(p.handle)
+	return p
+}
+
+// Add the route to the upstreams ( "ws://host:port" or "wss://host:port" ).
+// The request path and query are appended to the upstream URL.
+// The longest matching path is used, and health checking starts on the first route.
+func (p *Proxy) Route(host, path string, balance ProxyBalance, upstreams ...string) (*ProxyRoute, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("Route %s%s has no upstream", host, path)
+	}
+	r := &ProxyRoute{
+		Host:    host,
+		Path:    path,
+		Balance: balance,
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, raw := range upstreams {
+		up, err := p.upstream(raw)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, up)
+		for i := 0; i < proxyHashReplicas; i++ {
+			r.ring = append(r.ring, hashPoint{
+				hash:     crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", up.addr, i))),
+				upstream: up,
+			})
+		}
+	}
+	slices.SortFunc(r.ring, func(a, b hashPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	p.routes = append(p.routes, r)
+
+	p.healthOnce.Do(func() {
+		go p.checkHealth()
+	})
+	return r, nil
+}
+
+// Get the upstream of the URL, created on first use. Must be called with lock.
+func (p *Proxy) upstream(raw string) (*upstream, error) {
+	raw = strings.TrimSuffix(raw, "/")
+	if up, ok := p.upstreams[raw]; ok {
+		return up, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws", "http":
+		port = "80"
+	case "wss", "https":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("Unsupported upstream URL %q", raw)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	up := &upstream{
+		url:  u,
+		addr: net.JoinHostPort(u.Hostname(), port),
+	}
+	up.healthy.Store(true)
+	p.upstreams[raw] = up
+	return up, nil
+}
+
+// Get the status of all upstreams.
+func (p *Proxy) Upstreams() []UpstreamStatus {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var status []UpstreamStatus
+	for _, up := range p.upstreams {
+		status = append(status, UpstreamStatus{
+			URL:         up.url.String(),
+			Healthy:     up.healthy.Load(),
+			Connections: up.active.Load(),
+		})
+	}
+	slices.SortFunc(status, func(a, b UpstreamStatus) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+	return status
+}
+
+// Stop health checking. Proxied connections are kept.
+func (p *Proxy) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// Server join hook, connect to the upstream in background.
+func (p *Proxy) join(c *Connection) {
+	r := p.match(c)
+	if r == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &proxyConn{
+		queue:  make(chan *Frame, proxyQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	p.conns.Store(c, pc)
+	go p.relay(c, r, pc)
+}
+
+// Server leave hook, close the upstream with the client closing status.
+func (p *Proxy) leave(c *Connection) {
+	value, ok := p.conns.LoadAndDelete(c)
+	if !ok {
+		return
+	}
+	pc := value.(*proxyConn)
+	pc.cancel()
+	pc.mutex.Lock()
+	uc := pc.upstream
+	pc.mutex.Unlock()
+	if uc == nil {
+		return
+	}
+	code, reason := CloseGoingAway, ""
+	if ce := c.peerClose.Load(); ce != nil {
+		code, reason = sendableCloseCode(ce.Code), ce.Reason
+	}
+	// closing waits for the upstream reply
+	go uc.CloseWith(code, reason)
+}
+
+// Message hook to queue client messages to the upstream.
+func (p *Proxy) handle(c *Connection, frame *Frame) bool {
+	value, ok := p.conns.Load(c)
+	if !ok {
+		return false
+	}
+	pc := value.(*proxyConn)
+	select {
+	case pc.queue <- frame:
+	case <-pc.ctx.Done():
+	default:
+		// upstream is slower than the client
+		go c.CloseWith(CloseTryAgainLater, "upstream is busy")
+	}
+	return true
+}
+
+// Find the route of the connection.
+func (p *Proxy) match(c *Connection) *ProxyRoute {
+	if c.Request == nil {
+		return nil
+	}
+	host := requestHeader(c.Request, "Host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	path := c.Request.Path
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var found *ProxyRoute
+	for _, r := range p.routes {
+		if r.Host != "" && !strings.EqualFold(r.Host, host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(r.Path, "/")
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		if found == nil || len(r.Path) > len(found.Path) {
+			found = r
+		}
+	}
+	return found
+}
+
+// Connect to the upstream and relay messages in both directions.
+func (p *Proxy) relay(c *Connection, r *ProxyRoute, pc *proxyConn) {
+	key := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	if r.Balance == ProxyHash && r.HashHeader != "" {
+		if value := requestHeader(c.Request, r.HashHeader); value != "" {
+			key = value
+		}
+	}
+
+	// try other upstreams on failure
+	var uc *ClientConn
+	var up *upstream
+	tried := make(map[*upstream]bool)
+	for {
+		up = r.pick(key, tried)
+		if up == nil {
+			c.CloseWith(CloseBadGateway, "upstream unavailable")
+			return
+		}
+		tried[up] = true
+		var err error
+		if uc, err = p.dial(pc.ctx, c, up); err == nil {
+			break
+		}
+		if pc.ctx.Err() != nil {
+			return
+		}
+		// handshake rejection is not a health failure
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			up.healthy.Store(false)
+		}
+	}
+
+	pc.mutex.Lock()
+	if pc.ctx.Err() != nil {
+		pc.mutex.Unlock()
+		uc.CloseWith(CloseGoingAway, "")
+		return
+	}
+	pc.upstream = uc
+	pc.mutex.Unlock()
+
+	up.active.Add(1)
+	defer up.active.Add(-1)
+
+	go func() {
+		for {
+			select {
+			case frame := <-pc.queue:
+				if err := uc.WriteMessage(frame.Opcode, frame.PayloadData); err != nil {
+					return
+				}
+			case <-pc.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		opcode, message, err := uc.ReadMessage()
+		if err != nil {
+			if ce, ok := err.(*CloseError); ok {
+				c.CloseWith(sendableCloseCode(ce.Code), ce.Reason)
+			} else if pc.ctx.Err() == nil {
+				c.CloseWith(CloseBadGateway, "upstream closed")
+			}
+			return
+		}
+		if err := c.enqueueMessage(message, opcode); err != nil {
+			uc.CloseWith(CloseGoingAway, "")
+			return
+		}
+	}
+}
+
+// Connect to the upstream with the client request headers and subprotocol.
+func (p *Proxy) dial(ctx context.Context, c *Connection, up *upstream) (*ClientConn, error) {
+	d := *p.Dialer
+	d.Header = make(map[string]string)
+	for name, value := range c.Request.Headers {
+		switch strings.ToLower(name) {
+		case "host", "upgrade", "connection", "sec-websocket-key", "sec-websocket-version",
+			"sec-websocket-protocol", "sec-websocket-extensions", "x-forwarded-for":
+			continue
+		}
+		d.Header[name] = value
+	}
+	for name, value := range p.Dialer.Header {
+		d.Header[name] = value
+	}
+	forwarded := requestHeader(c.Request, "X-Forwarded-For")
+	if host, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
+		if forwarded != "" {
+			forwarded += ", "
+		}
+		forwarded += host
+	}
+	d.Header["X-Forwarded-For"] = forwarded
+	if host := requestHeader(c.Request, "Host"); host != "" {
+		d.Header["X-Forwarded-Host"] = host
+	}
+	if c.Subprotocol != "" {
+		d.Subprotocols = []string{c.Subprotocol}
+	} else {
+		d.Subprotocols = nil
+	}
+	return d.DialContext(ctx, up.url.String()+c.Request.URI())
+}
+
+// Choose the healthy upstream except tried ones ( nil if none ).
+func (r *ProxyRoute) pick(key string, tried map[*upstream]bool) *upstream {
+	available := func(up *upstream) bool {
+		return up.healthy.Load() && !tried[up]
+	}
+
+	switch r.Balance {
+	case ProxyLeastConnections:
+		var found *upstream
+		for _, up := range r.upstreams {
+			if available(up) && (found == nil || up.active.Load() < found.active.Load()) {
+				found = up
+			}
+		}
+		return found
+
+	case ProxyHash:
+		hash := crc32.ChecksumIEEE([]byte(key))
+		i, _ := slices.BinarySearchFunc(r.ring, hash, func(p hashPoint, h uint32) int {
+			return cmp.Compare(p.hash, h)
+		})
+		for n := 0; n < len(r.ring); n++ {
+			if up := r.ring[(i+n)%len(r.ring)].upstream; available(up) {
+				return up
+			}
+		}
+		return nil
+
+	default:
+		start := r.next.Add(1) - 1
+		for n := 0; n < len(r.upstreams); n++ {
+			if up := r.upstreams[(start+uint64(n))%uint64(len(r.upstreams))]; available(up) {
+				return up
+			}
+		}
+		return nil
+	}
+}
+
+// Check the upstreams by TCP connecting periodically.
+func (p *Proxy) checkHealth() {
+	if p.HealthInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		p.mutex.RLock()
+		var upstreams []*upstream
+		for _, up := range p.upstreams {
+			upstreams = append(upstreams, up)
+		}
+		p.mutex.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, up := range upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", up.addr, p.HealthTimeout)
+				if err == nil {
+					conn.Close()
+				}
+				up.healthy.Store(err == nil)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// Get the request header case-insensitively.
+func requestHeader(r *Request, name string) string {
+	for key, value := range r.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
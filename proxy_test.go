@@ -0,0 +1,193 @@
+package aun
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Upstream server replying "name:message:path?query".
+func newTestUpstream(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	hs := NewHandlerServer(func(c *Connection) {})
+	hs.Broadcast = BroadcastNone
+	hs.OnReceive = func(c *Connection, opcode int, message []byte) {
+		if string(message) == "close" {
+			// must not be sent, the proxy replaces it
+			go c.CloseWith(1005, "")
+			return
+		}
+		c.Send([]byte(name + ":" + string(message) + ":" + c.Request.Path + "?" + c.Request.RawQuery))
+	}
+	server := httptest.NewServer(hs)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Proxy server to the upstreams.
+func newTestProxy(t *testing.T, balance ProxyBalance, upstreams ...*httptest.Server) (*Proxy, string) {
+	t.Helper()
+	hs := NewHandlerServer(func(c *Connection) {})
+	p := NewProxy(hs.Server)
+	p.HealthInterval = 0
+	var urls []string
+	for _, up := range upstreams {
+		urls = append(urls, "ws"+strings.TrimPrefix(up.URL, "http"))
+	}
+	route, err := p.Route("", "/chat", balance, urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.HashHeader = "X-User"
+	server := httptest.NewServer(hs)
+	t.Cleanup(server.Close)
+	return p, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Close the client, unread messages and the closing reply are received by the reader.
+func closeClient(c *ClientConn) {
+	if c.closeSent.Load() {
+		return
+	}
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	c.Close()
+}
+
+// Connect through the proxy, and get the upstream name by a round trip.
+func proxyRoundTrip(t *testing.T, url, user string) (*ClientConn, string) {
+	t.Helper()
+	d := &Dialer{Header: map[string]string{"X-User": user}}
+	c, err := d.Dial(url + "/chat/room?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeClient(c) })
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := c.Send([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, rest, _ := strings.Cut(string(message), ":")
+	if rest != "hi:/chat/room?x=1" {
+		t.Fatalf("upstream received %q, want hi:/chat/room?x=1", rest)
+	}
+	return c, name
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	_, url := newTestProxy(t, ProxyRoundRobin, newTestUpstream(t, "a"), newTestUpstream(t, "b"))
+	var names []string
+	for i := 0; i < 4; i++ {
+		_, name := proxyRoundTrip(t, url, "")
+		names = append(names, name)
+	}
+	if got := strings.Join(names, ","); got != "a,b,a,b" {
+		t.Fatalf("upstreams %s, want a,b,a,b", got)
+	}
+}
+
+func TestProxyLeastConnections(t *testing.T) {
+	_, url := newTestProxy(t, ProxyLeastConnections, newTestUpstream(t, "a"), newTestUpstream(t, "b"))
+	first, name := proxyRoundTrip(t, url, "")
+	if name != "a" {
+		t.Fatalf("first upstream %s, want a", name)
+	}
+	if _, name := proxyRoundTrip(t, url, ""); name != "b" {
+		t.Fatalf("second upstream %s, want b", name)
+	}
+
+	// a has no connection after closing
+	closeClient(first)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, name := proxyRoundTrip(t, url, "")
+		if name == "a" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upstream with fewer connections is not chosen")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestProxyHash(t *testing.T) {
+	_, url := newTestProxy(t, ProxyHash, newTestUpstream(t, "a"), newTestUpstream(t, "b"))
+	chosen := make(map[string]string)
+	used := make(map[string]bool)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			_, name := proxyRoundTrip(t, url, user)
+			if prev, ok := chosen[user]; ok && prev != name {
+				t.Fatalf("%s moved from %s to %s", user, prev, name)
+			}
+			chosen[user] = name
+			used[name] = true
+		}
+	}
+	if len(used) != 2 {
+		t.Fatalf("keys are not spread: %v", chosen)
+	}
+}
+
+func TestProxyFailover(t *testing.T) {
+	down := newTestUpstream(t, "a")
+	p, url := newTestProxy(t, ProxyRoundRobin, down, newTestUpstream(t, "b"))
+	down.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, name := proxyRoundTrip(t, url, ""); name != "b" {
+			t.Fatalf("upstream %s, want b", name)
+		}
+	}
+	for _, status := range p.Upstreams() {
+		if healthy := !strings.HasPrefix(status.URL, "ws"+strings.TrimPrefix(down.URL, "http")); status.Healthy != healthy {
+			t.Fatalf("%s healthy = %v, want %v", status.URL, status.Healthy, healthy)
+		}
+	}
+}
+
+func TestProxyReplacesInvalidCloseCode(t *testing.T) {
+	_, url := newTestProxy(t, ProxyRoundRobin, newTestUpstream(t, "a"))
+	c, _ := proxyRoundTrip(t, url, "")
+	c.Send([]byte("close"))
+	_, _, err := c.ReadMessage()
+	ce, ok := err.(*CloseError)
+	if !ok || ce.Code != CloseProtocolError {
+		t.Fatalf("close error = %v, want %d", err, CloseProtocolError)
+	}
+}
+
+func TestSendableCloseCode(t *testing.T) {
+	for code, want := range map[int]int{
+		999:  CloseProtocolError,
+		1000: 1000,
+		1003: 1003,
+		1004: CloseProtocolError,
+		1005: CloseProtocolError,
+		1006: CloseProtocolError,
+		1011: 1011,
+		1014: 1014,
+		1015: CloseProtocolError,
+		2999: CloseProtocolError,
+		3000: 3000,
+		4999: 4999,
+		5000: CloseProtocolError,
+	} {
+		if got := sendableCloseCode(code); got != want {
+			t.Fatalf("sendableCloseCode(%d) = %d, want %d", code, got, want)
+		}
+	}
+}
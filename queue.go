@@ -0,0 +1,285 @@
+package aun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Behavior when the connection send queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// Wait for free space up to send timeout, then disconnect with 1008.
+	// Waiting is done in background, sender is never blocked.
+	SlowConsumerBlock SlowConsumerPolicy = iota
+
+	// Discard the oldest queued message to make space.
+	SlowConsumerDropOldest
+
+	// Discard the message being sent.
+	SlowConsumerDropNewest
+
+	// Disconnect immediately with 1008.
+	SlowConsumerDisconnect
+)
+
+var (
+	ErrConnectionClosed = errors.New("Connection already closed")
+	ErrQueueFull        = errors.New("Send queue is full, message dropped")
+	ErrSlowConsumer     = errors.New("Slow consumer, connection is closing")
+)
+
+// Configure send queue size and slow consumer policy.
+// Must be called before Wait().
+func (c *Connection) setSendQueue(size int, policy SlowConsumerPolicy, timeout time.Duration) {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultSendTimeout
+	}
+	c.Write = make(chan Readable, size)
+	c.queuePolicy = policy
+	c.sendTimeout = timeout
+}
+
+// Queue message to the writer.
+// This never blocks, full queue is handled by the slow consumer policy.
+func (c *Connection) enqueue(msg Readable) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if c.State() == CLOSED {
+		return ErrConnectionClosed
+	}
+
+	// Fast path, messages must not overtake the pending blocking sends
+	if c.pending == nil {
+		select {
+		case c.Write <- msg:
+			c.wakeWriter()
+			return nil
+		default:
+		}
+	}
+
+	switch c.queuePolicy {
+	case SlowConsumerDropNewest:
+		c.messagesDropped.Add(1)
+		return ErrQueueFull
+
+	case SlowConsumerDropOldest:
+		select {
+		case dropped := <-c.Write:
+			c.messagesDropped.Add(1)
+			// synchronous writer is waiting for the result
+			if sf, ok := dropped.(*syncFrame); ok {
+				sf.done <- ErrQueueFull
+			}
+		default:
+		}
+		select {
+		case c.Write <- msg:
+			c.wakeWriter()
+			return nil
+		default:
+			c.messagesDropped.Add(1)
+			return ErrQueueFull
+		}
+
+	case SlowConsumerDisconnect:
+		go c.CloseWith(ClosePolicyViolation, "slow consumer")
+		return ErrSlowConsumer
+
+	default:
+		// Blocking sends are bounded by queue size too
+		if c.pendingCount >= cap(c.Write) {
+			go c.CloseWith(ClosePolicyViolation, "slow consumer")
+			return ErrSlowConsumer
+		}
+		prev := c.pending
+		done := make(chan struct{})
+		c.pending = done
+		c.pendingCount++
+		go c.blockingSend(msg, prev, done)
+		return nil
+	}
+}
+
+// Queue the message frames as one entry, fragments are never dropped partially.
+func (c *Connection) enqueueMessage(message []byte, opcode int) error {
+	msg, err := c.buildMessage(message, opcode)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(msg)
+}
+
+// Build the message frames as one send queue entry.
+func (c *Connection) buildMessage(message []byte, opcode int) (Readable, error) {
+	frames, err := buildFrames(message, opcode, c.maxDataSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 1 {
+		return frames[0], nil
+	}
+	return prepareMessage(frames), nil
+}
+
+// Wait for previous blocking send, and queue message with timeout.
+func (c *Connection) blockingSend(msg Readable, prev, done chan struct{}) {
+	defer func() {
+		c.sendMutex.Lock()
+		if c.pending == done {
+			c.pending = nil
+		}
+		c.pendingCount--
+		c.sendMutex.Unlock()
+		close(done)
+	}()
+
+	if prev != nil {
+		<-prev
+	}
+
+	timer := time.NewTimer(c.sendTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.Write <- msg:
+		c.wakeWriter()
+	case <-c.closed:
+		c.messagesDropped.Add(1)
+	case <-timer.C:
+		c.messagesDropped.Add(1)
+		c.CloseWith(ClosePolicyViolation, "slow consumer")
+	}
+}
+
+// Drain send queue and write to socket.
+func (c *Connection) writeLoop() {
+	for {
+		select {
+		case msg := <-c.Write:
+			if err := c.write(msg); err != nil {
+				if c.State() != CLOSING {
+					fmt.Println(err)
+				}
+				c.shutdown()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Start writer on demand ( netpoll mode ).
+// In goroutine mode, writeLoop is always running.
+func (c *Connection) wakeWriter() {
+	if c.poller == nil {
+		return
+	}
+	if c.writing.CompareAndSwap(false, true) {
+		go c.flush()
+	}
+}
+
+// Write all queued messages, and exit when queue is empty.
+func (c *Connection) flush() {
+	for {
+		select {
+		case msg := <-c.Write:
+			if err := c.write(msg); err != nil {
+				c.shutdown()
+				return
+			}
+		case <-c.closed:
+			return
+		default:
+			c.writing.Store(false)
+			// message may be queued after the queue checking
+			if len(c.Write) == 0 || !c.writing.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}
+}
+
+// Write queued message to socket.
+func (c *Connection) write(msg Readable) error {
+	switch m := msg.(type) {
+	// Shared broadcast frame, small frame is copied into the pooled buffer,
+	// large payload is written with header without copying
+	case *preparedFrame:
+		size := m.headerSize + len(m.payload)
+		if size > maxCopySize {
+			return c.writeSocket(m.buffers())
+		}
+		buf := getBuffer(size)
+		defer putBuffer(buf)
+		copy(*buf, m.header[:m.headerSize])
+		copy((*buf)[m.headerSize:], m.payload)
+		return c.writeBytes(*buf)
+
+	// Fragmented message or replayed frames
+	case *frameBatch:
+		return c.writeSocket(m.buffers())
+
+	// Message tracked by the ack tracker
+	case *ackMessage:
+		return c.write(m.Readable)
+
+	// Synchronous frame, notify the result to the sender
+	case *syncFrame:
+		err := c.write(m.Frame)
+		m.done <- err
+		return err
+
+	// Single frame, encode into the pooled buffer
+	case *Frame:
+		buf := getBuffer(m.headerLength() + len(m.PayloadData))
+		defer putBuffer(buf)
+		size := m.encodeTo(*buf)
+		return c.writeBytes((*buf)[:size])
+
+	default:
+		return c.writeBytes(msg.getData())
+	}
+}
+
+// Write bytes to socket.
+func (c *Connection) writeBytes(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.sendTimeout))
+	size, err := c.conn.Write(data)
+	if err != nil {
+		return err
+	}
+	c.bytesSent.Add(int64(size))
+	c.messagesSent.Add(1)
+	c.touch()
+	return nil
+}
+
+// Write buffers to socket.
+// net.Buffers uses writev for TCP connection.
+func (c *Connection) writeSocket(bufs net.Buffers) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.sendTimeout))
+	size, err := bufs.WriteTo(c.conn)
+	if err != nil {
+		return err
+	}
+	c.bytesSent.Add(size)
+	c.messagesSent.Add(1)
+	c.touch()
+	return nil
+}
@@ -0,0 +1,209 @@
+package aun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connection over the pipe, the peer side is returned to read written frames.
+func newPipeConnection(t *testing.T, size int, policy SlowConsumerPolicy, timeout time.Duration) (*Connection, net.Conn) {
+	t.Helper()
+	server, peer := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		peer.Close()
+	})
+	c := NewConnection(server, 1024)
+	c.setSendQueue(size, policy, timeout)
+	c.setState(CONNECTED)
+	return c, peer
+}
+
+func queueText(t *testing.T, c *Connection, message string) error {
+	t.Helper()
+	return c.enqueueMessage([]byte(message), TextFrame)
+}
+
+// Take queued messages without writing.
+func queuedTexts(c *Connection) []string {
+	var texts []string
+	for len(c.Write) > 0 {
+		texts = append(texts, string((<-c.Write).(*Frame).PayloadData))
+	}
+	return texts
+}
+
+// Read a frame written to the peer.
+func readPeerFrame(t *testing.T, peer net.Conn) *Frame {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+	size, err := frameSize(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, make([]byte, size-2)...)
+	if _, err := io.ReadFull(peer, buf[2:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := NewFrame()
+	if err := frame.parse(buf); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// Expect the closing frame with the status code.
+func expectPeerClose(t *testing.T, peer net.Conn, code int) {
+	t.Helper()
+	for {
+		frame := readPeerFrame(t, peer)
+		if frame.Opcode != CloseFrame {
+			continue
+		}
+		if got := int(binary.BigEndian.Uint16(frame.PayloadData)); got != code {
+			t.Fatalf("close code = %d, want %d", got, code)
+		}
+		return
+	}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	c, _ := newPipeConnection(t, 2, SlowConsumerDropNewest, 0)
+	queueText(t, c, "1")
+	queueText(t, c, "2")
+	if err := queueText(t, c, "3"); err != ErrQueueFull {
+		t.Fatalf("err = %v, want ErrQueueFull", err)
+	}
+	if got := queuedTexts(c); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("queued %v, want [1 2]", got)
+	}
+	if dropped := c.Stats().MessagesDropped; dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	c, _ := newPipeConnection(t, 2, SlowConsumerDropOldest, 0)
+	for _, m := range []string{"1", "2", "3"} {
+		if err := queueText(t, c, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := queuedTexts(c); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Fatalf("queued %v, want [2 3]", got)
+	}
+	if dropped := c.Stats().MessagesDropped; dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	c, peer := newPipeConnection(t, 1, SlowConsumerDisconnect, 0)
+	queueText(t, c, "1")
+	if err := queueText(t, c, "2"); err != ErrSlowConsumer {
+		t.Fatalf("err = %v, want ErrSlowConsumer", err)
+	}
+	expectPeerClose(t, peer, ClosePolicyViolation)
+	eventually(t, "connection is not closed", func() bool {
+		return c.State() == CLOSED
+	})
+	if err := queueText(t, c, "3"); err != ErrConnectionClosed {
+		t.Fatalf("err = %v, want ErrConnectionClosed", err)
+	}
+}
+
+func TestQueueBlockKeepsOrder(t *testing.T) {
+	c, _ := newPipeConnection(t, 2, SlowConsumerBlock, time.Minute)
+	for _, m := range []string{"1", "2", "3", "4"} {
+		if err := queueText(t, c, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// waiting sends are queued in order as space is made, and later sends don't overtake
+	var got []string
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-c.Write:
+			got = append(got, string(m.(*Frame).PayloadData))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("blocked send is not queued, received %v", got)
+		}
+	}
+	if got[0] != "1" || got[1] != "2" || got[2] != "3" || got[3] != "4" {
+		t.Fatalf("received %v, want [1 2 3 4]", got)
+	}
+}
+
+func TestQueueBlockTimeout(t *testing.T) {
+	c, peer := newPipeConnection(t, 1, SlowConsumerBlock, 50*time.Millisecond)
+	queueText(t, c, "1")
+	if err := queueText(t, c, "2"); err != nil {
+		t.Fatalf("blocking send failed immediately: %v", err)
+	}
+	expectPeerClose(t, peer, ClosePolicyViolation)
+	eventually(t, "timed out send is not dropped", func() bool {
+		return c.Stats().MessagesDropped == 1
+	})
+}
+
+func TestQueueBlockLimit(t *testing.T) {
+	c, peer := newPipeConnection(t, 1, SlowConsumerBlock, time.Minute)
+	queueText(t, c, "1")
+	// one waiting send per queue slot
+	if err := queueText(t, c, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueText(t, c, "3"); err != ErrSlowConsumer {
+		t.Fatalf("err = %v, want ErrSlowConsumer", err)
+	}
+	expectPeerClose(t, peer, ClosePolicyViolation)
+}
+
+func TestWriterSendsInOrder(t *testing.T) {
+	c, peer := newPipeConnection(t, 4, SlowConsumerBlock, time.Minute)
+	go c.writeLoop()
+	defer c.shutdown()
+
+	for _, m := range []string{"1", "2", "3"} {
+		queueText(t, c, m)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if frame := readPeerFrame(t, peer); string(frame.PayloadData) != want {
+			t.Fatalf("written %q, want %q", frame.PayloadData, want)
+		}
+	}
+	eventually(t, "written messages are not counted", func() bool {
+		return c.Stats().MessagesSent == 3
+	})
+}
+
+func TestCloseAfterFlush(t *testing.T) {
+	c, peer := newPipeConnection(t, 4, SlowConsumerBlock, time.Minute)
+	go c.writeLoop()
+
+	queueText(t, c, "1")
+	queueText(t, c, "2")
+	closed := make(chan struct{})
+	go func() {
+		c.CloseAfterFlush(CloseNormalClosure, "")
+		close(closed)
+	}()
+	// the closing frame follows the queued messages
+	for _, want := range []string{"1", "2"} {
+		if frame := readPeerFrame(t, peer); string(frame.PayloadData) != want {
+			t.Fatalf("written %q, want %q", frame.PayloadData, want)
+		}
+	}
+	expectPeerClose(t, peer, CloseNormalClosure)
+	<-closed
+	if c.State() != CLOSED {
+		t.Fatal("connection is not closed")
+	}
+}
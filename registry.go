@@ -0,0 +1,111 @@
+package aun
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of registry shards.
+// Connections are spread over shards by ID hash to reduce lock contention.
+const registryShards = 32
+
+// Single registry shard guarded by its own lock.
+type registryShard struct {
+	mutex sync.RWMutex
+	conns map[string]*Connection
+}
+
+// Concurrency-safe connection registry, keyed by Connection.Id.
+type registry struct {
+	shards [registryShards]*registryShard
+	count  atomic.Int64
+}
+
+// Create new registry.
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{
+			conns: make(map[string]*Connection),
+		}
+	}
+	return r
+}
+
+// Find the shard for connection ID.
+func (r *registry) shard(id string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return r.shards[h.Sum32()%registryShards]
+}
+
+// Add connection. Returns false if the ID is already registered.
+func (r *registry) add(c *Connection) bool {
+	shard := r.shard(c.Id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, ok := shard.conns[c.Id]; ok {
+		return false
+	}
+	shard.conns[c.Id] = c
+	r.count.Add(1)
+	return true
+}
+
+// Remove connection. Returns false if the connection is not registered.
+func (r *registry) remove(c *Connection) bool {
+	shard := r.shard(c.Id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	// Another connection may own the same ID, remove only the same pointer
+	if registered, ok := shard.conns[c.Id]; !ok || registered != c {
+		return false
+	}
+	delete(shard.conns, c.Id)
+	r.count.Add(-1)
+	return true
+}
+
+// Find connection by ID.
+func (r *registry) get(id string) (*Connection, bool) {
+	shard := r.shard(id)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	c, ok := shard.conns[id]
+	return c, ok
+}
+
+// Check connection is registered.
+func (r *registry) has(c *Connection) bool {
+	registered, ok := r.get(c.Id)
+	return ok && registered == c
+}
+
+// Number of registered connections.
+func (r *registry) len() int {
+	return int(r.count.Load())
+}
+
+// Iterate all connections until fn returns false.
+// Each shard is copied under its lock and fn is called without holding any lock.
+func (r *registry) each(fn func(*Connection) bool) {
+	var conns []*Connection
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		conns = conns[:0]
+		for _, c := range shard.conns {
+			conns = append(conns, c)
+		}
+		shard.mutex.RUnlock()
+
+		for _, c := range conns {
+			if !fn(c) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package aun
+
+import (
+	"sync"
+	"testing"
+)
+
+func newRegistryConnection() *Connection {
+	c := NewConnection(discardConn{}, 16)
+	c.setSendQueue(1, SlowConsumerDropNewest, 0)
+	c.setState(CONNECTED)
+	return c
+}
+
+func TestRegistryConcurrentJoinLeaveBroadcast(t *testing.T) {
+	s := &Server{connections: newRegistry()}
+	frame, _ := BuildSingleFrame([]byte("message"), 1, TextFrame)
+
+	const workers, rounds = 8, 200
+	stable := make([]*Connection, workers)
+	for i := range stable {
+		stable[i] = newRegistryConnection()
+		s.connections.add(stable[i])
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(3)
+		// join and leave
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				c := newRegistryConnection()
+				if !s.connections.add(c) {
+					t.Error("new connection is not added")
+					return
+				}
+				if !s.connections.has(c) {
+					t.Error("added connection is not found")
+				}
+				if !s.connections.remove(c) {
+					t.Error("added connection is not removed")
+				}
+			}
+		}()
+		// broadcast
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				s.deliver(frame, s.connections.each)
+			}
+		}()
+		// send to a connection
+		go func(c *Connection) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				s.NotifyTo([]byte("direct"), c)
+				<-c.Write
+			}
+		}(stable[i])
+	}
+	wg.Wait()
+
+	if n := s.ConnectionCount(); n != workers {
+		t.Fatalf("connection count = %d, want %d", n, workers)
+	}
+	seen := 0
+	s.connections.each(func(c *Connection) bool {
+		seen++
+		return true
+	})
+	if seen != workers {
+		t.Fatalf("iterated %d connections, want %d", seen, workers)
+	}
+}
+
+func TestRegistryRemoveKeepsOtherOwner(t *testing.T) {
+	r := newRegistry()
+	a := newRegistryConnection()
+	b := newRegistryConnection()
+	b.Id = a.Id
+
+	r.add(a)
+	if r.add(b) {
+		t.Fatal("duplicate ID is added")
+	}
+	if r.remove(b) {
+		t.Fatal("connection with the same ID removed the owner")
+	}
+	if !r.has(a) || r.has(b) {
+		t.Fatal("registered owner is changed")
+	}
+}
+
+func TestRegistryShardDistribution(t *testing.T) {
+	r := newRegistry()
+	const perShard = 100
+	for i := 0; i < registryShards*perShard; i++ {
+		r.add(NewConnection(discardConn{}, 16))
+	}
+	if n := r.len(); n != registryShards*perShard {
+		t.Fatalf("len = %d, want %d", n, registryShards*perShard)
+	}
+	for i, shard := range r.shards {
+		if n := len(shard.conns); n < perShard/2 || n > perShard*2 {
+			t.Fatalf("shard %d has %d connections, want around %d", i, n, perShard)
+		}
+	}
+}
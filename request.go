@@ -3,6 +3,7 @@ package aun
 import (
 	"encoding/base64"
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -12,9 +13,12 @@ type Request struct {
 	// Request method ( always Shoud be "GET" )
 	Method string
 
-	// Request path
+	// Request path without query string
 	Path string
 
+	// Query string without "?"
+	RawQuery string
+
 	// HTTP Version ( must be greater than equal 1.1 )
 	Version string
 
@@ -41,12 +45,40 @@ func NewRequest(message string) *Request {
 		headers[spl[0]] = spl[1]
 	}
 
+	path, query, _ := strings.Cut(parts[1], "?")
+
 	return &Request{
-		Method:  parts[0],
-		Path:    parts[1],
-		Version: parts[2],
-		Headers: headers,
+		Method:   parts[0],
+		Path:     path,
+		RawQuery: query,
+		Version:  parts[2],
+		Headers:  headers,
+	}
+}
+
+// Get request path with query string
+func (r *Request) URI() string {
+	if r.RawQuery == "" {
+		return r.Path
+	}
+	return r.Path + "?" + r.RawQuery
+}
+
+// Get parsed query parameters
+func (r *Request) Query() url.Values {
+	values, _ := url.ParseQuery(r.RawQuery)
+	return values
+}
+
+// Get subprotocols offered by the client in preference order
+func (r *Request) Subprotocols() []string {
+	var protocols []string
+	for _, p := range strings.Split(r.Header("Sec-WebSocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
 	}
+	return protocols
 }
 
 // Check reuqest header has
@@ -0,0 +1,40 @@
+package aun
+
+import "testing"
+
+func TestNewRequestSplitsQuery(t *testing.T) {
+	for _, tt := range []struct {
+		line, path, query string
+	}{
+		{"GET /chat HTTP/1.1", "/chat", ""},
+		{"GET /chat?room=1&since=5 HTTP/1.1", "/chat", "room=1&since=5"},
+		{"GET /?a=b?c HTTP/1.1", "/", "a=b?c"},
+	} {
+		req := NewRequest(tt.line + "\r\nHost: example.com")
+		if req.Path != tt.path || req.RawQuery != tt.query {
+			t.Fatalf("%s: path = %q, query = %q", tt.line, req.Path, req.RawQuery)
+		}
+		if uri := req.URI(); uri != tt.line[4:len(tt.line)-9] {
+			t.Fatalf("%s: URI = %q", tt.line, uri)
+		}
+	}
+	req := NewRequest("GET /chat?room=1&since=5 HTTP/1.1\r\nHost: example.com")
+	if req.Query().Get("room") != "1" || req.Header("Host") != "example.com" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if seq, ok := req.replaySince(); !ok || seq != 5 {
+		t.Fatalf("replay since = %d, %v", seq, ok)
+	}
+}
+
+func TestRequestPathSameOnBothServers(t *testing.T) {
+	for _, mode := range testServerModes[:2] {
+		t.Run(mode.name, func(t *testing.T) {
+			_, url, connected := mode.start(t, nil)
+			_, c := dialTest(t, url+"/chat/room?x=1", connected)
+			if c.Request.Path != "/chat/room" || c.Request.RawQuery != "x=1" {
+				t.Fatalf("path = %q, query = %q", c.Request.Path, c.Request.RawQuery)
+			}
+		})
+	}
+}
@@ -11,6 +11,9 @@ import (
 type Response struct {
 	Readable
 	req *Request
+
+	// Additional headers in order
+	headers []string
 }
 
 // Create new response
@@ -33,10 +36,16 @@ func (r *Response) Headers() []byte {
 		"Connection: Upgrade",
 		fmt.Sprintf("Sec-WebSocket-Accept: %s", r.genAcceptKey()),
 	}
+	buffer = append(buffer, r.headers...)
 
 	return []byte(strings.Join(buffer, "\r\n") + "\r\n\r\n")
 }
 
+// Add response header
+func (r *Response) SetHeader(key, value string) {
+	r.headers = append(r.headers, fmt.Sprintf("%s: %s", key, value))
+}
+
 // Calcualte webosket accept key string
 func (r *Response) genAcceptKey() string {
 	key := strings.TrimSpace(r.req.Header("Sec-WebSocket-Key"))
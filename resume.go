@@ -0,0 +1,199 @@
+package aun
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Header and query parameter name of the session resumption token
+const (
+	ResumeHeader = "Aun-Resume-Token"
+	ResumeQuery  = "resume"
+)
+
+// Closed connection state kept for resumption.
+type session struct {
+	token  string
+	id     string
+	userId string
+	meta   map[string]interface{}
+
+	// Joined topics per hub
+	topics map[*Hub][]string
+
+	// Tracked topics and metadata per presence
+	tracked map[*Presence]map[string]interface{}
+
+	// Messages left in the send queue
+	pending []Readable
+
+	// Unacked messages
+	acks *ackTracker
+
+	// Discard timer
+	timer *time.Timer
+}
+
+// Closed sessions by resume token.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+// Create new session store.
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*session),
+	}
+}
+
+// Keep the session until window is passed.
+func (s *sessionStore) put(sess *session, window time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[sess.token] = sess
+	sess.timer = time.AfterFunc(window, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.sessions[sess.token] == sess {
+			delete(s.sessions, sess.token)
+			if sess.acks != nil {
+				sess.acks.close(ErrConnectionClosed)
+			}
+		}
+	})
+}
+
+// Take out the session of the user. Token is usable only once.
+// Session of the identified user can't be taken by another user or anonymous connection,
+// and it is kept for the right user.
+func (s *sessionStore) take(token, userId string) (*session, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok || (sess.userId != "" && sess.userId != userId) {
+		return nil, false
+	}
+	sess.timer.Stop()
+	delete(s.sessions, token)
+	return sess, true
+}
+
+// Restore the session on handshake, and issue the new resume token.
+// Called before the connection joins to the server.
+func (s *Server) resume(c *Connection, req *Request, response *Response) {
+	token := req.Header(ResumeHeader)
+	if token == "" {
+		token = req.Query().Get(ResumeQuery)
+	}
+	if token != "" {
+		if sess, ok := s.sessions.take(token, c.UserId); ok {
+			c.Id = sess.id
+			c.meta = sess.meta
+			c.resumed = sess
+		}
+	}
+
+	c.resumeToken = generateSessionId()
+	response.SetHeader(ResumeHeader, c.resumeToken)
+}
+
+// Keep the closed connection state for resumption.
+// Called on server loop before leave hooks remove topic memberships.
+// Returns false if resumption is disabled.
+func (s *Server) suspend(c *Connection) bool {
+	if s.Resume <= 0 || c.resumeToken == "" {
+		return false
+	}
+
+	c.metaMutex.RLock()
+	meta := make(map[string]interface{}, len(c.meta))
+	for k, v := range c.meta {
+		meta[k] = v
+	}
+	c.metaMutex.RUnlock()
+
+	sess := &session{
+		token:   c.resumeToken,
+		id:      c.Id,
+		userId:  c.UserId,
+		meta:    meta,
+		topics:  make(map[*Hub][]string),
+		tracked: make(map[*Presence]map[string]interface{}),
+		acks:    c.acks,
+	}
+	for _, hub := range s.hubList() {
+		if topics := hub.Topics(c); len(topics) > 0 {
+			sess.topics[hub] = topics
+		}
+		for _, p := range hub.presenceList() {
+			if tracked := p.tracked(c); len(tracked) > 0 {
+				sess.tracked[p] = tracked
+			}
+		}
+	}
+
+	// writer is stopped, remaining messages are undelivered.
+	// Unacked messages are resent by the ack tracker instead.
+DRAIN:
+	for {
+		select {
+		case msg := <-c.Write:
+			if _, ok := msg.(*ackMessage); !ok {
+				sess.pending = append(sess.pending, msg)
+			}
+		default:
+			break DRAIN
+		}
+	}
+
+	s.sessions.put(sess, s.Resume)
+	return true
+}
+
+// Restore queued messages, topic memberships and presence of the resumed session.
+// Must be called with fanout lock, before the connection is registered.
+func (s *Server) restore(c *Connection) {
+	sess := c.resumed
+	if sess == nil {
+		return
+	}
+	c.resumed = nil
+
+	if len(sess.pending) > 0 {
+		c.enqueue(&frameBatch{frames: sess.pending})
+	}
+	if sess.acks != nil {
+		c.acks = sess.acks
+		c.acks.attach(c)
+	}
+	for hub, topics := range sess.topics {
+		for _, topic := range topics {
+			hub.add(c, topic)
+		}
+	}
+	for p, tracked := range sess.tracked {
+		for topic, meta := range tracked {
+			p.restore(c, topic, meta)
+		}
+	}
+}
+
+// Register hub to keep memberships on resumption.
+func (s *Server) addHub(hub *Hub) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	hub.channel = hubChannel + strconv.Itoa(len(s.hubs))
+	s.hubs = append(s.hubs, hub)
+}
+
+// Get registered hubs.
+func (s *Server) hubList() []*Hub {
+	s.hooksMutex.RLock()
+	defer s.hooksMutex.RUnlock()
+	return s.hubs
+}
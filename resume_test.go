@@ -0,0 +1,57 @@
+package aun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionTakeRequiresSameUser(t *testing.T) {
+	store := newSessionStore()
+	store.put(&session{token: "t1", userId: "alice"}, time.Minute)
+	store.put(&session{token: "t2"}, time.Minute)
+
+	if _, ok := store.take("t1", ""); ok {
+		t.Fatal("anonymous connection took the user session")
+	}
+	if _, ok := store.take("t1", "bob"); ok {
+		t.Fatal("another user took the session")
+	}
+	// session is kept for the right user
+	if _, ok := store.take("t1", "alice"); !ok {
+		t.Fatal("session is consumed by rejected attempts")
+	}
+	if _, ok := store.take("t1", "alice"); ok {
+		t.Fatal("token is used twice")
+	}
+
+	if _, ok := store.take("t2", "carol"); !ok {
+		t.Fatal("anonymous session is not resumable")
+	}
+}
+
+func TestSuspendSkipsAckMessages(t *testing.T) {
+	s := &Server{Resume: time.Minute, sessions: newSessionStore()}
+	c := NewConnection(discardConn{}, 1024)
+	c.setState(CONNECTED)
+	c.resumeToken = "token"
+	c.acks = newAckTracker(c, nil)
+
+	c.Send([]byte("plain"))
+	c.acks.send(TextFrame, []byte("acked"))
+	if len(c.Write) != 2 {
+		t.Fatalf("queued %d, want 2", len(c.Write))
+	}
+	c.setState(CLOSED)
+	if !s.suspend(c) {
+		t.Fatal("session is not suspended")
+	}
+
+	sess, ok := s.sessions.take("token", "")
+	if !ok {
+		t.Fatal("session is not stored")
+	}
+	if len(sess.pending) != 1 {
+		t.Fatalf("pending %d, want 1 ( acked message is resent by the tracker )", len(sess.pending))
+	}
+	sess.acks.close(ErrConnectionClosed)
+}
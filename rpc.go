@@ -0,0 +1,326 @@
+package aun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RPC error codes
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	RPCServerError    = -32000
+)
+
+// RPC message types
+const (
+	rpcCall   = "call"
+	rpcResult = "result"
+	rpcError  = "error"
+	rpcCancel = "cancel"
+)
+
+// Error returned by the remote method.
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Error interface implement.
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// RPC method handler.
+// Context is cancelled on timeout, cancel from the caller, or connection close.
+type RPCHandler func(ctx context.Context, conn *Connection, params json.RawMessage) (interface{}, error)
+
+// RPC message on the connection, the type field name is reserved:
+//
+//	{"aun.rpc": "call", "id": "1", "method": "add", "params": [1, 2]}
+//	{"aun.rpc": "result", "id": "1", "result": 3}
+//	{"aun.rpc": "error", "id": "1", "error": {"code": -32601, "message": "Method not found"}}
+//	{"aun.rpc": "cancel", "id": "1"}
+type rpcMessage struct {
+	Rpc    string          `json:"aun.rpc"`
+	Id     string          `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+// Call waiting for the response.
+type pendingCall struct {
+	conn  *Connection
+	reply chan *rpcMessage
+}
+
+// Request/response RPC between the server and clients.
+// Both sides can call methods, and responses are matched by correlation ID.
+type RPC struct {
+	server *Server
+
+	// Timeout of calls and handlers without deadline ( default 30s )
+	Timeout time.Duration
+
+	// Max running handlers per connection, unlimited if zero ( default 64 )
+	MaxConcurrent int
+
+	mutex   sync.Mutex
+	methods map[string]RPCHandler
+
+	// Calls to clients by ID
+	calls  map[string]*pendingCall
+	nextId atomic.Uint64
+
+	// Running handlers by connection and call ID
+	serving map[*Connection]map[string]context.CancelFunc
+}
+
+// Enable RPC on the server.
+// RPC messages are consumed before OnMessage and broadcasting.
+func NewRPC(s *Server) *RPC {
+	r := &RPC{
+		server:        s,
+		Timeout:       30 * time.Second,
+		MaxConcurrent: 64,
+		methods:       make(map[string]RPCHandler),
+		calls:         make(map[string]*pendingCall),
+		serving:       make(map[*Connection]map[string]context.CancelFunc),
+	}
+	s.hooksMutex.Lock()
+	s.rpc = r
+	s.hooksMutex.Unlock()
+
+	s.addMessageHook(r.handle)
+	s.addLeaveHook(r.leave)
+	return r
+}
+
+// Register method callable from clients.
+func (r *RPC) Register(method string, handler RPCHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.methods[method] = handler
+}
+
+// Call the client method, and wait for the result.
+func (r *RPC) Call(ctx context.Context, conn *Connection, method string, params interface{}) (json.RawMessage, error) {
+	var raw json.RawMessage
+	if params != nil {
+		var err error
+		if raw, err = json.Marshal(params); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := ctx.Deadline(); !ok && r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	id := strconv.FormatUint(r.nextId.Add(1), 10)
+	call := &pendingCall{conn: conn, reply: make(chan *rpcMessage, 1)}
+	r.mutex.Lock()
+	r.calls[id] = call
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.calls, id)
+		r.mutex.Unlock()
+	}()
+
+	// leave hook may have run before the call is registered
+	if conn.State() == CLOSED {
+		return nil, ErrConnectionClosed
+	}
+	if err := r.send(conn, &rpcMessage{Rpc: rpcCall, Id: id, Method: method, Params: raw}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-call.reply:
+		if reply == nil {
+			return nil, ErrConnectionClosed
+		}
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		return reply.Result, nil
+	case <-ctx.Done():
+		r.send(conn, &rpcMessage{Rpc: rpcCancel, Id: id})
+		return nil, ctx.Err()
+	}
+}
+
+// Message hook to handle RPC messages.
+// Application messages without the reserved field are passed through.
+func (r *RPC) handle(c *Connection, frame *Frame) bool {
+	payload := bytes.TrimSpace(frame.PayloadData)
+	if frame.Opcode != TextFrame || len(payload) == 0 || payload[0] != '{' || !bytes.Contains(payload, []byte(`"aun.rpc"`)) {
+		return false
+	}
+	m := &rpcMessage{}
+	if err := json.Unmarshal(payload, m); err != nil || m.Rpc == "" {
+		return false
+	}
+
+	switch m.Rpc {
+	case rpcCall:
+		r.serve(c, m)
+	case rpcCancel:
+		r.mutex.Lock()
+		if cancel, ok := r.serving[c][m.Id]; ok {
+			cancel()
+		}
+		r.mutex.Unlock()
+	case rpcResult, rpcError:
+		r.mutex.Lock()
+		call, ok := r.calls[m.Id]
+		r.mutex.Unlock()
+		if ok && call.conn == c {
+			select {
+			case call.reply <- m:
+			default:
+			}
+		}
+	default:
+		r.send(c, &rpcMessage{Rpc: rpcError, Id: m.Id, Error: &RPCError{Code: RPCInvalidRequest, Message: "Invalid request"}})
+	}
+	return true
+}
+
+// Run the method handler on its own goroutine, so cancel can be received.
+// Call ID must be unique in the running calls of the connection.
+func (r *RPC) serve(c *Connection, m *rpcMessage) {
+	r.mutex.Lock()
+	// leave hook may have run before the handler is registered,
+	// the connection state is changed before it
+	if c.State() == CLOSED {
+		r.mutex.Unlock()
+		return
+	}
+	handler, ok := r.methods[m.Method]
+	if !ok {
+		r.mutex.Unlock()
+		r.send(c, &rpcMessage{Rpc: rpcError, Id: m.Id, Error: &RPCError{Code: RPCMethodNotFound, Message: "Method not found"}})
+		return
+	}
+	if _, running := r.serving[c][m.Id]; running {
+		r.mutex.Unlock()
+		r.send(c, &rpcMessage{Rpc: rpcError, Id: m.Id, Error: &RPCError{Code: RPCInvalidRequest, Message: "Duplicate call ID"}})
+		return
+	}
+	if r.MaxConcurrent > 0 && len(r.serving[c]) >= r.MaxConcurrent {
+		r.mutex.Unlock()
+		r.send(c, &rpcMessage{Rpc: rpcError, Id: m.Id, Error: &RPCError{Code: RPCServerError, Message: "Too many concurrent calls"}})
+		return
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if r.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), r.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	if r.serving[c] == nil {
+		r.serving[c] = make(map[string]context.CancelFunc)
+	}
+	r.serving[c][m.Id] = cancel
+	r.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			r.mutex.Lock()
+			delete(r.serving[c], m.Id)
+			if len(r.serving[c]) == 0 {
+				delete(r.serving, c)
+			}
+			r.mutex.Unlock()
+			cancel()
+		}()
+
+		result, err := r.invoke(ctx, handler, c, m.Params)
+		if ctx.Err() != nil && err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			rpcErr, ok := err.(*RPCError)
+			if !ok {
+				rpcErr = &RPCError{Code: RPCServerError, Message: err.Error()}
+			}
+			r.send(c, &rpcMessage{Rpc: rpcError, Id: m.Id, Error: rpcErr})
+			return
+		}
+		raw, err := json.Marshal(result)
+		if err != nil {
+			r.send(c, &rpcMessage{Rpc: rpcError, Id: m.Id, Error: &RPCError{Code: RPCInternalError, Message: err.Error()}})
+			return
+		}
+		r.send(c, &rpcMessage{Rpc: rpcResult, Id: m.Id, Result: raw})
+	}()
+}
+
+// Run the handler, panic is reported and returned as internal error.
+func (r *RPC) invoke(ctx context.Context, handler RPCHandler, c *Connection, params json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			r.server.handleError(c, fmt.Errorf("RPC handler panic: %v", rec))
+			result, err = nil, &RPCError{Code: RPCInternalError, Message: "Internal error"}
+		}
+	}()
+	return handler(ctx, c, params)
+}
+
+// Send RPC message to the connection.
+func (r *RPC) send(c *Connection, m *rpcMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.enqueueMessage(data, TextFrame)
+}
+
+// Server leave hook, fail calls and cancel handlers of the closed connection.
+func (r *RPC) leave(c *Connection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, call := range r.calls {
+		if call.conn == c {
+			select {
+			case call.reply <- nil:
+			default:
+			}
+		}
+	}
+	for _, cancel := range r.serving[c] {
+		cancel()
+	}
+}
+
+// Call the client method through the server RPC, and wait for the result.
+func (c *Connection) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if c.server == nil {
+		return nil, errors.New("RPC is not enabled")
+	}
+	c.server.hooksMutex.RLock()
+	r := c.server.rpc
+	c.server.hooksMutex.RUnlock()
+	if r == nil {
+		return nil, errors.New("RPC is not enabled")
+	}
+	return r.Call(ctx, c, method, params)
+}
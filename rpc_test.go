@@ -0,0 +1,115 @@
+package aun
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Read queued RPC messages of the connection.
+func readRPC(t *testing.T, c *Connection) *rpcMessage {
+	t.Helper()
+	m := &rpcMessage{}
+	if err := json.Unmarshal((<-c.Write).(*Frame).PayloadData, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRPCRejectsDuplicateAndExcessCalls(t *testing.T) {
+	r := NewRPC(&Server{})
+	r.MaxConcurrent = 2
+	release := make(chan struct{})
+	r.Register("wait", func(ctx context.Context, conn *Connection, params json.RawMessage) (interface{}, error) {
+		<-release
+		return "done", nil
+	})
+	c := NewConnection(discardConn{}, 1024)
+	c.setState(CONNECTED)
+
+	call := func(id string) {
+		frame, _ := BuildSingleFrame([]byte(`{"aun.rpc":"call","id":"`+id+`","method":"wait"}`), 1, TextFrame)
+		if !r.handle(c, frame) {
+			t.Fatal("call is not consumed")
+		}
+	}
+	call("1")
+	call("1")
+	if m := readRPC(t, c); m.Id != "1" || m.Error == nil || m.Error.Code != RPCInvalidRequest {
+		t.Fatalf("duplicate call is not rejected: %+v", m)
+	}
+	call("2")
+	call("3")
+	if m := readRPC(t, c); m.Id != "3" || m.Error == nil || m.Error.Code != RPCServerError {
+		t.Fatalf("call over the limit is not rejected: %+v", m)
+	}
+
+	close(release)
+	results := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		m := readRPC(t, c)
+		if m.Rpc != rpcResult {
+			t.Fatalf("unexpected reply %+v", m)
+		}
+		results[m.Id] = true
+	}
+	if !results["1"] || !results["2"] {
+		t.Fatalf("results of running calls = %v", results)
+	}
+}
+
+func TestRPCKeepsApplicationMessages(t *testing.T) {
+	r := NewRPC(&Server{})
+	c := NewConnection(discardConn{}, 1024)
+	c.setState(CONNECTED)
+
+	for _, message := range []string{`{"rpc":"call","id":"1","method":"x"}`, `{"type":"rpc"}`} {
+		frame, _ := BuildSingleFrame([]byte(message), 1, TextFrame)
+		if r.handle(c, frame) {
+			t.Fatalf("application message %s is consumed", message)
+		}
+	}
+}
+
+func TestRPCCancelsHandlersOnLeave(t *testing.T) {
+	r := NewRPC(&Server{})
+	r.Timeout = time.Minute
+	cancelled := make(chan struct{})
+	started := make(chan struct{}, 1)
+	r.Register("wait", func(ctx context.Context, conn *Connection, params json.RawMessage) (interface{}, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	c := NewConnection(discardConn{}, 1024)
+	c.setState(CONNECTED)
+	call := func() {
+		frame, _ := BuildSingleFrame([]byte(`{"aun.rpc":"call","id":"1","method":"wait"}`), 1, TextFrame)
+		r.handle(c, frame)
+	}
+
+	call()
+	<-started
+	c.setState(CLOSED)
+	r.leave(c)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("running handler is not cancelled")
+	}
+
+	// call handled after leaving is not run
+	call()
+	select {
+	case <-started:
+		t.Fatal("handler is run for the closed connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.serving) != 0 {
+		t.Fatalf("handlers are kept for the closed connection: %v", r.serving)
+	}
+}
@@ -0,0 +1,403 @@
+package aun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Compiled JSON Schema of the practical subset:
+//
+//	type, enum, const,
+//	properties, required, additionalProperties, minProperties, maxProperties,
+//	items, minItems, maxItems,
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+//	minLength, maxLength, pattern
+//
+// Other keywords are ignored. Patterns are Go regular expressions ( RE2 syntax ).
+type Schema struct {
+	types []string
+	enum  []interface{}
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	noAdditional         bool
+	minProperties        *int
+	maxProperties        *int
+
+	items    *Schema
+	minItems *int
+	maxItems *int
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	// multipleOf as exact decimal
+	divisor *big.Rat
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+}
+
+// JSON Schema document representation for decoding.
+type schemaDocument struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []interface{}              `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	MinProperties        *int                       `json:"minProperties"`
+	MaxProperties        *int                       `json:"maxProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	ExclusiveMinimum     *float64                   `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64                   `json:"exclusiveMaximum"`
+	MultipleOf           *float64                   `json:"multipleOf"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              *string                    `json:"pattern"`
+}
+
+// JSON Schema type names
+var schemaTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"integer": true,
+	"number":  true,
+	"string":  true,
+	"array":   true,
+	"object":  true,
+}
+
+// Schema violation of the value at the path ( JSON Pointer ).
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// error interface implement.
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Maximum number of violations reported by Validate()
+const maxValidationErrors = 16
+
+// Compile JSON Schema document.
+func CompileSchema(data []byte) (*Schema, error) {
+	return compileSchema(data, 0)
+}
+
+// Compile schema with nesting depth.
+func compileSchema(data []byte, depth int) (*Schema, error) {
+	if depth > maxCodecDepth {
+		return nil, errors.New("Schema is too deeply nested")
+	}
+
+	data = []byte(strings.TrimSpace(string(data)))
+	// boolean schema
+	switch string(data) {
+	case "true":
+		return &Schema{}, nil
+	case "false":
+		return &Schema{enum: []interface{}{}}, nil
+	}
+
+	doc := &schemaDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("Invalid schema: %w", err)
+	}
+
+	sc := &Schema{
+		enum:          doc.Enum,
+		required:      doc.Required,
+		minProperties: doc.MinProperties,
+		maxProperties: doc.MaxProperties,
+		minItems:      doc.MinItems,
+		maxItems:      doc.MaxItems,
+		minimum:       doc.Minimum,
+		maximum:       doc.Maximum,
+		multipleOf:    doc.MultipleOf,
+		minLength:     doc.MinLength,
+		maxLength:     doc.MaxLength,
+
+		exclusiveMinimum: doc.ExclusiveMinimum,
+		exclusiveMaximum: doc.ExclusiveMaximum,
+	}
+
+	if len(doc.Type) > 0 {
+		if doc.Type[0] == '[' {
+			if err := json.Unmarshal(doc.Type, &sc.types); err != nil {
+				return nil, fmt.Errorf("Invalid schema type: %w", err)
+			}
+		} else {
+			var t string
+			if err := json.Unmarshal(doc.Type, &t); err != nil {
+				return nil, fmt.Errorf("Invalid schema type: %w", err)
+			}
+			sc.types = []string{t}
+		}
+		for _, t := range sc.types {
+			if !schemaTypes[t] {
+				return nil, fmt.Errorf("Unknown schema type %q", t)
+			}
+		}
+	}
+
+	if len(doc.Const) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(doc.Const, &v); err != nil {
+			return nil, err
+		}
+		sc.enum = []interface{}{v}
+	}
+
+	if len(doc.Properties) > 0 {
+		sc.properties = make(map[string]*Schema, len(doc.Properties))
+		for name, raw := range doc.Properties {
+			prop, err := compileSchema(raw, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			sc.properties[name] = prop
+		}
+	}
+
+	switch strings.TrimSpace(string(doc.AdditionalProperties)) {
+	case "", "true":
+	case "false":
+		sc.noAdditional = true
+	default:
+		additional, err := compileSchema(doc.AdditionalProperties, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		sc.additionalProperties = additional
+	}
+
+	if len(doc.Items) > 0 {
+		items, err := compileSchema(doc.Items, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		sc.items = items
+	}
+
+	if doc.Pattern != nil {
+		pattern, err := regexp.Compile(*doc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schema pattern: %w", err)
+		}
+		sc.pattern = pattern
+	}
+
+	if sc.multipleOf != nil {
+		if *sc.multipleOf <= 0 {
+			return nil, errors.New("multipleOf must be greater than 0")
+		}
+		sc.divisor = decimalRat(*sc.multipleOf)
+	}
+	return sc, nil
+}
+
+// Compile JSON Schema document, panics on error.
+func MustCompileSchema(data string) *Schema {
+	sc, err := CompileSchema([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+	return sc
+}
+
+// Validate the decoded JSON value ( result of json.Unmarshal into interface{} ).
+// Returns violations up to 16, or nil if valid.
+func (sc *Schema) Validate(v interface{}) []ValidationError {
+	var errs []ValidationError
+	sc.validate(v, "", &errs)
+	return errs
+}
+
+// Validate the value and collect violations.
+func (sc *Schema) validate(v interface{}, path string, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = appendLimited(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(sc.types) > 0 && !sc.matchType(v) {
+		fail("expected %s, got %s", strings.Join(sc.types, " or "), jsonType(v))
+		return
+	}
+
+	if sc.enum != nil {
+		found := false
+		for _, e := range sc.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not allowed")
+		}
+	}
+
+	switch value := v.(type) {
+	case float64:
+		if sc.minimum != nil && value < *sc.minimum {
+			fail("must be >= %v", *sc.minimum)
+		}
+		if sc.maximum != nil && value > *sc.maximum {
+			fail("must be <= %v", *sc.maximum)
+		}
+		if sc.exclusiveMinimum != nil && value <= *sc.exclusiveMinimum {
+			fail("must be > %v", *sc.exclusiveMinimum)
+		}
+		if sc.exclusiveMaximum != nil && value >= *sc.exclusiveMaximum {
+			fail("must be < %v", *sc.exclusiveMaximum)
+		}
+		if sc.divisor != nil {
+			// float division rejects 0.3 for 0.1, compare the decimals as written in JSON
+			if r := decimalRat(value); r == nil || !r.Quo(r, sc.divisor).IsInt() {
+				fail("must be multiple of %v", *sc.multipleOf)
+			}
+		}
+
+	case string:
+		length := utf8.RuneCountInString(value)
+		if sc.minLength != nil && length < *sc.minLength {
+			fail("length must be >= %d", *sc.minLength)
+		}
+		if sc.maxLength != nil && length > *sc.maxLength {
+			fail("length must be <= %d", *sc.maxLength)
+		}
+		if sc.pattern != nil && !sc.pattern.MatchString(value) {
+			fail("must match pattern %s", sc.pattern)
+		}
+
+	case []interface{}:
+		if sc.minItems != nil && len(value) < *sc.minItems {
+			fail("must have at least %d items", *sc.minItems)
+		}
+		if sc.maxItems != nil && len(value) > *sc.maxItems {
+			fail("must have at most %d items", *sc.maxItems)
+		}
+		if sc.items != nil {
+			for i, item := range value {
+				sc.items.validate(item, path+"/"+strconv.Itoa(i), errs)
+			}
+		}
+
+	case map[string]interface{}:
+		if sc.minProperties != nil && len(value) < *sc.minProperties {
+			fail("must have at least %d properties", *sc.minProperties)
+		}
+		if sc.maxProperties != nil && len(value) > *sc.maxProperties {
+			fail("must have at most %d properties", *sc.maxProperties)
+		}
+		for _, name := range sc.required {
+			if _, ok := value[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+
+		// sort keys for the stable error order
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propPath := path + "/" + escapePointer(key)
+			if prop, ok := sc.properties[key]; ok {
+				prop.validate(value[key], propPath, errs)
+				continue
+			}
+			switch {
+			case sc.noAdditional:
+				*errs = appendLimited(*errs, ValidationError{Path: propPath, Message: "additional property is not allowed"})
+			case sc.additionalProperties != nil:
+				sc.additionalProperties.validate(value[key], propPath, errs)
+			}
+		}
+	}
+}
+
+// Check the value matches one of the types.
+func (sc *Schema) matchType(v interface{}) bool {
+	actual := jsonType(v)
+	for _, t := range sc.types {
+		if t == actual {
+			return true
+		}
+		// integer is also a number
+		if t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON type name of the decoded value.
+func jsonType(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) && !math.IsInf(value, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// Append violation up to the limit.
+func appendLimited(errs []ValidationError, err ValidationError) []ValidationError {
+	if len(errs) < maxValidationErrors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Escape JSON Pointer reference token ( RFC 6901 ).
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// Convert float to the exact rational of its shortest decimal representation.
+// Returns nil for infinity and NaN.
+func decimalRat(f float64) *big.Rat {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	if !ok {
+		return nil
+	}
+	return r
+}
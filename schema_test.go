@@ -0,0 +1,36 @@
+package aun
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSchemaMultipleOfDecimal(t *testing.T) {
+	for _, c := range []struct {
+		multipleOf string
+		value      string
+		valid      bool
+	}{
+		{"0.1", "0.3", true},
+		{"0.1", "0.7", true},
+		{"0.01", "19.99", true},
+		{"0.1", "0.35", false},
+		{"3", "9", true},
+		{"3", "10", false},
+		{"2.5", "-7.5", true},
+		{"0.0001", "1e-4", true},
+		{"1e-10", "3e-10", true},
+		{"1e300", "3e300", true},
+		{"1e300", "3.5e300", false},
+	} {
+		schema, err := CompileSchema([]byte(`{"type": "number", "multipleOf": ` + c.multipleOf + `}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{}
+		json.Unmarshal([]byte(c.value), &v)
+		if errs := schema.Validate(v); (len(errs) == 0) != c.valid {
+			t.Fatalf("%s multipleOf %s: valid = %v, want %v", c.value, c.multipleOf, len(errs) == 0, c.valid)
+		}
+	}
+}
@@ -10,7 +10,23 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+)
+
+// Built-in broadcasting behavior for the received message.
+type BroadcastMode int
+
+const (
+	// Send to all clients including the sender
+	BroadcastAll BroadcastMode = iota
+
+	// Send to all clients except the sender
+	BroadcastOthers
+
+	// Don't broadcast, the received message is handled by OnMessage and RPC only
+	BroadcastNone
 )
 
 // TCP server with managing clients,
@@ -23,10 +39,13 @@ type Server struct {
 	socket net.Listener
 
 	// WebSocket clients
-	connections map[*Connection]bool
+	connections *registry
+
+	// Clients by application user ID
+	users *userIndex
 
 	// Max buffer size per message
-	maxDataSize int
+	maxDataSize atomic.Int64
 
 	// Broadcast channel
 	broadcast chan *Frame
@@ -37,18 +56,108 @@ type Server struct {
 	// Join the client channek
 	join chan *Connection
 
-	// Map Muten
-	mutex *sync.Mutex
-
 	// Exit channel
 	Exit chan int
 
+	// Per connection send queue size ( default 64 messages )
+	SendQueueSize int
+
+	// Behavior when a client can't keep up with sending messages
+	SlowConsumer SlowConsumerPolicy
+
+	// Max time to wait for a slow client ( default 10 seconds )
+	SendTimeout time.Duration
+
+	// Close the client when no data is received for the duration ( default 1 minute )
+	IdleTimeout time.Duration
+
+	// Broadcasting behavior for the received message ( default BroadcastAll )
+	Broadcast BroadcastMode
+
+	// Record broadcast messages for replaying on reconnect ( disabled if nil ).
+	// Clients request replay with "since" query or "Aun-Since" header on handshake.
+	History *History
+
+	// Use epoll event loop instead of goroutines per connection ( Linux only ).
+	// Falls back to goroutine mode if unavailable ( e.g. TLS connection ).
+	NetPoll bool
+
+	// netpoll mode poller
+	poller *poller
+
+	// Number of handler workers ( default number of CPUs ).
+	// Handlers for the same connection run in order on the same worker.
+	Workers int
+
+	// handler worker pool
+	workers     *workerPool
+	workersOnce sync.Once
+
+	// Keep the message order same for all clients
+	fanoutMutex sync.Mutex
+
+	// Internal hooks run on the server loop when client is joined or closed
+	joinHooks  []func(*Connection)
+	leaveHooks []func(*Connection)
+	hooksMutex sync.RWMutex
+
+	// Internal hooks run on the worker before OnMessage, returns true to consume the message
+	messageHooks []func(*Connection, *Frame) bool
+
+	// Hubs created on the server
+	hubs []*Hub
+
+	// RPC enabled by NewRPC()
+	rpc *RPC
+
+	// Supported subprotocols, the first one offered by the client is selected
+	Subprotocols []string
+
+	// Keep closed sessions for the duration to resume ( disabled if zero ).
+	// Resume token is issued with "Aun-Resume-Token" response header,
+	// clients resume with "resume" query or "Aun-Resume-Token" header on handshake.
+	Resume time.Duration
+
+	// Closed sessions for resumption
+	sessions *sessionStore
+
+	// Broker between nodes ( local broadcast if nil )
+	broker       Broker
+	brokerMutex  sync.RWMutex
+	unsubscribes []func()
+
+	// Cluster directory for sending to other nodes
+	cluster *Cluster
+
+	// Acknowledged delivery settings, Send() waits for acks if set.
+	// SendAck() uses the defaults if nil
+	Ack     *AckPolicy
+	ackOnce sync.Once
+
+	// net.Conn adapter hook registration, and listener adapting all connections
+	netConnOnce sync.Once
+	netListener atomic.Pointer[Listener]
+
 	// noop default handlers
 	OnMessage MessageHandler
 	OnClose   CloseHandler
 	OnConnect ConnectHandler
+	OnError   ErrorHandler
+
+	// Message handler with the sender connection, runs before OnMessage
+	OnReceive ReceiveHandler
+
+	// Bind application user ID to the client on handshake
+	Identify IdentifyHandler
+
+	// Fired on the first connection and after the last connection of the user
+	OnOnline  UserHandler
+	OnOffline UserHandler
 
 	terminate chan os.Signal
+
+	// Closed when the server loop finished
+	done chan struct{}
 }
 
 // Create New WebSocket Server.
@@ -60,12 +169,14 @@ func NewServer(host string, port int) (*Server, error) {
 
 	return &Server{
 		addr:        addr,
-		connections: make(map[*Connection]bool),
+		connections: newRegistry(),
+		users:       newUserIndex(),
+		sessions:    newSessionStore(),
 		broadcast:   make(chan *Frame),
 		manager:     make(chan *Connection),
 		join:        make(chan *Connection),
-		mutex:       new(sync.Mutex),
 		Exit:        make(chan int, 1),
+		done:        make(chan struct{}),
 	}, nil
 }
 
@@ -111,7 +222,17 @@ func (s *Server) ListenTLS(maxDataSize int, ssl *tls.Config) (err error) {
 func (s *Server) serve(maxDataSize int) {
 	defer s.socket.Close()
 
-	s.maxDataSize = maxDataSize
+	s.maxDataSize.Store(int64(maxDataSize))
+
+	if s.NetPoll {
+		p, err := newPoller()
+		if err != nil {
+			fmt.Println("netpoll disabled:", err)
+		} else {
+			s.poller = p
+			defer p.close()
+		}
+	}
 
 	// Loop and accepting client connection.
 	// Running with goroutine
@@ -125,40 +246,60 @@ func (s *Server) serve(maxDataSize int) {
 }
 
 func (s *Server) wait() {
+	defer close(s.done)
+	defer s.unsubscribeBroker()
 MAIN:
 	// Channel selection
 	for {
 		select {
 		// handle the broadcast
 		case frame := <-s.broadcast:
-			s.mutex.Lock()
-			if s.OnMessage != nil {
-				s.OnMessage(frame.PayloadData)
+			if frame.origin == nil {
+				s.broadcastMessage(frame)
+				break
 			}
-			for c, _ := range s.connections {
-				c.Write <- NewMessage(frame.toFrameBytes())
-			}
-			s.mutex.Unlock()
+			// message from client, run handler and broadcast on the worker
+			s.dispatchMessage(frame.origin, func() {
+				if s.runMessageHooks(frame.origin, frame) {
+					return
+				}
+				if s.OnReceive != nil {
+					s.OnReceive(frame.origin, frame.Opcode, frame.PayloadData)
+				}
+				if s.OnMessage != nil {
+					s.OnMessage(frame.PayloadData)
+				}
+				s.broadcastMessage(frame)
+			})
 
 		// handle the left client
 		case c := <-s.manager:
-			s.mutex.Lock()
-			if s.OnClose != nil {
-				s.OnClose(c)
+			if !s.connections.remove(c) {
+				break
 			}
-			if _, ok := s.connections[c]; ok {
-				delete(s.connections, c)
+			if !s.suspend(c) {
+				c.acks.close(ErrConnectionClosed)
+			}
+			s.unbindUser(c)
+			s.runLeaveHooks(c)
+			if s.OnClose != nil {
+				s.dispatch(c, func() {
+					s.OnClose(c)
+				})
 			}
-			s.mutex.Unlock()
 
 		// handle the join client
 		case c := <-s.join:
-			s.mutex.Lock()
+			if !s.register(c) {
+				break
+			}
+			s.bindUser(c)
+			s.runJoinHooks(c)
 			if s.OnConnect != nil {
-				s.OnConnect(c)
+				s.dispatch(c, func() {
+					s.OnConnect(c)
+				})
 			}
-			s.connections[c] = true
-			s.mutex.Unlock()
 
 		case <-s.Exit:
 			break MAIN
@@ -178,13 +319,202 @@ func (s *Server) acceptLoop(maxDataSize int) {
 			return
 		}
 
-		// Create new connection, and waiting message
+		// Create new connection, and waiting message.
+		// Connection joins to server after handshake is completed.
 		c := NewConnection(conn, maxDataSize)
-		s.join <- c
+		s.prepare(c)
+		if s.poller != nil {
+			if err := c.waitPoll(s.poller, s.broadcast, s.join, s.manager); err == nil {
+				continue
+			}
+		}
 		go c.Wait(s.broadcast, s.join, s.manager)
 	}
 }
 
+// Send message frame to all clients.
+func (s *Server) fanout(message *Frame) {
+	s.record(message, s.connections.each)
+}
+
+// Register joined client.
+// Requested history is replayed before any broadcast message.
+func (s *Server) register(c *Connection) bool {
+	s.fanoutMutex.Lock()
+	defer s.fanoutMutex.Unlock()
+
+	if s.History != nil && c.Request != nil {
+		if seq, ok := c.Request.replaySince(); ok {
+			c.replay(s.History.Since(seq))
+		}
+	}
+	s.restore(c)
+	return s.connections.add(c)
+}
+
+// Record message to history, and send to clients given by iterator.
+func (s *Server) record(message *Frame, each func(func(*Connection) bool)) {
+	s.fanoutMutex.Lock()
+	defer s.fanoutMutex.Unlock()
+
+	if s.History != nil {
+		message = s.History.record(message)
+	}
+	s.send(message, each)
+}
+
+// Iterator over clients matching predicate.
+func (s *Server) connectionsWhere(match func(*Connection) bool) func(func(*Connection) bool) {
+	return func(fn func(*Connection) bool) {
+		s.connections.each(func(c *Connection) bool {
+			if !match(c) {
+				return true
+			}
+			return fn(c)
+		})
+	}
+}
+
+// Send message frame to clients given by iterator.
+func (s *Server) deliver(message *Frame, each func(func(*Connection) bool)) {
+	s.fanoutMutex.Lock()
+	defer s.fanoutMutex.Unlock()
+
+	s.send(message, each)
+}
+
+// Send message frame to clients, must be called with fanout lock.
+// Frames are encoded once, and shared between all clients.
+func (s *Server) send(message *Frame, each func(func(*Connection) bool)) {
+	frames, err := buildFrames(message.PayloadData, message.Opcode, s.frameSize())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// all fragments take one queue slot, slow consumer policy drops the whole message
+	prepared := prepareMessage(frames)
+
+	each(func(c *Connection) bool {
+		c.enqueue(prepared)
+		return true
+	})
+}
+
+// Register internal hook for closed clients.
+// Hooks run on the server loop, so they must not block.
+func (s *Server) addLeaveHook(hook func(*Connection)) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.leaveHooks = append(s.leaveHooks, hook)
+}
+
+// Register internal hook for joined client.
+// Hooks run on the server loop, so they must not block.
+func (s *Server) addJoinHook(hook func(*Connection)) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.joinHooks = append(s.joinHooks, hook)
+}
+
+// Run internal hooks for joined client.
+func (s *Server) runJoinHooks(c *Connection) {
+	s.hooksMutex.RLock()
+	hooks := s.joinHooks
+	s.hooksMutex.RUnlock()
+
+	for _, hook := range hooks {
+		hook(c)
+	}
+}
+
+// Register internal hook for received messages.
+func (s *Server) addMessageHook(hook func(*Connection, *Frame) bool) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.messageHooks = append(s.messageHooks, hook)
+}
+
+// Register internal hook run before the others for received message.
+func (s *Server) prependMessageHook(hook func(*Connection, *Frame) bool) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.messageHooks = append([]func(*Connection, *Frame) bool{hook}, s.messageHooks...)
+}
+
+// Run internal hooks for received message.
+// Returns true if the message is consumed by a hook.
+func (s *Server) runMessageHooks(c *Connection, frame *Frame) bool {
+	s.hooksMutex.RLock()
+	hooks := s.messageHooks
+	s.hooksMutex.RUnlock()
+
+	for _, hook := range hooks {
+		if hook(c, frame) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run internal hooks for closed client.
+func (s *Server) runLeaveHooks(c *Connection) {
+	s.hooksMutex.RLock()
+	hooks := s.leaveHooks
+	s.hooksMutex.RUnlock()
+
+	for _, hook := range hooks {
+		hook(c)
+	}
+}
+
+// Select subprotocol from the client offer.
+func (s *Server) selectSubprotocol(req *Request) string {
+	s.hooksMutex.RLock()
+	defer s.hooksMutex.RUnlock()
+
+	for _, offered := range req.Subprotocols() {
+		for _, supported := range s.Subprotocols {
+			if offered == supported {
+				return offered
+			}
+		}
+	}
+	return ""
+}
+
+// Add supported subprotocol.
+func (s *Server) addSubprotocol(protocol string) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+
+	for _, supported := range s.Subprotocols {
+		if supported == protocol {
+			return
+		}
+	}
+	s.Subprotocols = append(s.Subprotocols, protocol)
+}
+
+// Max frame size for sending, may be read before listening.
+func (s *Server) frameSize() int {
+	if size := s.maxDataSize.Load(); size > 0 {
+		return int(size)
+	}
+	// Same as connection default
+	return 1024
+}
+
+// Apply server settings to the new connection.
+func (s *Server) prepare(c *Connection) {
+	c.server = s
+	c.serverDone = s.done
+	c.setSendQueue(s.SendQueueSize, s.SlowConsumer, s.SendTimeout)
+	if s.IdleTimeout > 0 {
+		c.idleTimeout = s.IdleTimeout
+	}
+	c.acks = newAckTracker(c, s.Ack)
+}
+
 // handling OS Signal
 func (s *Server) handleSignal(sig os.Signal) {
 	switch sig {
@@ -192,23 +522,68 @@ func (s *Server) handleSignal(sig os.Signal) {
 		fmt.Println("Terminating...")
 
 		// graceful closing
-		for c, _ := range s.connections {
-			c.Close <- struct{}{}
-		}
+		s.connections.each(func(c *Connection) bool {
+			c.CloseWith(CloseGoingAway, "")
+			return true
+		})
 
 		s.Exit <- 1
 	}
 }
 
+// Iterate connected clients.
+// Iteration runs over a snapshot so the callback may send or close freely.
+//
+// Example:
+//    for c := range srv.Connections() {
+//        fmt.Println(c.Stats())
+//    }
+func (s *Server) Connections() func(yield func(*Connection) bool) {
+	return func(yield func(*Connection) bool) {
+		s.connections.each(yield)
+	}
+}
+
+// Find connected client by connection ID.
+func (s *Server) Connection(id string) (*Connection, bool) {
+	return s.connections.get(id)
+}
+
+// Number of connected clients.
+func (s *Server) ConnectionCount() int {
+	return s.connections.len()
+}
+
 // Broadcast tp all clients
 func (s *Server) Notify(message []byte) error {
-	frames, err := BuildFrame(message, s.maxDataSize)
+	frame, err := BuildSingleFrame(message, 1, TextFrame)
 	if err != nil {
 		return err
 	}
-	for _, frame := range frames {
-		s.broadcast <- frame
+	s.broadcast <- frame
+
+	return nil
+}
+
+// Broadcast to all clients except the given connections
+func (s *Server) NotifyExcept(message []byte, except ...*Connection) error {
+	return s.NotifyWhere(message, func(c *Connection) bool {
+		for _, e := range except {
+			if c == e {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Broadcast to clients which the predicate returns true
+func (s *Server) NotifyWhere(message []byte, match func(*Connection) bool) error {
+	frame, err := BuildSingleFrame(message, 1, TextFrame)
+	if err != nil {
+		return err
 	}
+	s.deliver(frame, s.connectionsWhere(match))
 
 	return nil
 }
@@ -217,19 +592,11 @@ func (s *Server) Notify(message []byte) error {
 func (s *Server) NotifyTo(message []byte, to *Connection) error {
 
 	// Check client is connected
-	if _, ok := s.connections[to]; !ok {
+	if !s.connections.has(to) {
 		return errors.New("Client not connected, abort send message.")
 	}
 
-	frames, err := BuildFrame(message, s.maxDataSize)
-	if err != nil {
-		return err
-	}
-	for _, f := range frames {
-		to.Write <- NewMessage(f.toFrameBytes())
-	}
-
-	return nil
+	return to.enqueueMessage(message, TextFrame)
 }
 
 type HandlerServer struct {
@@ -241,24 +608,29 @@ type HandlerCallback func(*Connection)
 func NewHandlerServer(handler HandlerCallback) *HandlerServer {
 	hs := &HandlerServer{
 		Server: &Server{
-			connections: make(map[*Connection]bool),
+			connections: newRegistry(),
+			users:       newUserIndex(),
+			sessions:    newSessionStore(),
 			broadcast:   make(chan *Frame),
 			manager:     make(chan *Connection),
 			join:        make(chan *Connection),
-			mutex:       new(sync.Mutex),
 			Exit:        make(chan int, 2),
-			maxDataSize: 4096,
+			done:        make(chan struct{}),
 		},
 		callback: handler,
 	}
+	hs.maxDataSize.Store(4096)
 	go hs.wait()
 	return hs
 }
 
+// Process handshake and start the connection.
+// Handshake response is written by the connection before any message.
 func (hs *HandlerServer) Connect(conn net.Conn, req *Request) (*Connection, error) {
 	// Create new connection, and waiting message
 	c := NewConnection(conn, 4096)
-	if err := c.handshake(req, true); err != nil {
+	hs.prepare(c)
+	if err := c.handshake(req); err != nil {
 		return nil, err
 	}
 	go c.Wait(hs.broadcast, hs.join, hs.manager)
@@ -287,10 +659,11 @@ func (hs *HandlerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req := &Request{
-		Method:  r.Method,
-		Path:    r.URL.Path,
-		Version: r.Proto,
-		Headers: headers,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+		Version:  r.Proto,
+		Headers:  headers,
 	}
 	c, err := hs.Connect(conn, req)
 
@@ -303,9 +676,5 @@ func (hs *HandlerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := NewResponse(req)
-	fmt.Fprint(buf, string(response.getData()))
-	buf.Flush()
-
 	hs.callback(c)
 }
@@ -0,0 +1,79 @@
+package aun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotifyExcept(t *testing.T) {
+	s, url, connected := newTestServer(t, nil)
+	clientA, _ := dialTest(t, url, connected)
+	clientB, b := dialTest(t, url, connected)
+	clientC, _ := dialTest(t, url, connected)
+
+	if err := s.NotifyExcept([]byte("hello"), b); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, clientA, "hello")
+	expectMessage(t, clientC, "hello")
+	expectNoMessage(t, clientB, b)
+}
+
+func TestNotifyWhere(t *testing.T) {
+	s, url, connected := newTestServer(t, nil)
+	clientA, a := dialTest(t, url, connected)
+	clientB, b := dialTest(t, url, connected)
+	a.Set("role", "admin")
+
+	err := s.NotifyWhere([]byte("admins only"), func(c *Connection) bool {
+		role, _ := c.Get("role")
+		return role == "admin"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, clientA, "admins only")
+	expectNoMessage(t, clientB, b)
+}
+
+func TestBroadcastOthers(t *testing.T) {
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastOthers
+	})
+	clientA, a := dialTest(t, url, connected)
+	clientB, _ := dialTest(t, url, connected)
+
+	if err := clientA.Send([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	// fan-out to all clients is done when one receives
+	expectMessage(t, clientB, "hi")
+	expectNoMessage(t, clientA, a)
+}
+
+func TestBroadcastNone(t *testing.T) {
+	received := make(chan string, 2)
+	_, url, connected := newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		s.OnReceive = func(c *Connection, opcode int, message []byte) {
+			received <- string(message)
+		}
+	})
+	clientA, a := dialTest(t, url, connected)
+	clientB, b := dialTest(t, url, connected)
+
+	// handlers of the connection run in order, the first message is done when the second is handled
+	for _, m := range []string{"hi", "again"} {
+		clientA.Send([]byte(m))
+		select {
+		case got := <-received:
+			if got != m {
+				t.Fatalf("received %q, want %q", got, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not handled")
+		}
+	}
+	expectNoMessage(t, clientA, a)
+	expectNoMessage(t, clientB, b)
+}
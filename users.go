@@ -0,0 +1,156 @@
+package aun
+
+import (
+	"errors"
+	"sync"
+)
+
+// Index of connections by application user ID.
+type userIndex struct {
+	mutex sync.RWMutex
+	conns map[string]map[*Connection]struct{}
+}
+
+// Create new user index.
+func newUserIndex() *userIndex {
+	return &userIndex{
+		conns: make(map[string]map[*Connection]struct{}),
+	}
+}
+
+// Add connection. Returns true if it's the first connection of the user.
+func (u *userIndex) add(c *Connection) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.conns[c.UserId] == nil {
+		u.conns[c.UserId] = make(map[*Connection]struct{})
+	}
+	u.conns[c.UserId][c] = struct{}{}
+	return len(u.conns[c.UserId]) == 1
+}
+
+// Remove connection. Returns true if it was the last connection of the user.
+func (u *userIndex) remove(c *Connection) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if _, ok := u.conns[c.UserId][c]; !ok {
+		return false
+	}
+	delete(u.conns[c.UserId], c)
+	if len(u.conns[c.UserId]) > 0 {
+		return false
+	}
+	delete(u.conns, c.UserId)
+	return true
+}
+
+// Get connections of the user.
+func (u *userIndex) get(userId string) []*Connection {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	conns := make([]*Connection, 0, len(u.conns[userId]))
+	for c := range u.conns[userId] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Bind connection to user on server loop, and fire online hook.
+func (s *Server) bindUser(c *Connection) {
+	if c.UserId == "" || !s.users.add(c) || s.OnOnline == nil {
+		return
+	}
+	// presence hooks run on the user's worker to keep online/offline order
+	s.dispatchKey(c.UserId, c, func() {
+		s.OnOnline(c.UserId)
+	})
+}
+
+// Unbind connection from user on server loop, and fire offline hook.
+func (s *Server) unbindUser(c *Connection) {
+	if c.UserId == "" || !s.users.remove(c) || s.OnOffline == nil {
+		return
+	}
+	s.dispatchKey(c.UserId, c, func() {
+		s.OnOffline(c.UserId)
+	})
+}
+
+// Get live connections of the user.
+func (s *Server) UserConnections(userId string) []*Connection {
+	return s.users.get(userId)
+}
+
+// Send message to all connections of the user.
+// Connections on other cluster nodes receive it through the cluster.
+func (s *Server) SendToUser(userId string, message []byte) error {
+	sent := s.sendToLocalUser(userId, message)
+	if cluster := s.currentCluster(); cluster != nil {
+		for _, nodeId := range cluster.UserNodes(userId) {
+			if nodeId == cluster.NodeId {
+				continue
+			}
+			cluster.publish(&clusterMessage{
+				Type:    clusterSendUser,
+				To:      nodeId,
+				Target:  userId,
+				Payload: message,
+			})
+			sent = true
+		}
+	}
+	if !sent {
+		return errors.New("User not connected, abort send message.")
+	}
+	return nil
+}
+
+// Send message to the user connections on this node.
+func (s *Server) sendToLocalUser(userId string, message []byte) bool {
+	conns := s.users.get(userId)
+	if len(conns) == 0 {
+		return false
+	}
+
+	frame, err := BuildSingleFrame(message, 1, TextFrame)
+	if err != nil {
+		return false
+	}
+	s.deliver(frame, func(fn func(*Connection) bool) {
+		for _, c := range conns {
+			if !fn(c) {
+				return
+			}
+		}
+	})
+	return true
+}
+
+// Close all connections of the user with status code,
+// including connections on other cluster nodes.
+func (s *Server) DisconnectUser(userId string, code int) {
+	s.disconnectLocalUser(userId, code)
+	if cluster := s.currentCluster(); cluster != nil {
+		for _, nodeId := range cluster.UserNodes(userId) {
+			if nodeId == cluster.NodeId {
+				continue
+			}
+			cluster.publish(&clusterMessage{
+				Type:   clusterDisconnectUser,
+				To:     nodeId,
+				Target: userId,
+				Code:   code,
+			})
+		}
+	}
+}
+
+// Close the user connections on this node.
+func (s *Server) disconnectLocalUser(userId string, code int) {
+	for _, c := range s.users.get(userId) {
+		c.CloseWith(code, "")
+	}
+}
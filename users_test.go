@@ -0,0 +1,123 @@
+package aun
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test server binding users by X-User header.
+func newTestUserServer(t *testing.T, online, offline chan string) (*Server, string, chan *Connection) {
+	t.Helper()
+	return newTestServer(t, func(s *Server) {
+		s.Broadcast = BroadcastNone
+		s.Identify = func(c *Connection, req *Request) (string, error) {
+			if req.Headers["X-User"] == "blocked" {
+				return "", errors.New("blocked")
+			}
+			return req.Headers["X-User"], nil
+		}
+		s.OnOnline = func(userId string) { online <- userId }
+		s.OnOffline = func(userId string) { offline <- userId }
+	})
+}
+
+func dialUser(t *testing.T, url, user string, connected chan *Connection) (*ClientConn, *Connection) {
+	t.Helper()
+	return dialTestWith(t, &Dialer{Header: map[string]string{"X-User": user}}, url, connected)
+}
+
+func expectUserEvent(t *testing.T, events chan string, want string) {
+	t.Helper()
+	select {
+	case userId := <-events:
+		if userId != want {
+			t.Fatalf("event for %s, want %s", userId, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event for %s", want)
+	}
+}
+
+func TestUserFanOut(t *testing.T) {
+	online := make(chan string, 4)
+	offline := make(chan string, 4)
+	s, url, connected := newTestUserServer(t, online, offline)
+
+	tab1, c1 := dialUser(t, url, "alice", connected)
+	tab2, _ := dialUser(t, url, "alice", connected)
+	other, o := dialUser(t, url, "bob", connected)
+	if c1.UserId != "alice" {
+		t.Fatalf("user = %q, want alice", c1.UserId)
+	}
+	expectUserEvent(t, online, "alice")
+	expectUserEvent(t, online, "bob")
+
+	if n := len(s.UserConnections("alice")); n != 2 {
+		t.Fatalf("alice has %d connections, want 2", n)
+	}
+	if err := s.SendToUser("alice", []byte("hello alice")); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, tab1, "hello alice")
+	expectMessage(t, tab2, "hello alice")
+	expectNoMessage(t, other, o)
+
+	if err := s.SendToUser("carol", []byte("hello")); err == nil {
+		t.Fatal("sent to the user without connection")
+	}
+}
+
+func TestUserOnlineOffline(t *testing.T) {
+	online := make(chan string, 4)
+	offline := make(chan string, 4)
+	s, url, connected := newTestUserServer(t, online, offline)
+
+	tab1, _ := dialUser(t, url, "alice", connected)
+	expectUserEvent(t, online, "alice")
+	tab2, _ := dialUser(t, url, "alice", connected)
+
+	// offline after the last connection
+	closeClient(tab1)
+	eventually(t, "closed connection is still bound", func() bool {
+		return len(s.UserConnections("alice")) == 1
+	})
+	select {
+	case userId := <-offline:
+		t.Fatalf("%s is offline with a live connection", userId)
+	case <-online:
+		t.Fatal("online fired twice")
+	default:
+	}
+	closeClient(tab2)
+	expectUserEvent(t, offline, "alice")
+}
+
+func TestDisconnectUser(t *testing.T) {
+	online := make(chan string, 4)
+	offline := make(chan string, 4)
+	s, url, connected := newTestUserServer(t, online, offline)
+
+	tab1, _ := dialUser(t, url, "alice", connected)
+	tab2, _ := dialUser(t, url, "alice", connected)
+	other, o := dialUser(t, url, "bob", connected)
+
+	s.DisconnectUser("alice", ClosePolicyViolation)
+	for _, tab := range []*ClientConn{tab1, tab2} {
+		_, _, err := tab.ReadMessage()
+		if ce, ok := err.(*CloseError); !ok || ce.Code != ClosePolicyViolation {
+			t.Fatalf("close error = %v, want %d", err, ClosePolicyViolation)
+		}
+	}
+	expectUserEvent(t, offline, "alice")
+	expectNoMessage(t, other, o)
+}
+
+func TestIdentifyRejects(t *testing.T) {
+	_, url, _ := newTestUserServer(t, make(chan string, 1), make(chan string, 1))
+	d := &Dialer{Header: map[string]string{"X-User": "blocked"}}
+	if c, err := d.Dial(url); err == nil {
+		closeClient(c)
+		t.Fatal("handshake is accepted for the rejected user")
+	}
+}
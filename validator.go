@@ -0,0 +1,212 @@
+package aun
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// Behavior for the message rejected by the validator.
+type ValidationAction int
+
+const (
+	// Drop the message and reply the structured error:
+	//
+	//	{"error": "invalid_message", "event": "chat", "errors": [{"path": "/data/text", "message": "..."}]}
+	//	{"error": "invalid_json"}
+	ValidationReply ValidationAction = iota
+
+	// Drop the message and close the connection,
+	// with 1007 for malformed JSON and 1008 for schema violation.
+	ValidationClose
+)
+
+// Rejection error reply.
+type validationReply struct {
+	Error  string            `json:"error"`
+	Event  string            `json:"event,omitempty"`
+	Errors []ValidationError `json:"errors,omitempty"`
+}
+
+// Validation statistics snapshot.
+type ValidationStats struct {
+	// Messages checked against the schemas
+	Validated int64
+
+	// Messages rejected, including malformed JSON
+	Rejected int64
+
+	// Rejected messages which are not JSON
+	Malformed int64
+
+	// Rejected messages per event name and route path
+	Events map[string]int64
+	Routes map[string]int64
+}
+
+// JSON Schema validator of incoming text messages.
+// Invalid messages are rejected before any other message handling ( events, RPC, OnMessage and broadcasting ).
+//
+// Schema of the route applies to every text message on the connections of the request path,
+// and schema of the event applies to "data" of {"event": ..., "data": ...} messages.
+type Validator struct {
+	server *Server
+
+	// Behavior for the rejected message
+	Action ValidationAction
+
+	mutex  sync.RWMutex
+	events map[string]*Schema
+	routes map[string]*Schema
+
+	// Metrics
+	validated  atomic.Int64
+	rejected   atomic.Int64
+	malformed  atomic.Int64
+	statsMutex sync.Mutex
+	byEvent    map[string]int64
+	byRoute    map[string]int64
+}
+
+// Enable message validation on the server.
+func NewValidator(s *Server) *Validator {
+	v := &Validator{
+		server:  s,
+		events:  make(map[string]*Schema),
+		routes:  make(map[string]*Schema),
+		byEvent: make(map[string]int64),
+		byRoute: make(map[string]int64),
+	}
+	// validation must precede the hooks consuming messages
+	s.prependMessageHook(v.handle)
+	return v
+}
+
+// Register schema of the event data.
+func (v *Validator) Event(event string, schema *Schema) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.events[event] = schema
+}
+
+// Register schema of messages on the request path ( query string is ignored ).
+func (v *Validator) Route(path string, schema *Schema) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.routes[path] = schema
+}
+
+// Take a snapshot of validation statistics.
+func (v *Validator) Stats() ValidationStats {
+	v.statsMutex.Lock()
+	defer v.statsMutex.Unlock()
+
+	stats := ValidationStats{
+		Validated: v.validated.Load(),
+		Rejected:  v.rejected.Load(),
+		Malformed: v.malformed.Load(),
+		Events:    make(map[string]int64, len(v.byEvent)),
+		Routes:    make(map[string]int64, len(v.byRoute)),
+	}
+	for k, n := range v.byEvent {
+		stats.Events[k] = n
+	}
+	for k, n := range v.byRoute {
+		stats.Routes[k] = n
+	}
+	return stats
+}
+
+// Message hook to validate text messages.
+// Returns true when the message is rejected.
+func (v *Validator) handle(c *Connection, frame *Frame) bool {
+	if frame.Opcode != TextFrame {
+		return false
+	}
+
+	var route string
+	if c.Request != nil {
+		route = c.Request.Path
+	}
+	v.mutex.RLock()
+	routeSchema := v.routes[route]
+	hasEvents := len(v.events) > 0
+	v.mutex.RUnlock()
+	if routeSchema == nil && !hasEvents {
+		return false
+	}
+
+	var message interface{}
+	if err := json.Unmarshal(frame.PayloadData, &message); err != nil {
+		// non JSON message is rejected only on the validated route
+		if routeSchema == nil {
+			return false
+		}
+		v.malformed.Add(1)
+		v.reject(c, "", route, nil, CloseInvalidPayload)
+		return true
+	}
+
+	if routeSchema != nil {
+		v.validated.Add(1)
+		if errs := routeSchema.Validate(message); len(errs) > 0 {
+			v.reject(c, "", route, errs, ClosePolicyViolation)
+			return true
+		}
+	}
+
+	object, ok := message.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	event, ok := object["event"].(string)
+	if !ok {
+		return false
+	}
+	v.mutex.RLock()
+	eventSchema := v.events[event]
+	v.mutex.RUnlock()
+	if eventSchema == nil {
+		return false
+	}
+
+	v.validated.Add(1)
+	var errs []ValidationError
+	eventSchema.validate(object["data"], "/data", &errs)
+	if len(errs) > 0 {
+		v.reject(c, event, "", errs, ClosePolicyViolation)
+		return true
+	}
+	return false
+}
+
+// Count the rejection and reply error or close the connection.
+func (v *Validator) reject(c *Connection, event, route string, errs []ValidationError, code int) {
+	v.rejected.Add(1)
+	c.messagesRejected.Add(1)
+
+	v.statsMutex.Lock()
+	if event != "" {
+		v.byEvent[event]++
+	} else {
+		v.byRoute[route]++
+	}
+	v.statsMutex.Unlock()
+
+	if v.Action == ValidationClose {
+		reason := "Invalid message"
+		if code == CloseInvalidPayload {
+			reason = "Invalid JSON"
+		}
+		c.CloseWith(code, reason)
+		return
+	}
+
+	reply := validationReply{Error: "invalid_message", Event: event, Errors: errs}
+	if code == CloseInvalidPayload {
+		reply.Error = "invalid_json"
+	}
+	if data, err := json.Marshal(reply); err == nil {
+		c.enqueueMessage(data, TextFrame)
+	}
+}
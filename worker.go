@@ -0,0 +1,159 @@
+package aun
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+// Queued jobs per worker
+const workerQueueSize = 1024
+
+var ErrWorkerBusy = errors.New("Handler worker is busy, message dropped")
+
+// Worker pool running event handlers.
+// Jobs for the same key ( connection ID ) always run on the same worker,
+// so the handler order per connection is kept.
+type workerPool struct {
+	workers []*worker
+}
+
+// Single worker queue.
+// Jobs which must run are kept in overflow when the queue is full,
+// so the server loop never waits for slow handlers.
+type worker struct {
+	queue chan func()
+
+	mutex    sync.Mutex
+	overflow []func()
+}
+
+// Create worker pool and start workers.
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	p := &workerPool{
+		workers: make([]*worker, size),
+	}
+	for i := range p.workers {
+		w := &worker{queue: make(chan func(), workerQueueSize)}
+		p.workers[i] = w
+		go w.work()
+	}
+	return p
+}
+
+// Queue the job to the worker for key without blocking.
+// If the queue is full, the job is kept in overflow when must is true,
+// otherwise it is discarded and returns false.
+func (p *workerPool) dispatch(key string, job func(), must bool) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	w := p.workers[h.Sum32()%uint32(len(p.workers))]
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	// jobs must not overtake the overflow
+	if len(w.overflow) == 0 {
+		select {
+		case w.queue <- job:
+			return true
+		default:
+		}
+	}
+	if !must {
+		return false
+	}
+	w.overflow = append(w.overflow, job)
+	return true
+}
+
+// Run queued jobs, and overflow jobs after the queue is drained.
+// Overflow is added only while the queue is full, so the worker is never idle with overflow.
+func (w *worker) work() {
+	for {
+		select {
+		case job := <-w.queue:
+			job()
+			continue
+		default:
+		}
+		if job := w.shift(); job != nil {
+			job()
+			continue
+		}
+		job := <-w.queue
+		job()
+	}
+}
+
+// Take the first overflow job ( nil if empty ).
+func (w *worker) shift() func() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.overflow) == 0 {
+		return nil
+	}
+	job := w.overflow[0]
+	w.overflow[0] = nil
+	w.overflow = w.overflow[1:]
+	return job
+}
+
+// Get worker pool, create on first use.
+func (s *Server) pool() *workerPool {
+	s.workersOnce.Do(func() {
+		s.workers = newWorkerPool(s.Workers)
+	})
+	return s.workers
+}
+
+// Run lifecycle handler on the worker for the connection.
+// Panic in the handler is recovered, reported to OnError,
+// and the connection is closed with 1011.
+func (s *Server) dispatch(c *Connection, handler func()) {
+	s.dispatchKey(c.Id, c, handler)
+}
+
+// Run message handler on the worker for the connection.
+// If the worker is too busy, the message is dropped, reported to OnError,
+// and the connection is closed with 1013.
+func (s *Server) dispatchMessage(c *Connection, handler func()) {
+	if s.pool().dispatch(c.Id, s.recovered(c, handler), false) {
+		return
+	}
+	c.messagesDropped.Add(1)
+	s.handleError(c, ErrWorkerBusy)
+	go c.CloseWith(CloseTryAgainLater, "server busy")
+}
+
+// Run lifecycle handler on the worker for the key, it is never dropped.
+// The connection is closed on panic.
+func (s *Server) dispatchKey(key string, c *Connection, handler func()) {
+	s.pool().dispatch(key, s.recovered(c, handler), true)
+}
+
+// Wrap handler to recover panic.
+func (s *Server) recovered(c *Connection, handler func()) func() {
+	return func() {
+		defer func() {
+			if r := recover(); r != nil {
+				s.handleError(c, fmt.Errorf("Handler panic: %v", r))
+				c.CloseWith(CloseInternalError, "internal error")
+			}
+		}()
+		handler()
+	}
+}
+
+// Report handler error.
+func (s *Server) handleError(c *Connection, err error) {
+	if s.OnError != nil {
+		s.OnError(c, err)
+		return
+	}
+	fmt.Println(err)
+}
@@ -0,0 +1,75 @@
+package aun
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerDispatchDoesNotBlock(t *testing.T) {
+	p := newWorkerPool(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	p.dispatch("a", func() {
+		close(started)
+		<-release
+	}, false)
+	<-started
+
+	var mutex sync.Mutex
+	var order []int
+	record := func(i int) func() {
+		return func() {
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+		}
+	}
+
+	// fill the queue, worker is blocked by the first job
+	for i := 0; i < workerQueueSize; i++ {
+		if !p.dispatch("a", record(i), false) {
+			t.Fatalf("job %d is rejected before the queue is full", i)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- p.dispatch("a", record(-1), false)
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("job is queued over the queue size")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked on the full queue")
+	}
+
+	// jobs which must run are kept in order
+	p.dispatch("a", record(workerQueueSize), true)
+	p.dispatch("a", record(workerQueueSize+1), true)
+	if p.dispatch("a", record(-1), false) {
+		t.Fatal("job overtakes the overflow")
+	}
+
+	finished := make(chan struct{})
+	p.dispatch("a", func() { close(finished) }, true)
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued jobs are not run")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(order) != workerQueueSize+2 {
+		t.Fatalf("run %d jobs, want %d", len(order), workerQueueSize+2)
+	}
+	for i, n := range order {
+		if i != n {
+			t.Fatalf("job %d run at %d", n, i)
+		}
+	}
+}